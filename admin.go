@@ -0,0 +1,355 @@
+package webdav
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wwqdrh/gokit/logger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const adminPrefix = APIPrefix + "admin/"
+
+// serveAdmin serves the administration API. Only administrators may use
+// it.
+func (c *Config) serveAdmin(w http.ResponseWriter, r *http.Request, u *User) {
+	if !u.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	route := strings.TrimPrefix(r.URL.Path, adminPrefix)
+	switch {
+	case route == "lockouts" || strings.HasPrefix(route, "lockouts/"):
+		c.serveLockouts(w, r, u, strings.TrimPrefix(strings.TrimPrefix(route, "lockouts"), "/"))
+	case route == "users" || strings.HasPrefix(route, "users/"):
+		c.serveUsers(w, r, u, strings.TrimPrefix(strings.TrimPrefix(route, "users"), "/"))
+	case route == "sessions" && r.Method == "GET":
+		sessions := c.sessionTable().list(time.Now())
+		if name := r.URL.Query().Get("user"); name != "" {
+			filtered := []Session{}
+			for _, s := range sessions {
+				if s.Username == name {
+					filtered = append(filtered, s)
+				}
+			}
+			sessions = filtered
+		}
+		writeJSON(w, http.StatusOK, sessions)
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+}
+
+// serveLockouts lists the throttled usernames and addresses (GET) and
+// unlocks one of them (DELETE lockouts/user/<name> or lockouts/ip/<addr>).
+func (c *Config) serveLockouts(w http.ResponseWriter, r *http.Request, u *User, target string) {
+	if c.Guard == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && target == "":
+		states := c.Guard.States(time.Now())
+		if states == nil {
+			states = []LockState{}
+		}
+		writeJSON(w, http.StatusOK, states)
+	case r.Method == "DELETE":
+		kind, key, ok := strings.Cut(target, "/")
+		if !ok || (kind != "user" && kind != "ip") || !c.Guard.Unlock(kind, key) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		c.audit(AuditEvent{Type: "unlock", Username: u.Username, IP: clientIP(r), Detail: kind + " " + key})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errUserExists   = errors.New("user already exists")
+)
+
+// Quota reports the storage used by a user and the rate limit applying
+// to it.
+type Quota struct {
+	Username  string    `json:"username"`
+	Scope     string    `json:"scope"`
+	UsedBytes int64     `json:"usedBytes"`
+	Files     int       `json:"files"`
+	RateLimit RateLimit `json:"rateLimit"`
+}
+
+// serveUsers manages the users of the configuration file:
+//
+//	GET    users                  list the users
+//	POST   users                  create a user
+//	GET    users/<name>           show a user
+//	PUT    users/<name>           replace a user, keeping unset passwords
+//	DELETE users/<name>           delete a user
+//	PUT    users/<name>/password  set the password ({"password": "..."})
+//	GET    users/<name>/rules     show the rules of a user
+//	PUT    users/<name>/rules     replace the rules of a user
+//	POST   users/<name>/disable   refuse the logins of a user
+//	POST   users/<name>/enable    accept them again
+//	GET    users/<name>/quota     show the storage used by a user
+//
+// Passwords are stored as bcrypt hashes and never returned. Changes are
+// written back to the configuration file and take effect immediately.
+func (c *Config) serveUsers(w http.ResponseWriter, r *http.Request, admin *User, target string) {
+	name, action, _ := strings.Cut(target, "/")
+
+	if r.Method == "GET" && action == "quota" {
+		c.serveQuota(w, name)
+		return
+	}
+	if c.reloader == nil {
+		http.Error(w, "the configuration is not backed by a file", http.StatusNotImplemented)
+		return
+	}
+
+	var (
+		result interface{}
+		status = http.StatusOK
+		change string
+		err    error
+	)
+	switch {
+	case r.Method == "GET" && target == "":
+		users := []UserConfig{}
+		for _, uc := range c.reloader.FileConfig().Users {
+			users = append(users, redactUser(uc))
+		}
+		result = users
+	case r.Method == "POST" && target == "":
+		var uc UserConfig
+		if err := json.NewDecoder(r.Body).Decode(&uc); err != nil || uc.Username == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err = hashUserPasswords(&uc, nil); err == nil {
+			err = c.reloader.Update(func(fc *FileConfig) error {
+				if findUser(fc, uc.Username) != nil {
+					return errUserExists
+				}
+				fc.Users = append(fc.Users, uc)
+				return nil
+			})
+		}
+		result, status, change = redactUser(uc), http.StatusCreated, "create user "+uc.Username
+	case name == "":
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	case r.Method == "GET" && action == "":
+		uc := findUser(c.reloader.FileConfig(), name)
+		if uc == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		result = redactUser(*uc)
+	case r.Method == "PUT" && action == "":
+		var uc UserConfig
+		if err := json.NewDecoder(r.Body).Decode(&uc); err != nil || (uc.Username != "" && uc.Username != name) {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		uc.Username = name
+		err = c.reloader.Update(func(fc *FileConfig) error {
+			old := findUser(fc, name)
+			if old == nil {
+				return errUserNotFound
+			}
+			if err := hashUserPasswords(&uc, old); err != nil {
+				return err
+			}
+			*old = uc
+			return nil
+		})
+		result, change = redactUser(uc), "update user "+name
+	case r.Method == "DELETE" && action == "":
+		err = c.reloader.Update(func(fc *FileConfig) error {
+			for i := range fc.Users {
+				if fc.Users[i].Username == name {
+					fc.Users = append(fc.Users[:i], fc.Users[i+1:]...)
+					return nil
+				}
+			}
+			return errUserNotFound
+		})
+		status, change = http.StatusNoContent, "delete user "+name
+	case r.Method == "PUT" && action == "password":
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		err = c.updateUser(name, func(uc *UserConfig) error {
+			uc.Password = req.Password
+			return hashUserPasswords(uc, nil)
+		})
+		status, change = http.StatusNoContent, "set password of "+name
+	case r.Method == "GET" && action == "rules":
+		uc := findUser(c.reloader.FileConfig(), name)
+		if uc == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		result = append([]RuleConfig{}, uc.Rules...)
+	case r.Method == "PUT" && action == "rules":
+		var rules []RuleConfig
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		err = c.updateUser(name, func(uc *UserConfig) error {
+			uc.Rules = rules
+			return nil
+		})
+		result, change = append([]RuleConfig{}, rules...), "set rules of "+name
+	case r.Method == "POST" && (action == "disable" || action == "enable"):
+		err = c.updateUser(name, func(uc *UserConfig) error {
+			uc.Disabled = action == "disable"
+			return nil
+		})
+		status, change = http.StatusNoContent, action+" user "+name
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	case errors.Is(err, errUserExists):
+		http.Error(w, "Conflict", http.StatusConflict)
+		return
+	case errors.Is(err, ErrInvalidConfig):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		logger.DefaultLogger.Error("update users: " + err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if change != "" {
+		c.audit(AuditEvent{Type: "admin", Username: admin.Username, IP: clientIP(r), Detail: change})
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, result)
+}
+
+// updateUser applies fn to the configuration of the user called name.
+func (c *Config) updateUser(name string, fn func(uc *UserConfig) error) error {
+	return c.reloader.Update(func(fc *FileConfig) error {
+		uc := findUser(fc, name)
+		if uc == nil {
+			return errUserNotFound
+		}
+		return fn(uc)
+	})
+}
+
+// serveQuota reports the storage used in the scope of a configured user.
+func (c *Config) serveQuota(w http.ResponseWriter, name string) {
+	u, ok := c.Users[name]
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	q := Quota{Username: u.Username, Scope: u.Scope, RateLimit: c.RateLimit}
+	if u.RateLimit != nil {
+		q.RateLimit = *u.RateLimit
+	}
+	err := filepath.WalkDir(u.Scope, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		q.UsedBytes += info.Size()
+		q.Files++
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
+
+func findUser(fc *FileConfig, name string) *UserConfig {
+	for i := range fc.Users {
+		if fc.Users[i].Username == name {
+			return &fc.Users[i]
+		}
+	}
+	return nil
+}
+
+// redactUser returns a copy of uc without its passwords.
+func redactUser(uc UserConfig) UserConfig {
+	uc.Password = ""
+	uc.AppPasswords = append([]AppPasswordConfig{}, uc.AppPasswords...)
+	for i := range uc.AppPasswords {
+		uc.AppPasswords[i].Password = ""
+	}
+	return uc
+}
+
+// hashUserPasswords hashes the plain text passwords of uc. Empty
+// passwords are taken from old, the previous version of the user, when
+// there is one.
+func hashUserPasswords(uc *UserConfig, old *UserConfig) error {
+	if uc.Password == "" && old != nil {
+		uc.Password = old.Password
+	} else if err := hashPassword(&uc.Password); err != nil {
+		return err
+	}
+
+	for i := range uc.AppPasswords {
+		ap := &uc.AppPasswords[i]
+		if ap.Password == "" && old != nil {
+			for _, prev := range old.AppPasswords {
+				if prev.Name == ap.Name {
+					ap.Password = prev.Password
+				}
+			}
+			continue
+		}
+		if err := hashPassword(&ap.Password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashPassword(password *string) error {
+	if *password == "" || strings.HasPrefix(*password, "{bcrypt}") {
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	*password = "{bcrypt}" + string(hash)
+	return nil
+}
@@ -0,0 +1,124 @@
+package webdav
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminUsers(t *testing.T) {
+	dir := t.TempDir()
+	scope := filepath.Join(dir, "data")
+	if err := os.Mkdir(scope, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(scope, "file.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(dir, "config.json")
+	err := os.WriteFile(path, []byte(`{"scope": "`+scope+`", "users": [
+		{"username": "admin", "password": "admin", "admin": true},
+		{"username": "bob", "password": "bob"}
+	]}`), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl, err := NewReloader(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	do := func(method, target, user, password, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, r)
+		return w
+	}
+	admin := func(method, route, body string, status int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := do(method, adminPrefix+route, "admin", "admin", body)
+		if w.Code != status {
+			t.Fatalf("%s %s: expected status %d, got %d: %s", method, route, status, w.Code, w.Body)
+		}
+		return w
+	}
+
+	if w := do("GET", adminPrefix+"users", "bob", "bob", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected non-admins to be refused, got %d", w.Code)
+	}
+
+	var users []UserConfig
+	if err := json.NewDecoder(admin("GET", "users", "", http.StatusOK).Body).Decode(&users); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(users) != 2 || users[1].Username != "bob" || users[1].Password != "" {
+		t.Errorf("unexpected users %+v", users)
+	}
+
+	admin("POST", "users", `{"username": "carol", "password": "secret", "modify": true}`, http.StatusCreated)
+	admin("POST", "users", `{"username": "carol", "password": "other"}`, http.StatusConflict)
+	admin("POST", "users", `{"username": "dave", "groups": ["missing"]}`, http.StatusBadRequest)
+	if w := do("PUT", "/new.txt", "carol", "secret", "hello"); w.Code != http.StatusCreated {
+		t.Errorf("expected the new user to write, got %d", w.Code)
+	}
+
+	fc, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	carol := findUser(fc, "carol")
+	if carol == nil || !strings.HasPrefix(carol.Password, "{bcrypt}") {
+		t.Fatalf("expected carol to be persisted with a hashed password, got %+v", carol)
+	}
+
+	admin("PUT", "users/carol/rules", `[{"path": "/new.txt", "allow": false}]`, http.StatusOK)
+	if w := do("GET", "/new.txt", "carol", "secret", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected the new rules to apply, got %d", w.Code)
+	}
+
+	// Updating without a password keeps the current one.
+	admin("PUT", "users/carol", `{"modify": false}`, http.StatusOK)
+	if w := do("PROPFIND", "/", "carol", "secret", ""); w.Code != http.StatusMultiStatus {
+		t.Errorf("expected the password to be kept, got %d", w.Code)
+	}
+	admin("PUT", "users/carol/password", `{"password": "changed"}`, http.StatusNoContent)
+	if w := do("PROPFIND", "/", "carol", "changed", ""); w.Code != http.StatusMultiStatus {
+		t.Errorf("expected the new password to work, got %d", w.Code)
+	}
+
+	admin("POST", "users/carol/disable", "", http.StatusNoContent)
+	if w := do("PROPFIND", "/", "carol", "changed", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the disabled user to be refused, got %d", w.Code)
+	}
+	admin("POST", "users/carol/enable", "", http.StatusNoContent)
+	if w := do("PROPFIND", "/", "carol", "changed", ""); w.Code != http.StatusMultiStatus {
+		t.Errorf("expected the enabled user to be served, got %d", w.Code)
+	}
+
+	var quota Quota
+	if err := json.NewDecoder(admin("GET", "users/carol/quota", "", http.StatusOK).Body).Decode(&quota); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if quota.UsedBytes != 9 || quota.Files != 2 {
+		t.Errorf("unexpected quota %+v", quota)
+	}
+
+	var sessions []Session
+	if err := json.NewDecoder(admin("GET", "sessions?user=carol", "", http.StatusOK).Body).Decode(&sessions); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Requests == 0 {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+
+	admin("DELETE", "users/carol", "", http.StatusNoContent)
+	admin("DELETE", "users/carol", "", http.StatusNotFound)
+	if w := do("PROPFIND", "/", "carol", "changed", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the deleted user to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,287 @@
+package webdav
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/wwqdrh/gokit/logger"
+	"golang.org/x/net/webdav"
+)
+
+// archiveFormats maps the values of the archive query parameter to the
+// file extension and content type of the archives.
+var archiveFormats = map[string][2]string{
+	"zip":    {".zip", "application/zip"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+}
+
+func newArchive(format string, w io.Writer) archiveWriter {
+	if format == "tar.gz" {
+		gz := gzip.NewWriter(w)
+		return tarArchive{tar.NewWriter(gz), gz}
+	}
+	return zipArchive{zip.NewWriter(w)}
+}
+
+// archiveWriter adds the entries of a tree to an archive being streamed.
+type archiveWriter interface {
+	addDir(name string, info os.FileInfo) error
+	addFile(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) addDir(name string, info os.FileInfo) error {
+	_, err := a.CreateHeader(&zip.FileHeader{
+		Name:     name + "/",
+		Modified: info.ModTime(),
+	})
+	return err
+}
+
+func (a zipArchive) addFile(name string, info os.FileInfo, r io.Reader) error {
+	fh, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	fh.Name = name
+	fh.Method = zip.Deflate
+	w, err := a.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (a tarArchive) addDir(name string, info os.FileInfo) error {
+	return a.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  info.ModTime(),
+	})
+}
+
+func (a tarArchive) addFile(name string, info os.FileInfo, r io.Reader) error {
+	err := a.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	// The size in the header must match, even if the file changed.
+	_, err = io.CopyN(a, r, info.Size())
+	return err
+}
+
+func (a tarArchive) Close() error {
+	if err := a.Writer.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// archiveEntry is a tree of a file system stored in an archive under the
+// directory Base.
+type archiveEntry struct {
+	Name string
+	Base string
+}
+
+// streamArchive replies with an archive of the entries, built while it
+// is sent. Files and directories for which allow returns false are left
+// out.
+func streamArchive(w http.ResponseWriter, r *http.Request, format, filename string, fs webdav.FileSystem, entries []archiveEntry, allow func(name string) bool) {
+	f := archiveFormats[format]
+	w.Header().Set("Content-Type", f[1])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + f[0]}))
+	if r.Method == "HEAD" {
+		return
+	}
+
+	a := newArchive(format, w)
+	for _, e := range entries {
+		if err := archiveTree(r.Context(), a, fs, e.Name, e.Base, allow); err != nil {
+			// The status is sent already; a truncated archive does not
+			// pass for a complete one.
+			logger.DefaultLogger.Warn("archive " + e.Name + ": " + err.Error())
+			return
+		}
+	}
+	if err := a.Close(); err != nil {
+		logger.DefaultLogger.Warn("archive: " + err.Error())
+	}
+}
+
+// archiveRequest reports whether r asks for an archive: a GET of a
+// folder or a POST of a selection with the archive query parameter.
+func archiveRequest(r *http.Request) bool {
+	return (r.Method == "GET" || r.Method == "HEAD" || r.Method == "POST") && r.URL.Query().Has("archive")
+}
+
+// serveArchive serves archive requests. A GET archives the requested
+// folder or file. A POST archives the paths, relative to the requested
+// folder, listed in a JSON body ({"paths": [...]}) or in "path" form
+// fields.
+func (c *Config) serveArchive(w http.ResponseWriter, r *http.Request, u *User, fs webdav.FileSystem) {
+	format := r.URL.Query().Get("archive")
+	if _, ok := archiveFormats[format]; !ok {
+		http.Error(w, "unsupported archive format", http.StatusBadRequest)
+		return
+	}
+
+	access := RequestAccess(r)
+	access.NoModification = true
+	allow := func(name string) bool {
+		access.Path = c.Prefix + name
+		return c.DecideAccess(u, access).Allowed
+	}
+
+	ctx := r.Context()
+	name := strings.TrimPrefix(r.URL.Path, c.Prefix)
+	info, err := fs.Stat(ctx, name)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	filename := info.Name()
+	if filename == "/" || filename == "" {
+		filename = "archive"
+	}
+
+	if r.Method != "POST" {
+		streamArchive(w, r, format, filename, fs, []archiveEntry{{Name: name, Base: filename}}, allow)
+		return
+	}
+
+	if !info.IsDir() {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var paths []string
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		var req struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		paths = req.Paths
+	} else if err := r.ParseForm(); err == nil {
+		paths = r.PostForm["path"]
+	}
+	if len(paths) == 0 {
+		http.Error(w, "no paths selected", http.StatusBadRequest)
+		return
+	}
+
+	var entries []archiveEntry
+	for _, p := range paths {
+		p = path.Join(name, path.Clean("/"+p))
+		if !allow(p) {
+			// Denied paths are skipped before they are looked up, so
+			// that the answer does not tell whether they exist.
+			continue
+		}
+		info, err := fs.Stat(ctx, p)
+		if err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		entries = append(entries, archiveEntry{Name: p, Base: info.Name()})
+	}
+	streamArchive(w, r, format, filename, fs, entries, allow)
+}
+
+// archiveTree writes the tree rooted at name in fs to a, under the
+// archive directory base. Entries for which allow returns false are
+// skipped along with their children.
+func archiveTree(ctx context.Context, a archiveWriter, fs webdav.FileSystem, name, base string, allow func(name string) bool) error {
+	info, err := fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	return walkFS(ctx, fs, name, info, func(p string, info os.FileInfo) error {
+		if !allow(p) {
+			return errSkipDir
+		}
+
+		rel := strings.TrimPrefix(path.Join(base, strings.TrimPrefix(p, name)), "/")
+		if rel == "" {
+			// The root of a tree archived without a base directory.
+			return nil
+		}
+
+		if info.IsDir() {
+			return a.addDir(rel, info)
+		}
+		f, err := fs.OpenFile(ctx, p, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return a.addFile(rel, info, f)
+	})
+}
+
+var errSkipDir = errors.New("skip this directory")
+
+// walkFS calls fn for name and, when it is a directory, everything below
+// it in lexical order. Returning errSkipDir from fn skips the entry.
+func walkFS(ctx context.Context, fs webdav.FileSystem, name string, info os.FileInfo, fn func(name string, info os.FileInfo) error) error {
+	if err := fn(name, info); err != nil {
+		if err == errSkipDir {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+
+	for _, child := range children {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := walkFS(ctx, fs, path.Join(name, child.Name()), child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package webdav
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestConfigServeHTTPArchive(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"docs/a.txt":        "a",
+		"docs/sub/b.txt":    "b",
+		"docs/secret/c.txt": "c",
+		"other.txt":         "o",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	cfg := testConfig(t, `{
+		"scope": "`+dir+`",
+		"users": [{"username": "bob", "password": "bob",
+			"rules": [{"path": "/docs/secret", "allow": false}]}]
+	}`)
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		status      int
+		entries     []string
+	}{
+		{
+			name: "zip", method: "GET", target: "/docs?archive=zip", status: http.StatusOK,
+			entries: []string{"docs/", "docs/a.txt=a", "docs/sub/", "docs/sub/b.txt=b"},
+		},
+		{
+			name: "tar.gz", method: "GET", target: "/docs/?archive=tar.gz", status: http.StatusOK,
+			entries: []string{"docs/", "docs/a.txt=a", "docs/sub/", "docs/sub/b.txt=b"},
+		},
+		{
+			name: "json selection", method: "POST", target: "/?archive=zip",
+			contentType: "application/json", body: `{"paths": ["other.txt", "docs/sub", "docs/secret"]}`,
+			status:  http.StatusOK,
+			entries: []string{"other.txt=o", "sub/", "sub/b.txt=b"},
+		},
+		{
+			name: "form selection", method: "POST", target: "/docs?archive=tar.gz",
+			contentType: "application/x-www-form-urlencoded", body: url.Values{"path": {"a.txt", "sub/b.txt"}}.Encode(),
+			status:  http.StatusOK,
+			entries: []string{"a.txt=a", "b.txt=b"},
+		},
+		{
+			name: "selection outside the folder", method: "POST", target: "/docs?archive=zip",
+			contentType: "application/json", body: `{"paths": ["../other.txt"]}`,
+			status: http.StatusNotFound,
+		},
+		{
+			name: "missing denied selection", method: "POST", target: "/?archive=zip",
+			contentType: "application/json", body: `{"paths": ["other.txt", "docs/secret/none.txt"]}`,
+			status:  http.StatusOK,
+			entries: []string{"other.txt=o"},
+		},
+		{name: "missing selection", method: "POST", target: "/?archive=zip", contentType: "application/json", body: `{"paths": ["none"]}`, status: http.StatusNotFound},
+		{name: "denied folder", method: "GET", target: "/docs/secret?archive=zip", status: http.StatusForbidden},
+		{name: "missing denied folder", method: "GET", target: "/docs/secret/none?archive=zip", status: http.StatusForbidden},
+		{name: "unknown format", method: "GET", target: "/docs?archive=rar", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.SetBasicAuth("bob", "bob")
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			cfg.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			if tt.entries == nil {
+				return
+			}
+			format := r.URL.Query().Get("archive")
+			got := readArchiveEntries(t, format, w.Body.Bytes())
+			if strings.Join(got, ",") != strings.Join(tt.entries, ",") {
+				t.Errorf("expected entries %v, got %v", tt.entries, got)
+			}
+		})
+	}
+}
+
+// readArchiveEntries lists the entries of an archive as "name=content", or just
+// the name for directories.
+func readArchiveEntries(t *testing.T, format string, data []byte) []string {
+	t.Helper()
+
+	var entries []string
+	add := func(name string, r io.Reader) {
+		if strings.HasSuffix(name, "/") {
+			entries = append(entries, name)
+			return
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		entries = append(entries, name+"="+string(content))
+	}
+
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			add(f.Name, rc)
+			rc.Close()
+		}
+	} else {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			add(h.Name, tr)
+		}
+	}
+	sort.Strings(entries)
+	return entries
+}
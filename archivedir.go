@@ -0,0 +1,456 @@
+package webdav
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// maxArchiveIndexes is the number of archive indexes an ArchiveCache
+// keeps.
+const maxArchiveIndexes = 64
+
+// ArchiveCache keeps the member lists of the archives browsed through a
+// WebDavDir. An index is rebuilt when the modification time or the size
+// of its archive changes. The zero value is ready to use.
+type ArchiveCache struct {
+	mu      sync.Mutex
+	indexes map[string]*archiveIndex
+}
+
+type archiveIndex struct {
+	modTime time.Time
+	size    int64
+	used    time.Time
+	members map[string]*archiveMember
+}
+
+type archiveMember struct {
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+	// pos is the position of the member in the archive, -1 for
+	// directories that only exist as the parents of other members.
+	pos      int
+	children []string
+}
+
+// archiveKind returns how the archive called name is read, "" when it is
+// not an archive.
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// archivePath splits name into the path of an archive file of d and the
+// path of a member in it. Archives are only entered below them, so
+// "file.zip" is the archive itself and "file.zip/" its root.
+func (d WebDavDir) archivePath(ctx context.Context, name string) (archive, member string, ok bool) {
+	trailing := strings.HasSuffix(name, "/")
+	clean := path.Clean("/" + name)
+	parts := strings.Split(strings.TrimPrefix(clean, "/"), "/")
+
+	for i, part := range parts {
+		if archiveKind(part) == "" || (i == len(parts)-1 && !trailing) {
+			continue
+		}
+		prefix := "/" + strings.Join(parts[:i+1], "/")
+		info, err := d.files().Stat(ctx, prefix)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		return prefix, "/" + strings.Join(parts[i+1:], "/"), true
+	}
+	return "", "", false
+}
+
+// index returns the index of the archive called name in d.
+func (c *ArchiveCache) index(ctx context.Context, d WebDavDir, name string) (*archiveIndex, error) {
+	info, err := d.files().Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	key := string(d.Dir) + "\x00" + name
+
+	c.mu.Lock()
+	idx, ok := c.indexes[key]
+	if ok && idx.modTime.Equal(info.ModTime()) && idx.size == info.Size() {
+		idx.used = time.Now()
+		c.mu.Unlock()
+		return idx, nil
+	}
+	c.mu.Unlock()
+
+	idx, err = buildArchiveIndex(ctx, d.files(), name, info)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.indexes == nil {
+		c.indexes = map[string]*archiveIndex{}
+	}
+	if len(c.indexes) >= maxArchiveIndexes {
+		var oldest string
+		for k, other := range c.indexes {
+			if oldest == "" || other.used.Before(c.indexes[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(c.indexes, oldest)
+	}
+	c.indexes[key] = idx
+	return idx, nil
+}
+
+func buildArchiveIndex(ctx context.Context, d webdav.FileSystem, name string, info os.FileInfo) (*archiveIndex, error) {
+	idx := &archiveIndex{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		used:    time.Now(),
+		members: map[string]*archiveMember{
+			"/": {name: path.Base(name), dir: true, modTime: info.ModTime(), pos: -1},
+		},
+	}
+	add := func(entry string, dir bool, size int64, modTime time.Time, pos int) {
+		p := path.Clean("/" + entry)
+		if p == "/" || strings.Contains(entry, "..") {
+			return
+		}
+		if m, ok := idx.members[p]; ok {
+			// A directory first seen as a parent.
+			m.dir, m.modTime, m.pos = m.dir || dir, modTime, pos
+			return
+		}
+		idx.members[p] = &archiveMember{name: path.Base(p), dir: dir, size: size, modTime: modTime, pos: pos}
+
+		// Register the member in its parents, creating the missing ones.
+		for child := p; child != "/"; {
+			parent := path.Dir(child)
+			m, ok := idx.members[parent]
+			if !ok {
+				m = &archiveMember{name: path.Base(parent), dir: true, modTime: modTime, pos: -1}
+				idx.members[parent] = m
+			}
+			m.children = append(m.children, path.Base(child))
+			if ok {
+				break
+			}
+			child = parent
+		}
+	}
+
+	err := readArchive(ctx, d, name, func(r archiveReader) error {
+		for pos := 0; ; pos++ {
+			info, err := r.next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if info != nil {
+				add(r.name(), info.IsDir(), info.Size(), info.ModTime(), pos)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range idx.members {
+		sort.Strings(m.children)
+	}
+	return idx, nil
+}
+
+// archiveReader iterates over the members of an archive. next returns a
+// nil FileInfo for members that are neither files nor directories; name
+// and content return the path and the content of the last member.
+type archiveReader interface {
+	next() (os.FileInfo, error)
+	name() string
+	content() (io.ReadCloser, error)
+}
+
+type zipReader struct {
+	files []*zip.File
+	pos   int
+}
+
+func (r *zipReader) next() (os.FileInfo, error) {
+	if r.pos >= len(r.files) {
+		return nil, io.EOF
+	}
+	info := r.files[r.pos].FileInfo()
+	r.pos++
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil, nil
+	}
+	return info, nil
+}
+
+func (r *zipReader) name() string {
+	return r.files[r.pos-1].Name
+}
+
+func (r *zipReader) content() (io.ReadCloser, error) {
+	return r.files[r.pos-1].Open()
+}
+
+type tarReader struct {
+	*tar.Reader
+	h *tar.Header
+}
+
+func (r *tarReader) next() (os.FileInfo, error) {
+	h, err := r.Next()
+	if err != nil {
+		return nil, err
+	}
+	r.h = h
+	if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir {
+		return nil, nil
+	}
+	return h.FileInfo(), nil
+}
+
+func (r *tarReader) name() string {
+	return r.h.Name
+}
+
+func (r *tarReader) content() (io.ReadCloser, error) {
+	return io.NopCloser(r.Reader), nil
+}
+
+// readArchive calls fn with a reader of the archive called name in d.
+func readArchive(ctx context.Context, d webdav.FileSystem, name string, fn func(r archiveReader) error) error {
+	f, err := d.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch archiveKind(name) {
+	case "zip":
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			return errors.New("archive is not seekable")
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(ra, info.Size())
+		if err != nil {
+			return err
+		}
+		return fn(&zipReader{files: zr.File})
+	case "tar.gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return fn(&tarReader{Reader: tar.NewReader(gz)})
+	default:
+		return fn(&tarReader{Reader: tar.NewReader(f)})
+	}
+}
+
+// openMember returns the content of the member at pos of the archive
+// called name in d. The archive stays open until the reader is closed.
+func openMember(ctx context.Context, d webdav.FileSystem, name string, pos int) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(readArchive(ctx, d, name, func(r archiveReader) error {
+			for i := 0; ; i++ {
+				if _, err := r.next(); err != nil {
+					return err
+				}
+				if i == pos {
+					content, err := r.content()
+					if err != nil {
+						return err
+					}
+					defer content.Close()
+					_, err = io.Copy(pw, content)
+					return err
+				}
+			}
+		}))
+	}()
+	return pr, nil
+}
+
+// archiveFileInfo describes a member of an archive.
+type archiveFileInfo struct {
+	m *archiveMember
+}
+
+func (fi archiveFileInfo) Name() string       { return fi.m.name }
+func (fi archiveFileInfo) Size() int64        { return fi.m.size }
+func (fi archiveFileInfo) ModTime() time.Time { return fi.m.modTime }
+func (fi archiveFileInfo) IsDir() bool        { return fi.m.dir }
+func (fi archiveFileInfo) Sys() interface{}   { return nil }
+
+func (fi archiveFileInfo) Mode() os.FileMode {
+	if fi.m.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// statMember returns the index of the archive and the member called
+// member in it.
+func (d WebDavDir) statMember(ctx context.Context, archive, member string) (*archiveIndex, *archiveMember, error) {
+	idx, err := d.Archives.index(ctx, d, archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := idx.members[member]
+	if !ok {
+		return nil, nil, os.ErrNotExist
+	}
+	return idx, m, nil
+}
+
+// openMember opens a member of an archive for reading.
+func (d WebDavDir) openMember(ctx context.Context, archive, member string, flag int) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	idx, m, err := d.statMember(ctx, archive, member)
+	if err != nil {
+		return nil, err
+	}
+
+	info := archiveFileInfo{m}
+	if m.dir {
+		children := make([]os.FileInfo, 0, len(m.children))
+		for _, name := range m.children {
+			children = append(children, archiveFileInfo{idx.members[path.Join(member, name)]})
+		}
+		return &archiveDir{info: info, children: children}, nil
+	}
+	return &archiveFile{
+		info: info,
+		open: func() (io.ReadCloser, error) {
+			// The request context may be gone by the time the file is read.
+			return openMember(context.Background(), d.files(), archive, m.pos)
+		},
+	}, nil
+}
+
+// archiveDir is a directory of an archive.
+type archiveDir struct {
+	info     os.FileInfo
+	children []os.FileInfo
+	off      int
+}
+
+func (f *archiveDir) Close() error                                 { return nil }
+func (f *archiveDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (f *archiveDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (f *archiveDir) Stat() (os.FileInfo, error)                   { return f.info, nil }
+func (f *archiveDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+
+func (f *archiveDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := f.children[f.off:]
+	if count <= 0 {
+		f.off = len(f.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(rest))
+	f.off += n
+	return rest[:n], nil
+}
+
+// archiveFile is a file of an archive. Archives are read sequentially,
+// so seeking backwards reopens the member and skips to the offset.
+type archiveFile struct {
+	info os.FileInfo
+	open func() (io.ReadCloser, error)
+
+	pos  int64
+	r    io.ReadCloser
+	rpos int64
+}
+
+func (f *archiveFile) Read(p []byte) (int, error) {
+	if f.pos >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.r == nil || f.rpos > f.pos {
+		if f.r != nil {
+			f.r.Close()
+		}
+		r, err := f.open()
+		if err != nil {
+			return 0, err
+		}
+		f.r, f.rpos = r, 0
+	}
+	if f.rpos < f.pos {
+		n, err := io.CopyN(io.Discard, f.r, f.pos-f.rpos)
+		f.rpos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.r.Read(p)
+	f.rpos += int64(n)
+	f.pos = f.rpos
+	return n, err
+}
+
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *archiveFile) Close() error {
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
+
+func (f *archiveFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *archiveFile) Stat() (os.FileInfo, error)               { return f.info, nil }
+func (f *archiveFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
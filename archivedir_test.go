@@ -0,0 +1,170 @@
+package webdav
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func writeTestZip(t *testing.T, name string, files map[string]string) {
+	t.Helper()
+
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, n := range []string{"a.txt", "sub/b.txt"} {
+		w, err := zw.Create(n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		io.WriteString(w, files[n])
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func writeTestTarGz(t *testing.T, name string, files map[string]string) {
+	t.Helper()
+
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "sub/", Mode: 0755})
+	for _, n := range []string{"a.txt", "sub/b.txt"} {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: n, Mode: 0644, Size: int64(len(files[n]))})
+		io.WriteString(tw, files[n])
+	}
+	tw.Close()
+	if err := gz.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWebDavDirArchives(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "alpha", "sub/b.txt": "0123456789"}
+	writeTestZip(t, filepath.Join(dir, "files.zip"), files)
+	writeTestTarGz(t, filepath.Join(dir, "files.tar.gz"), files)
+
+	ctx := context.Background()
+	d := WebDavDir{Dir: webdav.Dir(dir), Archives: &ArchiveCache{}}
+
+	for _, archive := range []string{"/files.zip", "/files.tar.gz"} {
+		t.Run(archive, func(t *testing.T) {
+			info, err := d.Stat(ctx, archive)
+			if err != nil || info.IsDir() {
+				t.Fatalf("expected the archive itself to be a file, got %v %v", info, err)
+			}
+			info, err = d.Stat(ctx, archive+"/")
+			if err != nil || !info.IsDir() {
+				t.Fatalf("expected the archive root to be a directory, got %v %v", info, err)
+			}
+
+			root, err := d.OpenFile(ctx, archive+"/", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			children, err := root.Readdir(-1)
+			root.Close()
+			if err != nil || len(children) != 2 || children[0].Name() != "a.txt" || !children[1].IsDir() {
+				t.Fatalf("unexpected children %v %v", children, err)
+			}
+
+			f, err := d.OpenFile(ctx, archive+"/sub/b.txt", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer f.Close()
+			if data, err := io.ReadAll(f); err != nil || string(data) != "0123456789" {
+				t.Errorf("unexpected content %q %v", data, err)
+			}
+			if _, err := f.Seek(4, io.SeekStart); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			buf := make([]byte, 3)
+			if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "456" {
+				t.Errorf("unexpected content after seek %q %v", buf, err)
+			}
+
+			if _, err := d.Stat(ctx, archive+"/missing"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected missing member, got %v", err)
+			}
+			if _, err := d.OpenFile(ctx, archive+"/a.txt", os.O_WRONLY, 0); !errors.Is(err, os.ErrPermission) {
+				t.Errorf("expected members to be read-only, got %v", err)
+			}
+			if err := d.RemoveAll(ctx, archive+"/a.txt"); !errors.Is(err, os.ErrPermission) {
+				t.Errorf("expected members not to be removable, got %v", err)
+			}
+			if err := d.Mkdir(ctx, archive+"/new", 0755); !errors.Is(err, os.ErrPermission) {
+				t.Errorf("expected no directory to be created, got %v", err)
+			}
+		})
+	}
+
+	// A changed archive is indexed again.
+	zipPath := filepath.Join(dir, "files.zip")
+	writeTestZip(t, zipPath, map[string]string{"a.txt": "changed!", "sub/b.txt": ""})
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(zipPath, later, later)
+	if info, err := d.Stat(ctx, "/files.zip/a.txt"); err != nil || info.Size() != 8 {
+		t.Errorf("expected the index to be rebuilt, got %v %v", info, err)
+	}
+
+	// Without a cache archives are plain files.
+	if _, err := (WebDavDir{Dir: webdav.Dir(dir)}).Stat(ctx, "/files.zip/a.txt"); err == nil {
+		t.Error("expected archives not to be browsed")
+	}
+}
+
+func TestConfigServeHTTPBrowseArchives(t *testing.T) {
+	dir := t.TempDir()
+	writeTestZip(t, filepath.Join(dir, "files.zip"), map[string]string{"a.txt": "alpha", "sub/b.txt": "0123456789"})
+
+	cfg := testConfig(t, `{"scope": "`+dir+`", "browseArchives": true, "modify": true,
+		"users": [{"username": "bob", "password": "bob"}]}`)
+	do := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.SetBasicAuth("bob", "bob")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("PROPFIND", "/files.zip/", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "/files.zip/sub/") {
+		t.Errorf("expected the archive to be listed, got %d %s", w.Code, w.Body)
+	}
+	w = do("GET", "/files.zip/sub/b.txt", map[string]string{"Range": "bytes=2-4"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Errorf("expected a range of the member, got %d %q", w.Code, w.Body)
+	}
+	if w := do("DELETE", "/files.zip/a.txt", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected members not to be deleted, got %d", w.Code)
+	}
+	if w := do("GET", "/files.zip", nil); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("expected the archive to be downloadable, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
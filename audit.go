@@ -0,0 +1,103 @@
+package webdav
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/gokit/logger"
+)
+
+// AuditEvent is a security relevant event.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// Auditor records audit events.
+type Auditor interface {
+	Audit(ev AuditEvent)
+}
+
+// LogAuditor writes audit events as JSON lines to W, or to the default
+// logger when W is nil.
+type LogAuditor struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+func (a *LogAuditor) Audit(ev AuditEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	if a.W == nil {
+		logger.DefaultLogger.Info("audit " + string(data))
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.W.Write(append(data, '\n')); err != nil {
+		logger.DefaultLogger.Warn("write audit event: " + err.Error())
+	}
+}
+
+// FileAuditor appends audit events as JSON lines to the file at Path. The
+// file is opened with the first event, so that configurations that are
+// built but never served hold no file open, and until Close.
+type FileAuditor struct {
+	Path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (a *FileAuditor) Audit(ev AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		f, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			logger.DefaultLogger.Warn("open audit log: " + err.Error())
+			return
+		}
+		a.f = f
+	}
+	(&LogAuditor{W: a.f}).Audit(ev)
+}
+
+// Close closes the file, which is opened again by the next event.
+func (a *FileAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// audit records ev with the configured auditor, the default logger when
+// there is none.
+func (c *Config) audit(ev AuditEvent) {
+	if c.Audit != nil {
+		c.Audit.Audit(ev)
+		return
+	}
+	(&LogAuditor{}).Audit(ev)
+}
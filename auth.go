@@ -0,0 +1,96 @@
+package webdav
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is returned by authenticators when the username
+// or the password is wrong.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator verifies the credentials of a request and resolves the
+// user they belong to.
+type Authenticator interface {
+	Authenticate(username, password string) (*User, error)
+}
+
+// UserFinder is implemented by the authenticators that can resolve a
+// user without its credentials, telling whether it still exists. It
+// returns ErrInvalidCredentials for unknown users.
+type UserFinder interface {
+	FindUser(username string) (*User, error)
+}
+
+// ConfigAuthenticator authenticates against the passwords of the users
+// of the configuration. Passwords prefixed with "{bcrypt}" are bcrypt
+// hashes, anything else is compared as plain text.
+type ConfigAuthenticator struct {
+	Users map[string]*User
+}
+
+func (a ConfigAuthenticator) Authenticate(username, password string) (*User, error) {
+	u, ok := a.Users[username]
+	if !ok || !checkPassword(u.Password, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+func (a ConfigAuthenticator) FindUser(username string) (*User, error) {
+	u, ok := a.Users[username]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+func checkPassword(saved, input string) bool {
+	if hash, ok := strings.CutPrefix(saved, "{bcrypt}"); ok {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(input)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(saved), []byte(input)) == 1
+}
+
+// resolveUser returns the configured user called username or, when there
+// is none, a copy of template for that name. External backends use it to
+// attach rules and scopes to the identities they verify.
+func resolveUser(users map[string]*User, template *User, username string) (*User, error) {
+	if u, ok := users[username]; ok {
+		return u, nil
+	}
+	if template == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	u := *template
+	u.Username = username
+	u.Password = ""
+	u.Admin = false
+	u.Handler = nil
+	return u.Expand()
+}
+
+// AppPassword is a named password of a user that can be revoked on its
+// own and that may only grant a restricted access.
+type AppPassword struct {
+	Name string
+	// Password uses the same format as User.Password.
+	Password    string
+	Restriction Restriction
+	Revoked     bool
+}
+
+// authenticateApp checks password against the app passwords of u and
+// returns u narrowed by the restriction of the matching one.
+func authenticateApp(u *User, password string) (*User, bool) {
+	for _, ap := range u.AppPasswords {
+		if !ap.Revoked && checkPassword(ap.Password, password) {
+			return u.Restrict(ap.Restriction), true
+		}
+	}
+	return nil, false
+}
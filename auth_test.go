@@ -0,0 +1,42 @@
+package webdav
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestConfigAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	a := ConfigAuthenticator{Users: map[string]*User{
+		"plain":  {Username: "plain", Password: "secret"},
+		"hashed": {Username: "hashed", Password: "{bcrypt}" + string(hash)},
+	}}
+
+	tests := []struct {
+		username string
+		password string
+		ok       bool
+	}{
+		{"plain", "secret", true},
+		{"plain", "wrong", false},
+		{"hashed", "secret", true},
+		{"hashed", "wrong", false},
+		{"missing", "secret", false},
+	}
+
+	for _, tt := range tests {
+		u, err := a.Authenticate(tt.username, tt.password)
+		if tt.ok && (err != nil || u.Username != tt.username) {
+			t.Errorf("%s/%s: unexpected result %v, %v", tt.username, tt.password, u, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s/%s: expected ErrInvalidCredentials, got %v", tt.username, tt.password, err)
+		}
+	}
+}
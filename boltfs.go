@@ -0,0 +1,785 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/webdav"
+)
+
+// Buckets of a scope in a BoltFS database.
+var (
+	boltEntries = []byte("entries")
+	boltChunks  = []byte("chunks")
+	boltProps   = []byte("props")
+)
+
+const (
+	// boltChunkSize is the size of the values holding the content.
+	boltChunkSize = 64 * 1024
+	// boltSpillSize is the size above which files being written are
+	// buffered on disk instead of in memory.
+	boltSpillSize = 4 << 20
+	// boltBatchChunks is the number of chunks stored per transaction.
+	boltBatchChunks = 64
+)
+
+// BoltFS is a file system stored in a bbolt database, in a bucket per
+// scope. Entries are keyed by their parent directory and name, so that
+// listing a directory reads only its entries, and point to their content
+// and dead properties by ID, so that a tree is moved at once by renaming
+// its entries. Files being written are buffered and stored when closed,
+// as a new content the entry is then switched to, so that readers never
+// see part of each; they can only be rewritten whole, as PUT does.
+type BoltFS struct {
+	DB    *bolt.DB
+	Scope string
+	// TempDir holds the large files being written, os.TempDir() when
+	// empty.
+	TempDir string
+}
+
+// boltEntry is the metadata of a file or directory.
+type boltEntry struct {
+	ID uint64 `json:"id"`
+	// Content is the ID of the chunks of a file, its ID when zero.
+	Content uint64      `json:"content,omitempty"`
+	Dir     bool        `json:"dir,omitempty"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modTime"`
+	Size    int64       `json:"size,omitempty"`
+	Type    string      `json:"type,omitempty"`
+}
+
+var boltDBs struct {
+	sync.Mutex
+	open map[string]*bolt.DB
+}
+
+// openBoltDB opens the database at path once for the life of the
+// process, as the configurations replacing each other share it.
+func openBoltDB(path string) (*bolt.DB, error) {
+	boltDBs.Lock()
+	defer boltDBs.Unlock()
+	if db, ok := boltDBs.open[path]; ok {
+		return db, nil
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if boltDBs.open == nil {
+		boltDBs.open = map[string]*bolt.DB{}
+	}
+	boltDBs.open[path] = db
+	return db, nil
+}
+
+// NewBoltFS returns the file system of scope in db, creating it if
+// needed.
+func NewBoltFS(db *bolt.DB, scope string) (*BoltFS, error) {
+	if scope == "" {
+		scope = "."
+	}
+	fs := &BoltFS{DB: db, Scope: scope}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(scope))
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltEntries, boltChunks, boltProps} {
+			if _, err := b.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if b.Bucket(boltEntries).Get(boltKey("/")) != nil {
+			return nil
+		}
+		return fs.put(tx, "/", &boltEntry{Dir: true, Mode: 0755, ModTime: time.Now()})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// boltKey returns the key of the entry of the clean path name.
+func boltKey(name string) []byte {
+	if name == "/" {
+		return []byte("/")
+	}
+	return []byte(path.Dir(name) + "\x00" + path.Base(name))
+}
+
+// boltChildren returns the prefix of the keys of the entries in dir.
+func boltChildren(dir string) []byte {
+	return []byte(dir + "\x00")
+}
+
+func boltID(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+func boltChunkKey(id uint64, index int64) []byte {
+	return binary.BigEndian.AppendUint32(boltID(id), uint32(index))
+}
+
+// content returns the ID of the chunks of the entry.
+func (e *boltEntry) content() uint64 {
+	if e.Content != 0 {
+		return e.Content
+	}
+	return e.ID
+}
+
+func (fs *BoltFS) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	return tx.Bucket([]byte(fs.Scope)).Bucket(name)
+}
+
+// get returns the entry of the clean path name.
+func (fs *BoltFS) get(tx *bolt.Tx, name string) (*boltEntry, error) {
+	data := fs.bucket(tx, boltEntries).Get(boltKey(name))
+	if data == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	e := &boltEntry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// put stores the entry of the clean path name, giving it an ID if it
+// has none.
+func (fs *BoltFS) put(tx *bolt.Tx, name string, e *boltEntry) error {
+	b := fs.bucket(tx, boltEntries)
+	if e.ID == 0 {
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.ID = id
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.Put(boltKey(name), data)
+}
+
+// parent checks that the parent directory of name exists.
+func (fs *BoltFS) parent(tx *bolt.Tx, name string) error {
+	e, err := fs.get(tx, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !e.Dir {
+		return &os.PathError{Op: "open", Path: path.Dir(name), Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// children returns the names of the entries in dir.
+func (fs *BoltFS) children(tx *bolt.Tx, dir string) []string {
+	prefix := boltChildren(dir)
+	var names []string
+	c := fs.bucket(tx, boltEntries).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		names = append(names, string(k[len(prefix):]))
+	}
+	return names
+}
+
+// deleteContent deletes the chunks of the content with id.
+func (fs *BoltFS) deleteContent(tx *bolt.Tx, id uint64) error {
+	prefix := boltID(id)
+	c := fs.bucket(tx, boltChunks).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes the tree at name.
+func (fs *BoltFS) remove(tx *bolt.Tx, name string, e *boltEntry) error {
+	if e.Dir {
+		for _, child := range fs.children(tx, name) {
+			childName := path.Join(name, child)
+			ce, err := fs.get(tx, childName)
+			if err != nil {
+				return err
+			}
+			if err := fs.remove(tx, childName, ce); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fs.deleteContent(tx, e.content()); err != nil {
+		return err
+	}
+	if err := fs.bucket(tx, boltProps).Delete(boltID(e.ID)); err != nil {
+		return err
+	}
+	return fs.bucket(tx, boltEntries).Delete(boltKey(name))
+}
+
+// move renames the tree at oldName, keeping the IDs of its entries.
+func (fs *BoltFS) move(tx *bolt.Tx, oldName, newName string, e *boltEntry) error {
+	if e.Dir {
+		for _, child := range fs.children(tx, oldName) {
+			ce, err := fs.get(tx, path.Join(oldName, child))
+			if err != nil {
+				return err
+			}
+			if err := fs.move(tx, path.Join(oldName, child), path.Join(newName, child), ce); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fs.bucket(tx, boltEntries).Delete(boltKey(oldName)); err != nil {
+		return err
+	}
+	return fs.put(tx, newName, e)
+}
+
+func (fs *BoltFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = path.Clean("/" + name)
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		if _, err := fs.get(tx, name); err == nil {
+			return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+		}
+		if err := fs.parent(tx, name); err != nil {
+			return err
+		}
+		return fs.put(tx, name, &boltEntry{Dir: true, Mode: perm.Perm(), ModTime: time.Now()})
+	})
+}
+
+func (fs *BoltFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = path.Clean("/" + name)
+	var info os.FileInfo
+	err := fs.DB.View(func(tx *bolt.Tx) error {
+		e, err := fs.get(tx, name)
+		if err != nil {
+			return err
+		}
+		info = boltInfo{path.Base(name), *e}
+		return nil
+	})
+	return info, err
+}
+
+func (fs *BoltFS) RemoveAll(ctx context.Context, name string) error {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		e, err := fs.get(tx, name)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fs.remove(tx, name, e)
+	})
+}
+
+func (fs *BoltFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+	if oldName == "/" || newName == "/" || within(newName, oldName) {
+		// Prohibit renaming from or to the virtual root directory, or
+		// into itself.
+		return os.ErrInvalid
+	}
+	return fs.DB.Update(func(tx *bolt.Tx) error {
+		e, err := fs.get(tx, oldName)
+		if err != nil {
+			return err
+		}
+		if err := fs.parent(tx, newName); err != nil {
+			return err
+		}
+		if dst, err := fs.get(tx, newName); err == nil {
+			if dst.Dir {
+				return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+			}
+			if err := fs.remove(tx, newName, dst); err != nil {
+				return err
+			}
+		}
+		return fs.move(tx, oldName, newName, e)
+	})
+}
+
+func (fs *BoltFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = path.Clean("/" + name)
+	var e *boltEntry
+	err := fs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		e, err = fs.get(tx, name)
+		if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+			e, err = nil, fs.parent(tx, name)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case e != nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case e != nil && (!write || (e.Dir && flag&(os.O_CREATE|os.O_TRUNC) == 0)):
+		// Directories are opened for writing to change their properties.
+		return &boltFile{fs: fs, name: name, entry: *e, chunk: -1}, nil
+	case e != nil && e.Dir:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	w := &boltWriter{fs: fs, name: name, perm: perm, entry: e, modTime: time.Now()}
+	w.truncated = e == nil || flag&os.O_TRUNC != 0
+	return w, nil
+}
+
+// boltInfo describes an entry. Its content type was detected when it
+// was written, so that listing a directory does not read the files.
+type boltInfo struct {
+	name  string
+	entry boltEntry
+}
+
+func (fi boltInfo) Name() string       { return fi.name }
+func (fi boltInfo) Size() int64        { return fi.entry.Size }
+func (fi boltInfo) ModTime() time.Time { return fi.entry.ModTime }
+func (fi boltInfo) IsDir() bool        { return fi.entry.Dir }
+func (fi boltInfo) Sys() interface{}   { return nil }
+
+func (fi boltInfo) Mode() os.FileMode {
+	if fi.entry.Dir {
+		return os.ModeDir | fi.entry.Mode
+	}
+	return fi.entry.Mode
+}
+
+func (fi boltInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.entry.Type == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.entry.Type, nil
+}
+
+// deadProps returns the dead properties of the entry with id.
+func (fs *BoltFS) deadProps(id uint64) (map[xml.Name]webdav.Property, error) {
+	props := map[xml.Name]webdav.Property{}
+	err := fs.DB.View(func(tx *bolt.Tx) error {
+		return fs.loadProps(tx, id, props)
+	})
+	return props, err
+}
+
+func (fs *BoltFS) loadProps(tx *bolt.Tx, id uint64, props map[xml.Name]webdav.Property) error {
+	data := fs.bucket(tx, boltProps).Get(boltID(id))
+	if data == nil {
+		return nil
+	}
+	var list []webdav.Property
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, p := range list {
+		props[p.XMLName] = p
+	}
+	return nil
+}
+
+// patch applies patches to the dead properties of the entry with id.
+func (fs *BoltFS) patch(tx *bolt.Tx, id uint64, patches []webdav.Proppatch) error {
+	props := map[xml.Name]webdav.Property{}
+	if err := fs.loadProps(tx, id, props); err != nil {
+		return err
+	}
+	for _, p := range patches {
+		for _, prop := range p.Props {
+			if p.Remove {
+				delete(props, prop.XMLName)
+			} else {
+				props[prop.XMLName] = prop
+			}
+		}
+	}
+
+	b := fs.bucket(tx, boltProps)
+	if len(props) == 0 {
+		return b.Delete(boltID(id))
+	}
+	list := make([]webdav.Property, 0, len(props))
+	for _, p := range props {
+		list = append(list, p)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return b.Put(boltID(id), data)
+}
+
+// patchStatus is the reply to patches that were all applied.
+func patchStatus(patches []webdav.Proppatch) []webdav.Propstat {
+	st := webdav.Propstat{Status: http.StatusOK}
+	for _, p := range patches {
+		for _, prop := range p.Props {
+			st.Props = append(st.Props, webdav.Property{XMLName: prop.XMLName})
+		}
+	}
+	return []webdav.Propstat{st}
+}
+
+// boltFile reads a file or lists a directory.
+type boltFile struct {
+	fs    *BoltFS
+	name  string
+	entry boltEntry
+
+	pos   int64
+	chunk int64
+	data  []byte
+	// listed is the number of entries returned by Readdir.
+	listed int
+}
+
+func (f *boltFile) Close() error { return nil }
+
+func (f *boltFile) Read(p []byte) (int, error) {
+	if f.entry.Dir {
+		return 0, os.ErrInvalid
+	}
+	if f.pos >= f.entry.Size {
+		return 0, io.EOF
+	}
+	index := f.pos / boltChunkSize
+	if index != f.chunk {
+		err := f.fs.DB.View(func(tx *bolt.Tx) error {
+			data := f.fs.bucket(tx, boltChunks).Get(boltChunkKey(f.entry.content(), index))
+			if data == nil {
+				// The file was replaced while being read.
+				return io.ErrUnexpectedEOF
+			}
+			f.data = append(f.data[:0], data...)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		f.chunk = index
+	}
+	offset := f.pos - index*boltChunkSize
+	if offset >= int64(len(f.data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, f.data[offset:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *boltFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.entry.Size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *boltFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.entry.Dir {
+		return nil, os.ErrInvalid
+	}
+	var infos []os.FileInfo
+	err := f.fs.DB.View(func(tx *bolt.Tx) error {
+		prefix := boltChildren(f.name)
+		c := f.fs.bucket(tx, boltEntries).Cursor()
+		skip := f.listed
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if count > 0 && len(infos) == count {
+				break
+			}
+			var e boltEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			infos = append(infos, boltInfo{string(k[len(prefix):]), e})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.listed += len(infos)
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}
+
+func (f *boltFile) Stat() (os.FileInfo, error) {
+	return boltInfo{path.Base(f.name), f.entry}, nil
+}
+
+func (f *boltFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (f *boltFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return f.fs.deadProps(f.entry.ID)
+}
+
+func (f *boltFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	err := f.fs.DB.Update(func(tx *bolt.Tx) error {
+		return f.fs.patch(tx, f.entry.ID, patches)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return patchStatus(patches), nil
+}
+
+// boltWriter buffers a file being written and stores it when closed,
+// in batches under a new content ID, which then replaces the previous
+// content at once.
+type boltWriter struct {
+	fs      *BoltFS
+	name    string
+	perm    os.FileMode
+	entry   *boltEntry
+	modTime time.Time
+
+	truncated bool
+	buf       bytes.Buffer
+	spill     *os.File
+	n         int64
+	// patches are the property changes of a file not stored yet.
+	patches []webdav.Proppatch
+}
+
+func (w *boltWriter) Write(p []byte) (int, error) {
+	if !w.truncated {
+		// Files are rewritten whole, as PUT does.
+		return 0, errors.ErrUnsupported
+	}
+	if w.spill == nil && w.buf.Len()+len(p) > boltSpillSize {
+		f, err := os.CreateTemp(w.fs.TempDir, "webdav-bolt-")
+		if err != nil {
+			return 0, err
+		}
+		w.spill = f
+		if _, err := f.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if w.spill != nil {
+		n, err = w.spill.Write(p)
+	} else {
+		n, err = w.buf.Write(p)
+	}
+	w.n += int64(n)
+	return n, err
+}
+
+// content returns a reader of what was written.
+func (w *boltWriter) content() (io.Reader, error) {
+	if w.spill == nil {
+		return bytes.NewReader(w.buf.Bytes()), nil
+	}
+	if _, err := w.spill.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return w.spill, nil
+}
+
+func (w *boltWriter) Close() error {
+	defer func() {
+		if w.spill != nil {
+			w.spill.Close()
+			os.Remove(w.spill.Name())
+		}
+	}()
+	if !w.truncated {
+		// Only opened to change its properties.
+		return nil
+	}
+	r, err := w.content()
+	if err != nil {
+		return err
+	}
+
+	// The content is stored first, out of sight, and then swapped in.
+	var content uint64
+	err = w.fs.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		content, err = w.fs.bucket(tx, boltEntries).NextSequence()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	contentType, err := w.store(r, content)
+	if err == nil {
+		err = w.swap(content, contentType)
+	}
+	if err != nil {
+		// Chunks left over by a crash before the swap are not reclaimed.
+		w.fs.DB.Update(func(tx *bolt.Tx) error {
+			return w.fs.deleteContent(tx, content)
+		})
+	}
+	return err
+}
+
+// store writes the chunks read from r under content, a batch per
+// transaction, and returns the type detected from the first one.
+func (w *boltWriter) store(r io.Reader, content uint64) (string, error) {
+	var contentType string
+	buf := make([]byte, boltChunkSize)
+	for index, done := int64(0), false; !done; {
+		err := w.fs.DB.Update(func(tx *bolt.Tx) error {
+			chunks := w.fs.bucket(tx, boltChunks)
+			for end := index + boltBatchChunks; index < end; index++ {
+				n, err := io.ReadFull(r, buf)
+				if n > 0 {
+					if index == 0 {
+						contentType = boltContentType(w.name, buf[:n])
+					}
+					if err := chunks.Put(boltChunkKey(content, index), bytes.Clone(buf[:n])); err != nil {
+						return err
+					}
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					done = true
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if contentType == "" {
+		contentType = boltContentType(w.name, nil)
+	}
+	return contentType, nil
+}
+
+// swap points the entry of the file to content and deletes the content
+// it replaces.
+func (w *boltWriter) swap(content uint64, contentType string) error {
+	return w.fs.DB.Update(func(tx *bolt.Tx) error {
+		e, err := w.fs.get(tx, w.name)
+		var old uint64
+		switch {
+		case os.IsNotExist(err):
+			if err := w.fs.parent(tx, w.name); err != nil {
+				return err
+			}
+			e = &boltEntry{Mode: w.perm.Perm()}
+		case err != nil:
+			return err
+		case e.Dir:
+			return &os.PathError{Op: "close", Path: w.name, Err: errors.New("is a directory")}
+		default:
+			old = e.content()
+		}
+		e.ModTime, e.Size, e.Type, e.Content = w.modTime, w.n, contentType, content
+		if err := w.fs.put(tx, w.name, e); err != nil {
+			return err
+		}
+		if old != 0 {
+			if err := w.fs.deleteContent(tx, old); err != nil {
+				return err
+			}
+		}
+		if len(w.patches) > 0 {
+			return w.fs.patch(tx, e.ID, w.patches)
+		}
+		return nil
+	})
+}
+
+// boltContentType returns the type of a file from its extension or, as
+// the handler would, from the head of its content.
+func boltContentType(name string, head []byte) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return http.DetectContentType(head)
+}
+
+func (w *boltWriter) Read(p []byte) (int, error) { return 0, os.ErrInvalid }
+
+func (w *boltWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekCurrent || whence == io.SeekEnd) {
+		return w.n, nil
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (w *boltWriter) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (w *boltWriter) Stat() (os.FileInfo, error) {
+	e := boltEntry{Mode: w.perm.Perm(), ModTime: w.modTime, Size: w.n}
+	if w.entry != nil {
+		e.ID, e.Mode = w.entry.ID, w.entry.Mode
+	}
+	return boltInfo{path.Base(w.name), e}, nil
+}
+
+func (w *boltWriter) DeadProps() (map[xml.Name]webdav.Property, error) {
+	if w.entry == nil {
+		return map[xml.Name]webdav.Property{}, nil
+	}
+	return w.fs.deadProps(w.entry.ID)
+}
+
+// Patch changes the properties of a stored file at once, and those of a
+// new one, as COPY sets them, when it is stored.
+func (w *boltWriter) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if w.entry == nil {
+		w.patches = append(w.patches, patches...)
+		return patchStatus(patches), nil
+	}
+	err := w.fs.DB.Update(func(tx *bolt.Tx) error {
+		return w.fs.patch(tx, w.entry.ID, patches)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return patchStatus(patches), nil
+}
@@ -0,0 +1,258 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/webdav"
+)
+
+func testBoltFS(t *testing.T) *BoltFS {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "webdav.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	fs, err := NewBoltFS(db, "scope")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return fs
+}
+
+func TestBoltFS(t *testing.T) {
+	ctx := context.Background()
+	fs := testBoltFS(t)
+
+	write := func(name string, data []byte, flag int) {
+		t.Helper()
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|flag, 0644)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	read := func(name string) []byte {
+		t.Helper()
+		f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return data
+	}
+
+	if _, err := fs.OpenFile(ctx, "/missing/file", os.O_RDWR|os.O_CREATE, 0644); !os.IsNotExist(err) {
+		t.Errorf("expected a missing parent to fail, got %v", err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), boltChunkSize/5)
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fs.Mkdir(ctx, "/dir/sub", 0755)
+	write("/dir/big.bin", big, os.O_CREATE|os.O_TRUNC)
+	write("/dir/sub/small.txt", []byte("hello"), os.O_CREATE|os.O_TRUNC)
+	if f, err := fs.OpenFile(ctx, "/dir/sub/small.txt", os.O_RDWR, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := f.Write([]byte("HE")); err == nil {
+		t.Errorf("expected partial writes to be unsupported")
+	} else {
+		f.Close()
+	}
+
+	if got := read("/dir/big.bin"); !bytes.Equal(got, big) {
+		t.Errorf("expected the content back, got %d bytes", len(got))
+	}
+	if got := read("/dir/sub/small.txt"); string(got) != "hello" {
+		t.Errorf("expected the content to be kept, got %q", got)
+	}
+	info, err := fs.Stat(ctx, "/dir/big.bin")
+	if err != nil || info.Size() != int64(len(big)) {
+		t.Errorf("expected the size of the content, got %v %v", info, err)
+	}
+
+	f, _ := fs.OpenFile(ctx, "/dir/big.bin", os.O_RDONLY, 0)
+	f.Seek(boltChunkSize-2, io.SeekStart)
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(f, buf); err != nil || !bytes.Equal(buf, big[boltChunkSize-2:boltChunkSize+2]) {
+		t.Errorf("expected a read across chunks, got %q %v", buf, err)
+	}
+	f.Close()
+
+	prop := webdav.Property{XMLName: xml.Name{Space: "urn:test", Local: "color"}, InnerXML: []byte("red")}
+	f, _ = fs.OpenFile(ctx, "/dir/sub/small.txt", os.O_RDWR, 0)
+	if _, err := f.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{{Props: []webdav.Property{prop}}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+	if got := read("/dir/sub/small.txt"); string(got) != "hello" {
+		t.Errorf("expected patching properties to keep the content, got %q", got)
+	}
+
+	// Moving a tree keeps the content and properties of its files.
+	if err := fs.Rename(ctx, "/dir", "/moved"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := fs.Stat(ctx, "/dir/sub/small.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected the old tree to be gone, got %v", err)
+	}
+	if got := read("/moved/sub/small.txt"); string(got) != "hello" {
+		t.Errorf("expected the content after the move, got %q", got)
+	}
+	f, _ = fs.OpenFile(ctx, "/moved/sub/small.txt", os.O_RDONLY, 0)
+	props, err := f.(webdav.DeadPropsHolder).DeadProps()
+	f.Close()
+	if err != nil || string(props[prop.XMLName].InnerXML) != "red" {
+		t.Errorf("expected the property after the move, got %v %v", props, err)
+	}
+	if err := fs.Rename(ctx, "/moved", "/moved/sub/inside"); err == nil {
+		t.Errorf("expected moving a tree into itself to fail")
+	}
+
+	d, _ := fs.OpenFile(ctx, "/moved", os.O_RDONLY, 0)
+	infos, err := d.Readdir(0)
+	d.Close()
+	if err != nil || len(infos) != 2 || infos[0].Name() != "big.bin" || !infos[1].IsDir() {
+		t.Errorf("expected the entries of the directory, got %v %v", infos, err)
+	}
+
+	if err := fs.RemoveAll(ctx, "/moved"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fs.DB.View(func(tx *bolt.Tx) error {
+		if n := fs.bucket(tx, boltChunks).Stats().KeyN; n != 0 {
+			t.Errorf("expected the content to be removed, got %d chunks", n)
+		}
+		return nil
+	})
+}
+
+func TestBoltFSRewrite(t *testing.T) {
+	ctx := context.Background()
+	fs := testBoltFS(t)
+
+	write := func(data []byte) {
+		t.Helper()
+		f, err := fs.OpenFile(ctx, "/file.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	old := bytes.Repeat([]byte("a"), 3*boltChunkSize)
+	write(old)
+	f, err := fs.OpenFile(ctx, "/file.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	buf := make([]byte, boltChunkSize)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// More chunks than a transaction stores.
+	data := bytes.Repeat([]byte("b"), (boltBatchChunks+1)*boltChunkSize+1)
+	write(data)
+
+	// The reader sees the end of the old content vanish, never the new one.
+	rest, err := io.ReadAll(f)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected the replaced content to fail, got %v", err)
+	}
+	if bytes.ContainsRune(rest, 'b') {
+		t.Errorf("expected no new content in the old file")
+	}
+
+	g, _ := fs.OpenFile(ctx, "/file.bin", os.O_RDONLY, 0)
+	got, err := io.ReadAll(g)
+	g.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("expected the new content, got %d bytes %v", len(got), err)
+	}
+	fs.DB.View(func(tx *bolt.Tx) error {
+		if n := fs.bucket(tx, boltChunks).Stats().KeyN; n != boltBatchChunks+2 {
+			t.Errorf("expected the old chunks to be deleted, got %d chunks", n)
+		}
+		return nil
+	})
+}
+
+func TestConfigServeHTTPBolt(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "webdav.db")
+	cfg := testConfig(t, `{"modify": true, "bolt": {"path": "`+db+`"},
+		"users": [{"username": "bob", "password": "bob", "scope": "bob"}]}`)
+	if _, err := os.Stat(db); !os.IsNotExist(err) {
+		t.Errorf("expected the database to be opened by the first mount, got %v", err)
+	}
+
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("bob", "bob")
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("MKCOL", "/docs", ""); w.Code != http.StatusCreated {
+		t.Fatalf("expected the directory to be created, got %d", w.Code)
+	}
+	if w := do("PUT", "/docs/a.txt", "hello world"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	patch := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><T:color xmlns:T="urn:test">red</T:color></D:prop></D:set></D:propertyupdate>`
+	if w := do("PROPPATCH", "/docs/a.txt", patch); w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected the properties to be set, got %d", w.Code)
+	}
+	if w := do("COPY", "/docs", "", "Destination", "/copy"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the copy to succeed, got %d", w.Code)
+	}
+	if w := do("MOVE", "/docs", "", "Destination", "/archive"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the move to succeed, got %d", w.Code)
+	}
+
+	if w := do("GET", "/archive/a.txt", "", "Range", "bytes=6-10"); w.Body.String() != "world" {
+		t.Errorf("expected the range, got %d %q", w.Code, w.Body)
+	}
+	propfind := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:getcontenttype/><T:color xmlns:T="urn:test"/></D:prop></D:propfind>`
+	for _, name := range []string{"/archive/", "/copy/"} {
+		w := do("PROPFIND", name, propfind, "Depth", "1")
+		for _, want := range []string{"<D:getcontentlength>11</D:getcontentlength>", "text/plain", ">red</"} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("expected %s in the listing of %s, got %s", want, name, w.Body)
+			}
+		}
+	}
+	if w := do("GET", "/docs/a.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the moved tree to be gone, got %d", w.Code)
+	}
+}
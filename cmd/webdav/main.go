@@ -0,0 +1,227 @@
+// Command webdav serves WebDAV according to a JSON configuration file.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wwqdrh/webdav"
+	xwebdav "golang.org/x/net/webdav"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  webdav serve [-c config.json] [-watch interval]
+  webdav check-access [-c config.json] [-ip addr] [-at time] <user> <path> <op>
+  webdav token [-c config.json] [-ttl duration] [-scope path] [-ro] <user>
+  webdav gc [-c config.json] [-grace duration]
+  webdav rollback [-author name] <dir> <path> <commit>
+
+op is "read", "write" or an HTTP/WebDAV method such as PUT or PROPFIND.`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = serve(os.Args[2:])
+	case "check-access":
+		err = checkAccess(os.Args[2:])
+	case "token":
+		err = token(os.Args[2:])
+	case "gc":
+		err = gc(os.Args[2:])
+	case "rollback":
+		err = rollback(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "webdav:", err)
+		os.Exit(1)
+	}
+}
+
+func loadConfig(fs *flag.FlagSet, args []string) (*webdav.FileConfig, *webdav.Config, error) {
+	path := fs.String("c", "config.json", "configuration file")
+	fs.Parse(args)
+
+	fc, err := webdav.LoadConfig(*path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := fc.Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	return fc, cfg, nil
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	path := fs.String("c", "config.json", "configuration file")
+	interval := fs.Duration("watch", 2*time.Second, "how often the configuration file is checked for changes, 0 to disable")
+	fs.Parse(args)
+
+	rl, err := webdav.NewReloader(*path)
+	if err != nil {
+		return err
+	}
+	if *interval > 0 {
+		go rl.Watch(context.Background(), *interval)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := rl.Reload(); err != nil {
+				fmt.Fprintln(os.Stderr, "webdav: reload:", err)
+			} else {
+				fmt.Println("reloaded", *path)
+			}
+		}
+	}()
+
+	fc, cfg := rl.FileConfig(), rl.Config()
+	addr := fc.Address + ":" + strconv.Itoa(fc.Port)
+	srv := &http.Server{Addr: addr, Handler: rl}
+	if cfg.Metrics != nil {
+		srv.ConnState = cfg.Metrics.ConnState
+	}
+	fmt.Println("listening on", addr)
+	return srv.ListenAndServe()
+}
+
+func checkAccess(args []string) error {
+	fs := flag.NewFlagSet("check-access", flag.ExitOnError)
+	ip := fs.String("ip", "", "client address")
+	at := fs.String("at", "", "time of the access in RFC 3339 format (default now)")
+	_, cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		usage()
+	}
+	username, path, op := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+
+	u, ok := cfg.Users[username]
+	if !ok {
+		return fmt.Errorf("unknown user %q", username)
+	}
+
+	var readOnly bool
+	switch op = strings.ToUpper(op); op {
+	case "READ":
+		readOnly = true
+	case "WRITE":
+		readOnly = false
+	case "GET", "HEAD", "OPTIONS", "PROPFIND", "PUT", "DELETE", "MKCOL",
+		"COPY", "MOVE", "LOCK", "UNLOCK", "PROPPATCH", "POST":
+		// The path of a COPY is its source, which is only read.
+		readOnly = webdav.ReadOnlyMethod(op) || op == "COPY"
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+
+	access := webdav.Access{Path: path, NoModification: readOnly, Time: time.Now()}
+	if *ip != "" {
+		if access.IP = net.ParseIP(*ip); access.IP == nil {
+			return fmt.Errorf("invalid address %q", *ip)
+		}
+	}
+	if *at != "" {
+		if access.Time, err = time.Parse(time.RFC3339, *at); err != nil {
+			return err
+		}
+	}
+
+	d := cfg.DecideAccess(u, access)
+	fmt.Printf("%s %s %s: %s\n", username, op, path, d)
+	if !d.Allowed {
+		os.Exit(3)
+	}
+	return nil
+}
+
+func token(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	ttl := fs.Duration("ttl", time.Hour, "validity of the token")
+	scope := fs.String("scope", "", "path the token is confined to")
+	readOnly := fs.Bool("ro", false, "only allow read access")
+	_, cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		usage()
+	}
+	if cfg.Tokens == nil {
+		return fmt.Errorf("no tokenSecret configured")
+	}
+
+	t, err := cfg.Tokens.Issue(webdav.TokenClaims{
+		Subject:  fs.Arg(0),
+		Scope:    *scope,
+		ReadOnly: *readOnly,
+	}, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(t)
+	return nil
+}
+
+func gc(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	grace := fs.Duration("grace", time.Hour, "age below which unreferenced content is kept")
+	fc, _, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if fc.Dedup == nil {
+		return fmt.Errorf("no dedup store configured")
+	}
+
+	store, err := webdav.NewDedupStore(fc.Dedup.Root)
+	if err != nil {
+		return err
+	}
+	stats, err := store.Collect(*grace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("kept %d blobs, removed %d (%d bytes)\n", stats.Blobs, stats.Removed, stats.Freed)
+	return nil
+}
+
+func rollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	author := fs.String("author", "webdav", "user the rollback is committed as")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		usage()
+	}
+	dir, path, commit := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+
+	g, err := webdav.NewGitFS(xwebdav.Dir(dir), dir)
+	if err != nil {
+		return err
+	}
+	return g.Rollback(context.Background(), path, commit, *author)
+}
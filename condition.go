@@ -0,0 +1,118 @@
+package webdav
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Access describes a request to be authorized.
+type Access struct {
+	Path           string
+	NoModification bool
+	// IP is the address of the client, nil when unknown.
+	IP   net.IP
+	Time time.Time
+}
+
+// RequestAccess returns the access made by r.
+func RequestAccess(r *http.Request) Access {
+	return Access{
+		Path:           r.URL.Path,
+		NoModification: ReadOnlyMethod(r.Method),
+		IP:             remoteIP(r),
+		Time:           time.Now(),
+	}
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the address of the client of r, empty when unknown.
+func clientIP(r *http.Request) string {
+	if ip := remoteIP(r); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// TimeWindow is a daily period of time, such as business hours. A window
+// whose End is not after its Start spans midnight.
+type TimeWindow struct {
+	// Weekdays the window starts on; every day when empty.
+	Weekdays []time.Weekday
+	// Start and End are offsets from midnight.
+	Start time.Duration
+	End   time.Duration
+	// Location the window is expressed in; UTC when nil.
+	Location *time.Location
+}
+
+// Contains reports whether t falls inside the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	offset := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if w.Start < w.End {
+		return w.onDay(t.Weekday()) && offset >= w.Start && offset < w.End
+	}
+	return (w.onDay(t.Weekday()) && offset >= w.Start) ||
+		(w.onDay((t.Weekday()+6)%7) && offset < w.End)
+}
+
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range w.Weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// applies reports whether the network and time conditions of the rule
+// hold for the access. When the client is unknown, rules restricted to
+// networks are assumed to apply if they deny and not to if they allow,
+// so that an unknown client is never granted more.
+func (r *Rule) applies(a Access) bool {
+	if len(r.Networks) > 0 {
+		if a.IP == nil {
+			if r.Allow {
+				return false
+			}
+		} else if !containsIP(r.Networks, a.IP) {
+			return false
+		}
+	}
+	if len(r.Windows) > 0 {
+		for _, w := range r.Windows {
+			if w.Contains(a.Time) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package webdav
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+
+	business := TimeWindow{
+		Weekdays: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start:    9 * time.Hour,
+		End:      17 * time.Hour,
+		Location: berlin,
+	}
+	night := TimeWindow{
+		Weekdays: []time.Weekday{time.Friday},
+		Start:    22 * time.Hour,
+		End:      6 * time.Hour,
+	}
+
+	tests := []struct {
+		name   string
+		window TimeWindow
+		time   string
+		want   bool
+	}{
+		{"business hours", business, "2024-10-18T10:00:00+02:00", true},
+		{"business hours in UTC", business, "2024-10-18T07:30:00Z", true},
+		{"before opening", business, "2024-10-18T06:59:00Z", false},
+		{"weekend", business, "2024-10-19T10:00:00+02:00", false},
+		{"night start", night, "2024-10-18T23:00:00Z", true},
+		{"night after midnight", night, "2024-10-19T05:59:00Z", true},
+		{"night wrong day", night, "2024-10-20T05:00:00Z", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tt.time)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := tt.window.Contains(at); got != tt.want {
+				t.Errorf("TimeWindow.Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserDecideAccessConditions(t *testing.T) {
+	cfg := testConfig(t, `{
+		"users": [{"username": "alice", "modify": false, "rules": [
+			{"path": "/finance/", "allow": true, "modify": true,
+			 "networks": ["10.0.0.0/8", "192.168.1.10"],
+			 "windows": [{"days": ["mon", "tue", "wed", "thu", "fri"], "start": "09:00", "end": "17:00"}]},
+			{"path": "/finance/payroll/", "allow": true, "modify": true},
+			{"path": "/finance/payroll/", "allow": false, "networks": ["10.9.0.0/16"]}
+		]}]
+	}`)
+	alice := cfg.Users["alice"]
+
+	monday := time.Date(2024, 10, 14, 10, 0, 0, 0, time.UTC)
+	sunday := time.Date(2024, 10, 13, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		path string
+		ip   string
+		at   time.Time
+		want bool
+	}{
+		{"office during hours", "/finance/report.xls", "10.1.2.3", monday, true},
+		{"single address", "/finance/report.xls", "192.168.1.10", monday, true},
+		{"outside network", "/finance/report.xls", "203.0.113.5", monday, false},
+		{"outside window", "/finance/report.xls", "10.1.2.3", sunday, false},
+		{"unknown client", "/finance/report.xls", "", monday, false},
+		{"denied network", "/finance/payroll/june.xls", "10.9.1.1", monday, false},
+		{"other network", "/finance/payroll/june.xls", "10.1.2.3", monday, true},
+		{"unknown client denied", "/finance/payroll/june.xls", "", monday, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := alice.DecideAccess(Access{Path: tt.path, IP: net.ParseIP(tt.ip), Time: tt.at})
+			if d.Allowed != tt.want {
+				t.Errorf("User.DecideAccess() = %+v, want allowed %v", d, tt.want)
+			}
+		})
+	}
+}
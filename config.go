@@ -0,0 +1,858 @@
+package webdav
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wwqdrh/webdav/driver"
+	"golang.org/x/net/webdav"
+)
+
+// RuleConfig is the on-disk representation of a Rule. Networks are CIDRs
+// or single addresses.
+type RuleConfig struct {
+	Path     string         `json:"path"`
+	Regex    bool           `json:"regex"`
+	Allow    bool           `json:"allow"`
+	Modify   bool           `json:"modify"`
+	Networks []string       `json:"networks,omitempty"`
+	Windows  []WindowConfig `json:"windows,omitempty"`
+}
+
+// WindowConfig is the on-disk representation of a TimeWindow. Days are
+// abbreviated English weekday names ("mon", "tue", ...), Start and End
+// are "15:04" clock times and Timezone is an IANA zone name.
+type WindowConfig struct {
+	Days     []string `json:"days,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// GroupConfig is the on-disk representation of a Group.
+type GroupConfig struct {
+	Name   string       `json:"name"`
+	Scope  string       `json:"scope,omitempty"`
+	Modify *bool        `json:"modify,omitempty"`
+	Rules  []RuleConfig `json:"rules,omitempty"`
+}
+
+// UserConfig is the on-disk representation of a User. Unset fields are
+// inherited from the last group of the user that sets them, then from
+// the top-level defaults of the FileConfig.
+type UserConfig struct {
+	Username string       `json:"username"`
+	Password string       `json:"password"`
+	Scope    string       `json:"scope,omitempty"`
+	Mounts   []MountPoint `json:"mounts,omitempty"`
+	Modify   *bool        `json:"modify,omitempty"`
+	Admin    bool         `json:"admin,omitempty"`
+	Disabled bool         `json:"disabled,omitempty"`
+	Groups   []string     `json:"groups,omitempty"`
+	Rules    []RuleConfig `json:"rules,omitempty"`
+
+	AppPasswords   []AppPasswordConfig `json:"appPasswords,omitempty"`
+	RateLimit      *RateLimit          `json:"rateLimit,omitempty"`
+	UploadPolicies []UploadPolicy      `json:"uploadPolicies,omitempty"`
+}
+
+// AppPasswordConfig is the on-disk representation of an AppPassword.
+type AppPasswordConfig struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Path     string `json:"path,omitempty"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+	Revoked  bool   `json:"revoked,omitempty"`
+}
+
+// ProvisionConfig is the on-disk representation of a Provision. Perm is
+// an octal permission string such as "0750".
+type ProvisionConfig struct {
+	Perm     string `json:"perm,omitempty"`
+	Skeleton string `json:"skeleton,omitempty"`
+}
+
+// AuthConfig selects the authentication backend. Type is "config" (the
+// default), "htpasswd" or "ldap".
+type AuthConfig struct {
+	Type     string      `json:"type"`
+	Htpasswd string      `json:"htpasswd,omitempty"`
+	LDAP     *LDAPConfig `json:"ldap,omitempty"`
+}
+
+// LDAPConfig is the on-disk representation of an LDAPAuthenticator.
+// Groups maps LDAP group names to configured groups and CacheTTL is a
+// duration such as "5m".
+type LDAPConfig struct {
+	URL               string            `json:"url"`
+	BindDN            string            `json:"bindDN,omitempty"`
+	BindPassword      string            `json:"bindPassword,omitempty"`
+	BaseDN            string            `json:"baseDN"`
+	UserFilter        string            `json:"userFilter,omitempty"`
+	UsernameAttribute string            `json:"usernameAttribute,omitempty"`
+	GroupBaseDN       string            `json:"groupBaseDN,omitempty"`
+	GroupFilter       string            `json:"groupFilter,omitempty"`
+	GroupAttribute    string            `json:"groupAttribute,omitempty"`
+	Groups            map[string]string `json:"groups,omitempty"`
+	CacheTTL          string            `json:"cacheTTL,omitempty"`
+}
+
+// FileConfig is the JSON configuration file read by the webdav command.
+// The top-level Rules apply to every user, overridden by the rules of its
+// groups, themselves overridden by the user's own rules. Scopes and rule
+// paths may contain the {username} placeholder.
+type FileConfig struct {
+	Address   string           `json:"address"`
+	Port      int              `json:"port"`
+	Prefix    string           `json:"prefix"`
+	Auth      bool             `json:"auth"`
+	NoSniff   bool             `json:"nosniff"`
+	Debug     bool             `json:"debug"`
+	Scope     string           `json:"scope"`
+	Modify    bool             `json:"modify"`
+	Rules     []RuleConfig     `json:"rules"`
+	Groups    []GroupConfig    `json:"groups"`
+	Users     []UserConfig     `json:"users"`
+	Provision *ProvisionConfig `json:"provision,omitempty"`
+	// Authenticator checks passwords. Users authenticated by an external
+	// backend without an entry in Users get the top-level defaults.
+	Authenticator *AuthConfig `json:"authenticator,omitempty"`
+	// TokenSecret is the HMAC key of bearer tokens, which are only
+	// accepted when it is set.
+	TokenSecret string `json:"tokenSecret,omitempty"`
+	// Shares enables share links.
+	Shares *SharesConfig `json:"shares,omitempty"`
+	// Lockout enables login throttling.
+	Lockout *LockoutConfig `json:"lockout,omitempty"`
+	// AuditLog is a file audit events are appended to as JSON lines.
+	// They go to the regular log when empty.
+	AuditLog string `json:"auditLog,omitempty"`
+	// RateLimit applies to every user without its own.
+	RateLimit RateLimit `json:"rateLimit"`
+	// Metrics serves Prometheus metrics at /metrics, to administrators
+	// when auth is enabled.
+	Metrics bool `json:"metrics,omitempty"`
+	// CORS enables cross-origin requests from browsers.
+	CORS *CORS `json:"cors,omitempty"`
+	// BrowseArchives exposes zip and tar archives as read-only folders,
+	// "file.zip/" listing the members of file.zip.
+	BrowseArchives bool `json:"browseArchives,omitempty"`
+	// Remote serves the scopes from a remote WebDAV account instead of
+	// local directories.
+	Remote *RemoteConfig `json:"remote,omitempty"`
+	// Dedup stores the scopes in a deduplicating store instead of local
+	// directories.
+	Dedup *DedupConfig `json:"dedup,omitempty"`
+	// Bolt stores the scopes in a bbolt database instead of local
+	// directories.
+	Bolt *BoltConfig `json:"bolt,omitempty"`
+	// Git makes local scopes Git repositories committing the changes.
+	Git *GitConfig `json:"git,omitempty"`
+	// Hooks are notified of the changes made through the server.
+	Hooks []HookConfig `json:"hooks,omitempty"`
+	// UploadPolicies apply to every user, along with their own.
+	UploadPolicies []UploadPolicy `json:"uploadPolicies,omitempty"`
+	// Scan has the uploads checked before they become visible.
+	Scan *ScanConfig `json:"scan,omitempty"`
+	// EncryptionKeyFile is a file holding a master key, 32 random bytes
+	// or more, raw or hex encoded. The files of local scopes are encrypted
+	// on disk when it is set.
+	EncryptionKeyFile string `json:"encryptionKeyFile,omitempty"`
+}
+
+// ScanConfig is the on-disk representation of a Scanning, with either a
+// clamd daemon, at an address such as "unix:/run/clamav/clamd.ctl" or
+// "127.0.0.1:3310", or a command. Verdicts is the file keeping the
+// verdicts, which are kept in memory when it is empty.
+type ScanConfig struct {
+	Clamd      string   `json:"clamd,omitempty"`
+	Command    []string `json:"command,omitempty"`
+	Timeout    string   `json:"timeout,omitempty"`
+	Quarantine string   `json:"quarantine,omitempty"`
+	Verdicts   string   `json:"verdicts,omitempty"`
+	FailOpen   bool     `json:"failOpen,omitempty"`
+}
+
+// HookConfig is the on-disk representation of an event sink: a Webhook
+// when URL is set, a Command otherwise. Events limits the event types
+// and durations are strings such as "30s".
+type HookConfig struct {
+	Events      []string `json:"events,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	Secret      string   `json:"secret,omitempty"`
+	QueueDir    string   `json:"queueDir,omitempty"`
+	MaxQueue    int      `json:"maxQueue,omitempty"`
+	MaxAttempts int      `json:"maxAttempts,omitempty"`
+	Command     []string `json:"command,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+}
+
+// RemoteConfig is a remote WebDAV account, Jianguoyun unless URL is set.
+// Scopes are directories of the account. CacheTTL is a string such as
+// "10s".
+type RemoteConfig struct {
+	URL      string `json:"url,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TempDir  string `json:"tempDir,omitempty"`
+	CacheTTL string `json:"cacheTTL,omitempty"`
+}
+
+// DedupConfig is a DedupStore under Root, where each scope gets a
+// directory of the tree and identical files share their content.
+type DedupConfig struct {
+	Root string `json:"root"`
+}
+
+// BoltConfig is a bbolt database at Path, where each scope gets a
+// BoltFS. TempDir holds the large files being written.
+type BoltConfig struct {
+	Path    string `json:"path"`
+	TempDir string `json:"tempDir,omitempty"`
+}
+
+// GitConfig is the on-disk representation of a GitVersioning. Window is
+// a string such as "2s", the default.
+type GitConfig struct {
+	Scopes       []string `json:"scopes,omitempty"`
+	Window       string   `json:"window,omitempty"`
+	HistoryLimit int      `json:"historyLimit,omitempty"`
+}
+
+// LockoutConfig is the on-disk representation of a LoginGuard. Unset
+// fields keep the defaults of NewLoginGuard; durations are strings such
+// as "15m".
+type LockoutConfig struct {
+	Window           string `json:"window,omitempty"`
+	MaxFailures      int    `json:"maxFailures,omitempty"`
+	MaxFailuresPerIP int    `json:"maxFailuresPerIP,omitempty"`
+	Duration         string `json:"duration,omitempty"`
+	BaseDelay        string `json:"baseDelay,omitempty"`
+	MaxDelay         string `json:"maxDelay,omitempty"`
+	MaxTracked       int    `json:"maxTracked,omitempty"`
+}
+
+// SharesConfig configures share links. Store is the JSON file keeping
+// the shares and Secret signs their links.
+type SharesConfig struct {
+	Store  string `json:"store"`
+	Secret string `json:"secret"`
+}
+
+// LoadConfig reads and parses a JSON configuration file.
+func LoadConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses a JSON configuration.
+func ParseConfig(data []byte) (*FileConfig, error) {
+	fc := &FileConfig{
+		Address: "0.0.0.0",
+		Port:    8080,
+		Auth:    true,
+		Scope:   ".",
+	}
+	if err := json.Unmarshal(data, fc); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// Build compiles the rules and creates the handlers of every user.
+func (fc *FileConfig) Build() (*Config, error) {
+	defaults, err := compileRules(fc.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		User: &User{
+			Scope:          fc.Scope,
+			Modify:         fc.Modify,
+			Defaults:       defaults,
+			UploadPolicies: fc.UploadPolicies,
+		},
+		Auth:           fc.Auth,
+		NoSniff:        fc.NoSniff,
+		Debug:          fc.Debug,
+		Prefix:         fc.Prefix,
+		RateLimit:      fc.RateLimit,
+		CORS:           fc.CORS,
+		BrowseArchives: fc.BrowseArchives,
+		Users:          map[string]*User{},
+	}
+	if fc.Provision != nil {
+		cfg.Provision = &Provision{Skeleton: fc.Provision.Skeleton}
+		if fc.Provision.Perm != "" {
+			perm, err := strconv.ParseUint(fc.Provision.Perm, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid provision perm %q: %w", fc.Provision.Perm, err)
+			}
+			cfg.Provision.Perm = os.FileMode(perm).Perm()
+		}
+	}
+
+	groups := map[string]*groupEntry{}
+	for _, gc := range fc.Groups {
+		if gc.Name == "" {
+			return nil, fmt.Errorf("group without name")
+		}
+		if _, ok := groups[gc.Name]; ok {
+			return nil, fmt.Errorf("duplicate group %q", gc.Name)
+		}
+
+		rules, err := compileRules(gc.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %w", gc.Name, err)
+		}
+		g := &Group{Name: gc.Name, Scope: gc.Scope, Rules: rules}
+		if gc.Modify != nil {
+			g.Modify = *gc.Modify
+		}
+		groups[gc.Name] = &groupEntry{group: g, modifySet: gc.Modify != nil}
+	}
+
+	for _, uc := range fc.Users {
+		if uc.Username == "" {
+			return nil, fmt.Errorf("user without username")
+		}
+		if _, ok := cfg.Users[uc.Username]; ok {
+			return nil, fmt.Errorf("duplicate user %q", uc.Username)
+		}
+
+		rules, err := compileRules(uc.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", uc.Username, err)
+		}
+		mounted := map[string]bool{}
+		for _, mp := range uc.Mounts {
+			p := path.Clean("/" + mp.Path)
+			if mp.Scope == "" || mounted[p] {
+				return nil, fmt.Errorf("user %q: invalid mount %q", uc.Username, mp.Path)
+			}
+			mounted[p] = true
+		}
+
+		u := &User{
+			Username:       uc.Username,
+			Password:       uc.Password,
+			Scope:          fc.Scope,
+			Modify:         fc.Modify,
+			Mounts:         uc.Mounts,
+			Admin:          uc.Admin,
+			Disabled:       uc.Disabled,
+			Rules:          rules,
+			Defaults:       defaults,
+			RateLimit:      uc.RateLimit,
+			UploadPolicies: append(append([]UploadPolicy{}, fc.UploadPolicies...), uc.UploadPolicies...),
+		}
+		for _, apc := range uc.AppPasswords {
+			u.AppPasswords = append(u.AppPasswords, &AppPassword{
+				Name:        apc.Name,
+				Password:    apc.Password,
+				Restriction: Restriction{Path: apc.Path, ReadOnly: apc.ReadOnly},
+				Revoked:     apc.Revoked,
+			})
+		}
+
+		for _, name := range uc.Groups {
+			entry, ok := groups[name]
+			if !ok {
+				return nil, fmt.Errorf("user %q: unknown group %q", uc.Username, name)
+			}
+			u.Groups = append(u.Groups, entry.group)
+
+			if entry.group.Scope != "" {
+				u.Scope = entry.group.Scope
+			}
+			if entry.modifySet {
+				u.Modify = entry.group.Modify
+			}
+		}
+		if uc.Scope != "" {
+			u.Scope = uc.Scope
+		}
+		if uc.Modify != nil {
+			u.Modify = *uc.Modify
+		}
+		if u, err = u.Expand(); err != nil {
+			return nil, fmt.Errorf("user %q: %w", uc.Username, err)
+		}
+		cfg.Users[u.Username] = u
+	}
+
+	if fc.TokenSecret != "" {
+		cfg.Tokens = &TokenIssuer{Secret: []byte(fc.TokenSecret)}
+	}
+
+	if fc.Shares != nil {
+		if fc.Shares.Secret == "" {
+			return nil, fmt.Errorf("shares without secret")
+		}
+		if cfg.Shares, err = NewShareStore(fc.Shares.Store, []byte(fc.Shares.Secret)); err != nil {
+			return nil, fmt.Errorf("load shares: %w", err)
+		}
+	}
+
+	if fc.AuditLog != "" {
+		if info, err := os.Stat(filepath.Dir(fc.AuditLog)); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("audit log %s: no such directory", fc.AuditLog)
+		}
+		cfg.Audit = &FileAuditor{Path: fc.AuditLog}
+	}
+
+	if fc.Lockout != nil {
+		if cfg.Guard, err = fc.Lockout.build(); err != nil {
+			return nil, err
+		}
+		cfg.Guard.OnLockout = func(kind, key string, until time.Time) {
+			ev := AuditEvent{Type: "lockout", Detail: "locked until " + until.Format(time.RFC3339)}
+			if kind == "user" {
+				ev.Username = key
+			} else {
+				ev.IP = key
+			}
+			cfg.audit(ev)
+		}
+	}
+
+	if fc.CORS != nil && len(fc.CORS.AllowedOrigins) == 0 {
+		return nil, fmt.Errorf("cors without allowed origins")
+	}
+
+	if fc.Metrics {
+		cfg.Metrics = NewMetrics()
+	}
+
+	if fc.Remote != nil {
+		if cfg.Backend, err = fc.Remote.build(); err != nil {
+			return nil, err
+		}
+	}
+
+	if fc.Dedup != nil {
+		if fc.Remote != nil {
+			return nil, fmt.Errorf("remote and dedup are exclusive")
+		}
+		if cfg.Backend, err = fc.Dedup.build(); err != nil {
+			return nil, err
+		}
+	}
+
+	if fc.Bolt != nil {
+		if cfg.Backend != nil {
+			return nil, fmt.Errorf("bolt is exclusive with remote and dedup")
+		}
+		if cfg.Backend, err = fc.Bolt.build(); err != nil {
+			return nil, err
+		}
+	}
+
+	if fc.EncryptionKeyFile != "" {
+		if cfg.Backend != nil {
+			return nil, fmt.Errorf("encryption only applies to local scopes")
+		}
+		if cfg.MasterKey, err = LoadMasterKey(fc.EncryptionKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if fc.Git != nil {
+		if cfg.Backend != nil {
+			return nil, fmt.Errorf("git only applies to local scopes")
+		}
+		if cfg.MasterKey != nil {
+			// The history would serve, and the commits keep, the
+			// encrypted content.
+			return nil, fmt.Errorf("git is exclusive with encryption")
+		}
+		if cfg.Git, err = fc.Git.build(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Backend != nil {
+		// The content of uploads is checked as it is written to local
+		// scopes, so chunked uploads would escape the policies.
+		policies := len(fc.UploadPolicies) > 0
+		for _, uc := range fc.Users {
+			policies = policies || len(uc.UploadPolicies) > 0
+		}
+		if policies {
+			return nil, fmt.Errorf("upload policies only apply to local scopes")
+		}
+	}
+
+	if fc.Scan != nil {
+		if cfg.Backend != nil {
+			// Uploads are scanned as they are written to local scopes.
+			return nil, fmt.Errorf("scan only applies to local scopes")
+		}
+		if cfg.Scanning, err = fc.Scan.build(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hc := range fc.Hooks {
+		sink, err := hc.build()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Events = append(cfg.Events, sink)
+	}
+
+	if fc.Authenticator != nil {
+		if cfg.Authenticator, err = fc.Authenticator.build(cfg, groups); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+func (rc *RemoteConfig) build() (func(scope string) (webdav.FileSystem, error), error) {
+	if rc.Username == "" || rc.Password == "" {
+		return nil, fmt.Errorf("remote without credentials")
+	}
+	var ttl time.Duration
+	if rc.CacheTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(rc.CacheTTL); err != nil {
+			return nil, fmt.Errorf("invalid remote cache ttl %q: %w", rc.CacheTTL, err)
+		}
+	}
+
+	d := driver.NewJianguoDriver(nil).(*driver.JianguoDriver)
+	if rc.URL != "" {
+		d.SetEntry(rc.URL)
+	}
+	d.Auth(rc.Username, rc.Password)
+	return func(scope string) (webdav.FileSystem, error) {
+		return &DriverFS{Driver: d, Root: scope, TempDir: rc.TempDir, CacheTTL: ttl}, nil
+	}, nil
+}
+
+func (dc *DedupConfig) build() (func(scope string) (webdav.FileSystem, error), error) {
+	if dc.Root == "" {
+		return nil, fmt.Errorf("dedup without root")
+	}
+	store, err := NewDedupStore(dc.Root)
+	if err != nil {
+		return nil, err
+	}
+	return func(scope string) (webdav.FileSystem, error) {
+		fs, err := store.FS(scope)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	}, nil
+}
+
+func (bc *BoltConfig) build() (func(scope string) (webdav.FileSystem, error), error) {
+	if bc.Path == "" {
+		return nil, fmt.Errorf("bolt without path")
+	}
+	// The database is opened, and locked, by the first mount, so that
+	// the commands loading the configuration work beside the server.
+	return func(scope string) (webdav.FileSystem, error) {
+		db, err := openBoltDB(bc.Path)
+		if err != nil {
+			return nil, err
+		}
+		fs, err := NewBoltFS(db, scope)
+		if err != nil {
+			return nil, err
+		}
+		fs.TempDir = bc.TempDir
+		return fs, nil
+	}, nil
+}
+
+func (gc *GitConfig) build() (*GitVersioning, error) {
+	v := &GitVersioning{Scopes: gc.Scopes, Window: 2 * time.Second, HistoryLimit: gc.HistoryLimit}
+	if gc.Window != "" {
+		var err error
+		if v.Window, err = time.ParseDuration(gc.Window); err != nil {
+			return nil, fmt.Errorf("invalid git window %q: %w", gc.Window, err)
+		}
+	}
+	for _, pattern := range gc.Scopes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid git scope %q: %w", pattern, err)
+		}
+	}
+	return v, nil
+}
+
+func (sc *ScanConfig) build() (*Scanning, error) {
+	var timeout time.Duration
+	if sc.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(sc.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid scan timeout %q: %w", sc.Timeout, err)
+		}
+	}
+
+	s := &Scanning{Quarantine: sc.Quarantine, FailOpen: sc.FailOpen}
+	switch {
+	case sc.Clamd != "" && len(sc.Command) == 0:
+		network, address := "tcp", sc.Clamd
+		if socket, ok := strings.CutPrefix(sc.Clamd, "unix:"); ok {
+			network, address = "unix", socket
+		}
+		s.Scanner = &ClamdScanner{Network: network, Address: address, Timeout: timeout}
+	case sc.Clamd == "" && len(sc.Command) > 0:
+		s.Scanner = &ExecScanner{Path: sc.Command[0], Args: sc.Command[1:], Timeout: timeout}
+	default:
+		return nil, fmt.Errorf("scan needs either clamd or a command")
+	}
+
+	var err error
+	if s.Verdicts, err = NewVerdictStore(sc.Verdicts); err != nil {
+		return nil, fmt.Errorf("load verdicts: %w", err)
+	}
+	return s, nil
+}
+
+func (hc *HookConfig) build() (EventSink, error) {
+	for _, t := range hc.Events {
+		if !slices.Contains(eventTypes, t) {
+			return nil, fmt.Errorf("hook: unknown event %q", t)
+		}
+	}
+	var timeout time.Duration
+	if hc.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(hc.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid hook timeout %q: %w", hc.Timeout, err)
+		}
+	}
+
+	switch {
+	case hc.URL != "" && len(hc.Command) == 0:
+		h := NewWebhook(hc.URL, []byte(hc.Secret))
+		h.Types, h.QueueDir = hc.Events, hc.QueueDir
+		if hc.MaxQueue != 0 {
+			h.MaxQueue = hc.MaxQueue
+		}
+		if hc.MaxAttempts != 0 {
+			h.MaxAttempts = hc.MaxAttempts
+		}
+		if timeout > 0 {
+			h.Client = &http.Client{Timeout: timeout}
+		}
+		return h, nil
+	case hc.URL == "" && len(hc.Command) > 0:
+		return &Command{
+			Path:        hc.Command[0],
+			Args:        hc.Command[1:],
+			Types:       hc.Events,
+			Timeout:     timeout,
+			Concurrency: hc.Concurrency,
+			MaxQueue:    hc.MaxQueue,
+		}, nil
+	default:
+		return nil, fmt.Errorf("hook needs either a url or a command")
+	}
+}
+
+func (lc *LockoutConfig) build() (*LoginGuard, error) {
+	g := NewLoginGuard()
+	if lc.MaxFailures != 0 {
+		g.MaxFailures = lc.MaxFailures
+	}
+	if lc.MaxFailuresPerIP != 0 {
+		g.MaxFailuresPerIP = lc.MaxFailuresPerIP
+	}
+	if lc.MaxTracked != 0 {
+		g.MaxTracked = lc.MaxTracked
+	}
+	for _, d := range []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{lc.Window, &g.Window},
+		{lc.Duration, &g.LockoutDuration},
+		{lc.BaseDelay, &g.BaseDelay},
+		{lc.MaxDelay, &g.MaxDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lockout duration %q: %w", d.value, err)
+		}
+		*d.dst = v
+	}
+	return g, nil
+}
+
+func (ac *AuthConfig) build(cfg *Config, groups map[string]*groupEntry) (Authenticator, error) {
+	switch ac.Type {
+	case "", "config":
+		return ConfigAuthenticator{Users: cfg.Users}, nil
+	case "htpasswd":
+		if ac.Htpasswd == "" {
+			return nil, fmt.Errorf("htpasswd authenticator without file")
+		}
+		return &HtpasswdAuthenticator{Path: ac.Htpasswd, Users: cfg.Users, Template: cfg.User}, nil
+	case "ldap":
+		lc := ac.LDAP
+		if lc == nil || lc.URL == "" {
+			return nil, fmt.Errorf("ldap authenticator without url")
+		}
+		a := &LDAPAuthenticator{
+			Dial:              DialLDAP(lc.URL),
+			BindDN:            lc.BindDN,
+			BindPassword:      lc.BindPassword,
+			BaseDN:            lc.BaseDN,
+			UserFilter:        lc.UserFilter,
+			UsernameAttribute: lc.UsernameAttribute,
+			GroupBaseDN:       lc.GroupBaseDN,
+			GroupFilter:       lc.GroupFilter,
+			GroupAttribute:    lc.GroupAttribute,
+			Groups:            map[string]*Group{},
+			Users:             cfg.Users,
+			Template:          cfg.User,
+		}
+		for ldapGroup, name := range lc.Groups {
+			entry, ok := groups[name]
+			if !ok {
+				return nil, fmt.Errorf("ldap group %q: unknown group %q", ldapGroup, name)
+			}
+			a.Groups[ldapGroup] = entry.group
+		}
+		if lc.CacheTTL != "" {
+			ttl, err := time.ParseDuration(lc.CacheTTL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ldap cacheTTL: %w", err)
+			}
+			a.CacheTTL = ttl
+		}
+		return a, nil
+	default:
+		return nil, fmt.Errorf("unknown authenticator %q", ac.Type)
+	}
+}
+
+type groupEntry struct {
+	group     *Group
+	modifySet bool
+}
+
+func compileRules(rcs []RuleConfig) ([]*Rule, error) {
+	rules := make([]*Rule, 0, len(rcs))
+	for _, rc := range rcs {
+		rule := &Rule{
+			Regex:  rc.Regex,
+			Allow:  rc.Allow,
+			Modify: rc.Modify,
+			Path:   rc.Path,
+		}
+		if rc.Regex {
+			re, err := regexp.Compile(rc.Path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %w", rc.Path, err)
+			}
+			rule.Regexp = re
+		}
+		for _, network := range rc.Networks {
+			ipnet, err := parseNetwork(network)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rc.Path, err)
+			}
+			rule.Networks = append(rule.Networks, ipnet)
+		}
+		for _, wc := range rc.Windows {
+			window, err := wc.parse()
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rc.Path, err)
+			}
+			rule.Windows = append(rule.Windows, window)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q: %w", s, err)
+	}
+	return ipnet, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (wc WindowConfig) parse() (TimeWindow, error) {
+	var w TimeWindow
+	for _, day := range wc.Days {
+		d, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return w, fmt.Errorf("invalid weekday %q", day)
+		}
+		w.Weekdays = append(w.Weekdays, d)
+	}
+
+	var err error
+	if w.Start, err = parseClock(wc.Start); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(wc.End); err != nil {
+		return w, err
+	}
+	if wc.Timezone != "" {
+		if w.Location, err = time.LoadLocation(wc.Timezone); err != nil {
+			return w, err
+		}
+	}
+	return w, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,118 @@
+package webdav
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileConfigBuild(t *testing.T) {
+	cfg := testConfig(t, `{
+		"scope": "/srv",
+		"modify": true,
+		"rules": [{"path": "^/tmp/", "regex": true, "allow": false}],
+		"users": [
+			{"username": "alice", "password": "a", "scope": "/home/alice"},
+			{"username": "bob", "password": "b", "modify": false,
+			 "rules": [{"path": "/shared/", "allow": true}]}
+		]
+	}`)
+
+	alice := cfg.Users["alice"]
+	if alice.Scope != "/home/alice" || !alice.Modify || len(alice.Rules) != 0 || len(alice.Defaults) != 1 {
+		t.Errorf("unexpected user alice: %+v", alice)
+	}
+
+	bob := cfg.Users["bob"]
+	if bob.Scope != "/srv" || bob.Modify || len(bob.Rules) != 1 || len(bob.Defaults) != 1 {
+		t.Errorf("unexpected user bob: %+v", bob)
+	}
+	if bob.Allowed("/tmp/file", true) {
+		t.Errorf("expected default rule to deny /tmp/file")
+	}
+	if h, err := cfg.mount(bob); err != nil || h.Prefix != cfg.Prefix {
+		t.Errorf("unexpected mount result: %v, %v", h, err)
+	}
+}
+
+func TestFileConfigBuildErrors(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)), 0600)
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"invalid regex", `{"rules": [{"path": "(", "regex": true}]}`},
+		{"duplicate user", `{"users": [{"username": "a"}, {"username": "a"}]}`},
+		{"missing username", `{"users": [{"password": "a"}]}`},
+		{"remote without credentials", `{"remote": {"url": "http://localhost/"}}`},
+		{"hook without target", `{"hooks": [{"events": ["create"]}]}`},
+		{"scan without scanner", `{"scan": {"quarantine": "/tmp"}}`},
+		{"audit log in missing directory", `{"auditLog": "/nonexistent/audit.log"}`},
+		{"missing encryption key", `{"encryptionKeyFile": "/nonexistent/key"}`},
+		{"dedup without root", `{"dedup": {}}`},
+		{"bolt without path", `{"bolt": {}}`},
+		{"git with invalid window", `{"git": {"window": "soon"}}`},
+		{"upload policies with bolt", `{"bolt": {"path": "/tmp/webdav.db"}, "uploadPolicies": [{"maxSize": 10}]}`},
+		{"user upload policies with bolt", `{"bolt": {"path": "/tmp/webdav.db"}, "users": [{"username": "a", "uploadPolicies": [{"maxSize": 10}]}]}`},
+		{"scan with bolt", `{"bolt": {"path": "/tmp/webdav.db"}, "scan": {"command": ["true"]}}`},
+		{"git with encryption", `{"git": {}, "encryptionKeyFile": "` + keyFile + `"}`},
+		{"hook with unknown event", `{"hooks": [{"url": "http://localhost/", "events": ["rename"]}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc, err := ParseConfig([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := fc.Build(); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestFileConfigBuildGroups(t *testing.T) {
+	cfg := testConfig(t, `{
+		"scope": "/srv",
+		"rules": [{"path": "/", "allow": false}],
+		"groups": [
+			{"name": "team", "scope": "/srv/team", "modify": true,
+			 "rules": [{"path": "/readonly/", "allow": true}]},
+			{"name": "other", "scope": "/srv/other", "modify": false}
+		],
+		"users": [
+			{"username": "alice", "groups": ["team", "other"]},
+			{"username": "bob", "groups": ["other", "team"], "scope": "/home/bob"}
+		]
+	}`)
+
+	// The last group setting a field wins, as do the rules of later groups.
+	alice := cfg.Users["alice"]
+	if alice.Scope != "/srv/other" || alice.Modify || len(alice.Groups) != 2 {
+		t.Errorf("unexpected user alice: %+v", alice)
+	}
+	if alice.Allowed("/readonly/file", false) {
+		t.Errorf("expected group rule to deny modification")
+	}
+	// Group rules override the global ones.
+	if d := alice.Decide("/readonly/file", true); !d.Allowed || d.Group != "team" {
+		t.Errorf("expected group rule to allow reading, got %s", d)
+	}
+	if d := alice.Decide("/other", true); d.Allowed || !d.Global {
+		t.Errorf("expected global rule to deny reading, got %s", d)
+	}
+
+	bob := cfg.Users["bob"]
+	if bob.Scope != "/home/bob" || !bob.Modify {
+		t.Errorf("unexpected user bob: %+v", bob)
+	}
+
+	fc, _ := ParseConfig([]byte(`{"users": [{"username": "a", "groups": ["missing"]}]}`))
+	if _, err := fc.Build(); err == nil {
+		t.Errorf("expected error for unknown group")
+	}
+}
@@ -0,0 +1,101 @@
+package webdav
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCORSMethods are the methods allowed by CORS when none are set.
+var DefaultCORSMethods = []string{
+	"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS",
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// DefaultCORSHeaders are the request headers allowed by CORS when none
+// are set.
+var DefaultCORSHeaders = []string{
+	"Authorization", "Content-Type", "Range",
+	"Depth", "Destination", "Overwrite", "Lock-Token", "If", "Timeout",
+}
+
+// DefaultCORSExposedHeaders are the response headers exposed by CORS when
+// none are set.
+var DefaultCORSExposedHeaders = []string{"ETag", "DAV", "Lock-Token", "Content-Length", "Content-Range"}
+
+// CORS lets browser applications on other origins use the server.
+// AllowedOrigins holds exact origins such as "https://app.example.com",
+// or "*" for any. The other lists fall back to the defaults above when
+// empty.
+type CORS struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	ExposedHeaders []string `json:"exposedHeaders,omitempty"`
+	// AllowCredentials lets browsers send cookies and authorization
+	// headers; the origin is then echoed back instead of "*".
+	AllowCredentials bool `json:"allowCredentials,omitempty"`
+	// MaxAge is how many seconds a preflight result may be cached.
+	MaxAge int `json:"maxAge,omitempty"`
+}
+
+func (c *CORS) allowOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle adds the CORS headers to the response of a cross-origin request.
+// It answers preflight requests, which carry no credentials, and reports
+// whether it did.
+func (c *CORS) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+	if !c.allowOrigin(origin) {
+		if preflight {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+
+	if c.AllowCredentials || !c.allowOrigin("*") {
+		h.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		h.Set("Access-Control-Expose-Headers", strings.Join(orDefault(c.ExposedHeaders, DefaultCORSExposedHeaders), ", "))
+		return false
+	}
+
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", strings.Join(orDefault(c.AllowedMethods, DefaultCORSMethods), ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(orDefault(c.AllowedHeaders, DefaultCORSHeaders), ", "))
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func orDefault(values, defaults []string) []string {
+	if len(values) == 0 {
+		return defaults
+	}
+	return values
+}
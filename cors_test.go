@@ -0,0 +1,88 @@
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigServeHTTPCORS(t *testing.T) {
+	cfg := testConfig(t, `{
+		"scope": "`+t.TempDir()+`",
+		"cors": {"allowedOrigins": ["https://app.example.com"], "allowCredentials": true, "maxAge": 600},
+		"users": [{"username": "bob", "password": "bob"}]
+	}`)
+
+	tests := []struct {
+		name    string
+		method  string
+		origin  string
+		request string
+		auth    bool
+		status  int
+		headers map[string]string
+	}{
+		{
+			name: "preflight", method: "OPTIONS", origin: "https://app.example.com", request: "PROPFIND",
+			status: http.StatusNoContent,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     strings.Join(DefaultCORSMethods, ", "),
+				"Access-Control-Allow-Headers":     strings.Join(DefaultCORSHeaders, ", "),
+				"Access-Control-Max-Age":           "600",
+			},
+		},
+		{
+			name: "preflight from other origin", method: "OPTIONS", origin: "https://evil.example.com", request: "PUT",
+			status:  http.StatusForbidden,
+			headers: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name: "actual request", method: "PROPFIND", origin: "https://app.example.com", auth: true,
+			status: http.StatusMultiStatus,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":   "https://app.example.com",
+				"Access-Control-Expose-Headers": "ETag, DAV, Lock-Token, Content-Length, Content-Range",
+				"Access-Control-Allow-Methods":  "",
+			},
+		},
+		{
+			name: "unauthenticated request", method: "PROPFIND", origin: "https://app.example.com",
+			status:  http.StatusUnauthorized,
+			headers: map[string]string{"Access-Control-Allow-Origin": "https://app.example.com"},
+		},
+		{
+			name: "same origin", method: "PROPFIND", auth: true,
+			status:  http.StatusMultiStatus,
+			headers: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.request != "" {
+				r.Header.Set("Access-Control-Request-Method", tt.request)
+			}
+			if tt.auth {
+				r.SetBasicAuth("bob", "bob")
+			}
+			w := httptest.NewRecorder()
+			cfg.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+			for k, v := range tt.headers {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("expected %s %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,511 @@
+package webdav
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// DedupStore keeps the content of files once, however many times they
+// are stored. Under Root, blobs/ holds the contents named by their
+// SHA-256, tree/ the directories of the file systems, where each file is
+// a pointer to its blob, and tmp/ the files being written. Blobs are
+// counted by reference and removed when the last file using them goes;
+// Collect removes those left behind by crashes.
+type DedupStore struct {
+	Root string
+
+	mu sync.Mutex
+	// refs counts the pointers to each blob, counted from the tree the
+	// first time it is needed.
+	refs map[string]int
+}
+
+// DedupStats reports what Collect did.
+type DedupStats struct {
+	Blobs   int
+	Removed int
+	Freed   int64
+}
+
+// NewDedupStore returns the store under root, creating it if needed.
+func NewDedupStore(root string) (*DedupStore, error) {
+	for _, dir := range []string{"blobs", "tree", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &DedupStore{Root: root}, nil
+}
+
+// FS returns the file system of scope, a directory of the tree named
+// after it.
+func (s *DedupStore) FS(scope string) (*DedupFS, error) {
+	tree := filepath.Join(s.Root, "tree", filepath.FromSlash(path.Clean("/"+filepath.ToSlash(scope))))
+	if err := os.MkdirAll(tree, 0755); err != nil {
+		return nil, err
+	}
+	return &DedupFS{store: s, tree: tree}, nil
+}
+
+func (s *DedupStore) blobPath(sum string) string {
+	return filepath.Join(s.Root, "blobs", sum[:2], sum)
+}
+
+// dedupPointer is the content of a file of the tree.
+type dedupPointer struct {
+	Blob string `json:"blob"`
+	Size int64  `json:"size"`
+}
+
+func readPointer(file string) (dedupPointer, error) {
+	var p dedupPointer
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil || len(p.Blob) != sha256.Size*2 {
+		return p, &os.PathError{Op: "read", Path: file, Err: errors.New("invalid pointer")}
+	}
+	return p, nil
+}
+
+// pointers calls fn with the pointer of every file below dir.
+func pointers(dir string, fn func(p dedupPointer)) error {
+	return filepath.WalkDir(dir, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if e.Type().IsRegular() {
+			if p, err := readPointer(file); err == nil {
+				fn(p)
+			}
+		}
+		return nil
+	})
+}
+
+// loadRefs counts the references the first time. It must be called
+// with mu held.
+func (s *DedupStore) loadRefs() error {
+	if s.refs != nil {
+		return nil
+	}
+	refs := map[string]int{}
+	if err := pointers(filepath.Join(s.Root, "tree"), func(p dedupPointer) { refs[p.Blob]++ }); err != nil {
+		return err
+	}
+	s.refs = refs
+	return nil
+}
+
+// commit points the file at ptr to the blob sum, stored from tmp unless
+// it is empty or the blob exists, and releases the blob it pointed to.
+func (s *DedupStore) commit(ptr, tmp, sum string, size int64, perm os.FileMode, modTime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadRefs(); err != nil {
+		return err
+	}
+
+	blob := s.blobPath(sum)
+	if _, err := os.Stat(blob); err == nil {
+		// Known content: the blob is fresh again for Collect.
+		now := time.Now()
+		os.Chtimes(blob, now, now)
+	} else if tmp == "" {
+		return err
+	} else {
+		if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, blob); err != nil {
+			return err
+		}
+	}
+
+	old, oldErr := readPointer(ptr)
+	data, err := json.Marshal(dedupPointer{Blob: sum, Size: size})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ptr, data, perm); err != nil {
+		if s.refs[sum] == 0 {
+			os.Remove(blob)
+		}
+		return err
+	}
+	os.Chtimes(ptr, modTime, modTime)
+	s.refs[sum]++
+	if oldErr == nil {
+		s.release(old.Blob)
+	}
+	return nil
+}
+
+// release drops a reference to a blob, removing it with the last one. It
+// must be called with mu held.
+func (s *DedupStore) release(sum string) {
+	s.refs[sum]--
+	if s.refs[sum] <= 0 {
+		delete(s.refs, sum)
+		os.Remove(s.blobPath(sum))
+	}
+}
+
+// Collect counts the references from the tree again and removes the
+// blobs nothing points to, along with abandoned temporary files. Those
+// modified within grace are kept, as a server sharing the store may be
+// about to use them.
+func (s *DedupStore) Collect(grace time.Duration) (DedupStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats DedupStats
+	s.refs = nil
+	if err := s.loadRefs(); err != nil {
+		return stats, err
+	}
+	cutoff := time.Now().Add(-grace)
+	err := filepath.WalkDir(filepath.Join(s.Root, "blobs"), func(file string, e fs.DirEntry, err error) error {
+		if err != nil || !e.Type().IsRegular() {
+			return err
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if s.refs[e.Name()] > 0 || info.ModTime().After(cutoff) {
+			stats.Blobs++
+			return nil
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		stats.Removed++
+		stats.Freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.Root, "tmp"))
+	if err != nil {
+		return stats, err
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(s.Root, "tmp", e.Name()))
+		}
+	}
+	return stats, nil
+}
+
+// DedupFS is the file system of a scope in a DedupStore. Copying a file
+// points the copy to the same blob.
+type DedupFS struct {
+	store *DedupStore
+	tree  string
+}
+
+func (d *DedupFS) resolve(name string) string {
+	return filepath.Join(d.tree, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (d *DedupFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.Mkdir(d.resolve(name), perm)
+}
+
+func (d *DedupFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p := d.resolve(name)
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	return pointerInfo(p, info)
+}
+
+// fileInfo describes the file whose pointer is at p.
+func pointerInfo(p string, info os.FileInfo) (os.FileInfo, error) {
+	ptr, err := readPointer(p)
+	if err != nil {
+		return nil, err
+	}
+	return dedupInfo{info, ptr.Size, ptr.Blob}, nil
+}
+
+func (d *DedupFS) RemoveAll(ctx context.Context, name string) error {
+	if path.Clean("/"+name) == "/" {
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	p := d.resolve(name)
+
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+	if err := d.store.loadRefs(); err != nil {
+		return err
+	}
+	var blobs []string
+	if err := pointers(p, func(ptr dedupPointer) { blobs = append(blobs, ptr.Blob) }); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(p); err != nil {
+		return err
+	}
+	for _, sum := range blobs {
+		d.store.release(sum)
+	}
+	return nil
+}
+
+func (d *DedupFS) Rename(ctx context.Context, oldName, newName string) error {
+	if path.Clean("/"+oldName) == "/" || path.Clean("/"+newName) == "/" {
+		// Prohibit renaming from or to the virtual root directory.
+		return os.ErrInvalid
+	}
+	return os.Rename(d.resolve(oldName), d.resolve(newName))
+}
+
+func (d *DedupFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p := d.resolve(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if info.IsDir() {
+			return dedupDir{f}, nil
+		}
+		f.Close()
+		if info, err = pointerInfo(p, info); err != nil {
+			return nil, err
+		}
+		blob, err := os.Open(d.store.blobPath(info.(dedupInfo).blob))
+		if err != nil {
+			return nil, err
+		}
+		return &dedupFile{File: blob, info: info}, nil
+	}
+
+	info, err := os.Stat(p)
+	exists := err == nil
+	switch {
+	case err == nil && info.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case os.IsNotExist(err) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	if parent, err := os.Stat(filepath.Dir(p)); err != nil {
+		return nil, err
+	} else if !parent.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(d.store.Root, "tmp"), "upload-")
+	if err != nil {
+		return nil, err
+	}
+	w := &dedupWriter{tmp: tmp, store: d.store, ptr: p, name: path.Base(name), perm: perm, hash: sha256.New()}
+	if exists && flag&os.O_TRUNC == 0 {
+		// Start from the current content.
+		if err := w.copyCurrent(); err != nil {
+			w.discard()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// dedupInfo describes a file with the size of its blob, whose hash is
+// the ETag of the file.
+type dedupInfo struct {
+	os.FileInfo
+	size int64
+	blob string
+}
+
+func (fi dedupInfo) Size() int64 { return fi.size }
+
+func (fi dedupInfo) ETag(ctx context.Context) (string, error) {
+	return `"` + fi.blob + `"`, nil
+}
+
+// dedupFile reads a blob.
+type dedupFile struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (f *dedupFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+// WriteTo hands the file to the writers of the store, which io.Copy
+// would otherwise not see through the WriteTo of *os.File.
+func (f *dedupFile) WriteTo(w io.Writer) (int64, error) {
+	if dw, ok := w.(*dedupWriter); ok {
+		return dw.ReadFrom(f)
+	}
+	return io.Copy(w, struct{ io.Reader }{f.File})
+}
+
+// dedupDir lists the files of a directory of the tree.
+type dedupDir struct {
+	*os.File
+}
+
+func (d dedupDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	entries := infos[:0]
+	for _, info := range infos {
+		if !info.IsDir() {
+			var ferr error
+			if info, ferr = pointerInfo(filepath.Join(d.Name(), info.Name()), info); ferr != nil {
+				continue
+			}
+		}
+		entries = append(entries, info)
+	}
+	return entries, err
+}
+
+// dedupWriter writes a file to a temporary file, hashing it, and stores
+// it when closed. Copies of a file of the store are linked to its blob
+// without being written.
+type dedupWriter struct {
+	tmp   *os.File
+	store *DedupStore
+	ptr   string
+	name  string
+	perm  os.FileMode
+	hash  hash.Hash
+	n     int64
+	// linked is the blob of the file copied, until more is written.
+	linked string
+}
+
+func (w *dedupWriter) copyCurrent() error {
+	ptr, err := readPointer(w.ptr)
+	if err != nil {
+		return err
+	}
+	blob, err := os.Open(w.store.blobPath(ptr.Blob))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	_, err = io.Copy(struct{ io.Writer }{w}, blob)
+	return err
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	if w.linked != "" {
+		// Write out the content linked so far.
+		f, err := os.Open(w.store.blobPath(w.linked))
+		if err != nil {
+			return 0, err
+		}
+		w.linked, w.n = "", 0
+		_, err = io.Copy(struct{ io.Writer }{w}, f)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.tmp.Write(p)
+	w.hash.Write(p[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+// ReadFrom links the copy of a whole file of the store, as COPY and
+// MOVE across file systems do.
+func (w *dedupWriter) ReadFrom(r io.Reader) (int64, error) {
+	if f, ok := r.(*dedupFile); ok && w.n == 0 && w.linked == "" {
+		if pos, err := f.Seek(0, io.SeekCurrent); err == nil && pos == 0 {
+			info := f.info.(dedupInfo)
+			w.linked, w.n = info.blob, info.size
+			f.Seek(0, io.SeekEnd)
+			return info.size, nil
+		}
+	}
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+func (w *dedupWriter) sum() string {
+	if w.linked != "" {
+		return w.linked
+	}
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+func (w *dedupWriter) Close() error {
+	info, err := w.tmp.Stat()
+	if err != nil {
+		w.discard()
+		return err
+	}
+	if err := w.tmp.Close(); err != nil {
+		os.Remove(w.tmp.Name())
+		return err
+	}
+	tmp := w.tmp.Name()
+	if w.linked != "" {
+		os.Remove(tmp)
+		tmp = ""
+	}
+	err = w.store.commit(w.ptr, tmp, w.sum(), w.n, w.perm, info.ModTime())
+	if tmp != "" {
+		// Left behind when the blob already existed.
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (w *dedupWriter) discard() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+func (w *dedupWriter) Stat() (os.FileInfo, error) {
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return dedupInfo{renamedInfo{info, w.name}, w.n, w.sum()}, nil
+}
+
+func (w *dedupWriter) Read(p []byte) (int, error) { return 0, os.ErrInvalid }
+
+func (w *dedupWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekCurrent || whence == io.SeekEnd) {
+		return w.n, nil
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (w *dedupWriter) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
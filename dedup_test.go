@@ -0,0 +1,155 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blobs returns the number of blobs in the store at root.
+func blobs(t *testing.T, root string) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(root, "blobs", "*", "*"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return len(files)
+}
+
+func TestDedupFS(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := NewDedupStore(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fs, err := store.FS("team")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	write := func(name, content string) {
+		t.Helper()
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		io.WriteString(f, content)
+		if err := f.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	read := func(name string) string {
+		t.Helper()
+		f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		return string(data)
+	}
+
+	write("/a.bin", "same content")
+	fs.Mkdir(ctx, "/dir", 0755)
+	write("/dir/b.bin", "same content")
+	write("/c.bin", "other content")
+	if n := blobs(t, root); n != 2 {
+		t.Errorf("expected 2 blobs, got %d", n)
+	}
+	if got := read("/dir/b.bin"); got != "same content" {
+		t.Errorf("expected the content back, got %q", got)
+	}
+	if info, err := fs.Stat(ctx, "/a.bin"); err != nil || info.Size() != int64(len("same content")) {
+		t.Errorf("expected the size of the content, got %v %v", info, err)
+	}
+
+	// Overwriting releases the blob of the previous content.
+	write("/c.bin", "same content")
+	if n := blobs(t, root); n != 1 {
+		t.Errorf("expected the replaced blob to be removed, got %d blobs", n)
+	}
+
+	if err := fs.RemoveAll(ctx, "/a.bin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := fs.Rename(ctx, "/c.bin", "/dir/c.bin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := blobs(t, root); n != 1 {
+		t.Errorf("expected the blob to stay referenced, got %d blobs", n)
+	}
+	if err := fs.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := blobs(t, root); n != 0 {
+		t.Errorf("expected the blob to go with its last file, got %d blobs", n)
+	}
+
+	// Collect removes what nothing points to, as a crash leaves behind.
+	write("/d.bin", "kept")
+	orphan := filepath.Join(root, "blobs", "ff", strings.Repeat("f", 64))
+	os.MkdirAll(filepath.Dir(orphan), 0700)
+	os.WriteFile(orphan, []byte("orphan"), 0600)
+	if stats, err := store.Collect(time.Hour); err != nil || stats.Removed != 0 {
+		t.Errorf("expected recent blobs to be kept, got %+v %v", stats, err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(orphan, old, old)
+	stats, err := store.Collect(time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Removed != 1 || stats.Freed != int64(len("orphan")) || stats.Blobs != 1 {
+		t.Errorf("expected the orphan to be removed, got %+v", stats)
+	}
+	if got := read("/d.bin"); got != "kept" {
+		t.Errorf("expected the referenced content to be kept, got %q", got)
+	}
+}
+
+func TestConfigServeHTTPDedup(t *testing.T) {
+	root := t.TempDir()
+	cfg := testConfig(t, `{"modify": true, "dedup": {"root": "`+root+`"},
+		"users": [{"username": "bob", "password": "bob", "scope": "bob"}]}`)
+
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("bob", "bob")
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	content := strings.Repeat("asset ", 1000)
+	if w := do("PUT", "/asset.psd", content); w.Code != http.StatusCreated {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	if w := do("COPY", "/asset.psd", "", "Destination", "/copy.psd"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the copy to succeed, got %d", w.Code)
+	}
+	if w := do("PUT", "/again.psd", content); w.Code != http.StatusCreated {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	if n := blobs(t, root); n != 1 {
+		t.Errorf("expected a single blob, got %d", n)
+	}
+	if w := do("GET", "/copy.psd", ""); w.Body.String() != content {
+		t.Errorf("expected the copied content, got %d bytes", w.Body.Len())
+	}
+	if w := do("GET", "/copy.psd", "", "Range", "bytes=0-4"); w.Body.String() != "asset" {
+		t.Errorf("expected the range, got %q", w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tree", "bob", "asset.psd")); err != nil {
+		t.Errorf("expected the file in the tree of the scope: %v", err)
+	}
+}
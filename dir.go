@@ -27,15 +27,50 @@ func (w NoSniffFileInfo) ContentType(ctx context.Context) (contentType string, e
 type WebDavDir struct {
 	webdav.Dir
 	NoSniff bool
+	// Archives, when not nil, exposes zip and tar archives as read-only
+	// directories: "file.zip/" lists the members of file.zip.
+	Archives *ArchiveCache
+	// Scanning, when not nil, checks the files uploaded with PUT.
+	Scanning *Scanning
+	// Audit records the verdicts of the scans, logged when nil.
+	Audit Auditor
+	// Key, when not nil, encrypts the content of the files on disk, as
+	// EncryptedFS does.
+	Key []byte
+}
+
+// files returns the file system holding the files of d, which decrypts
+// them when d has a key.
+func (d WebDavDir) files() webdav.FileSystem {
+	if d.Key == nil {
+		return d.Dir
+	}
+	return EncryptedFS{FileSystem: d.Dir, Key: d.Key}
 }
 
 func (d WebDavDir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if uploadStaging(name) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	if d.Archives != nil {
+		if archive, member, ok := d.archivePath(ctx, name); ok {
+			_, m, err := d.statMember(ctx, archive, member)
+			if err != nil {
+				return nil, err
+			}
+			if d.NoSniff {
+				return NoSniffFileInfo{archiveFileInfo{m}}, nil
+			}
+			return archiveFileInfo{m}, nil
+		}
+	}
+
 	// Skip wrapping if NoSniff is off
 	if !d.NoSniff {
-		return d.Dir.Stat(ctx, name)
+		return d.files().Stat(ctx, name)
 	}
 
-	info, err := d.Dir.Stat(ctx, name)
+	info, err := d.files().Stat(ctx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -44,17 +79,74 @@ func (d WebDavDir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 }
 
 func (d WebDavDir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
-	// Skip wrapping if NoSniff is off
-	if !d.NoSniff {
-		return d.Dir.OpenFile(ctx, name, flag, perm)
+	if uploadStaging(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	open := d.files().OpenFile
+	st := contextState(ctx)
+	if st.upload && (st.uploads != nil || d.Scanning != nil) && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		// The content is checked against the upload policies as it is
+		// written, and scanned once complete.
+		open = func(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+			return d.openUpload(ctx, name, flag, perm, st)
+		}
+	}
+	if d.Archives != nil {
+		if archive, member, ok := d.archivePath(ctx, name); ok {
+			open = func(ctx context.Context, _ string, flag int, _ os.FileMode) (webdav.File, error) {
+				return d.openMember(ctx, archive, member, flag)
+			}
+		}
 	}
 
-	file, err := d.Dir.OpenFile(ctx, name, flag, perm)
+	file, err := open(ctx, name, flag, perm)
 	if err != nil {
 		return nil, err
 	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		file = stagingDir{File: file}
+	}
 
-	return WebDavFile{File: file}, nil
+	if d.NoSniff {
+		file = WebDavFile{File: file}
+	}
+	if d.Scanning != nil && d.Scanning.Verdicts != nil && flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if v, ok := d.Scanning.Verdicts.Get(localPath(d.Dir, name)); ok {
+			file = scannedFile{File: file, verdict: v}
+		}
+	}
+	return file, nil
+}
+
+func (d WebDavDir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if uploadStaging(name) || d.inArchive(ctx, name) {
+		return os.ErrPermission
+	}
+	return d.files().Mkdir(ctx, name, perm)
+}
+
+func (d WebDavDir) RemoveAll(ctx context.Context, name string) error {
+	if uploadStaging(name) || d.inArchive(ctx, name) {
+		return os.ErrPermission
+	}
+	return d.files().RemoveAll(ctx, name)
+}
+
+func (d WebDavDir) Rename(ctx context.Context, oldName, newName string) error {
+	if uploadStaging(oldName) || uploadStaging(newName) || d.inArchive(ctx, oldName) || d.inArchive(ctx, newName) {
+		return os.ErrPermission
+	}
+	return d.files().Rename(ctx, oldName, newName)
+}
+
+// inArchive reports whether name is inside an archive browsed as a
+// directory, where nothing can be changed.
+func (d WebDavDir) inArchive(ctx context.Context, name string) bool {
+	if d.Archives == nil {
+		return false
+	}
+	_, _, ok := d.archivePath(ctx, name)
+	return ok
 }
 
 type WebDavFile struct {
@@ -27,6 +27,7 @@ type FileItem struct {
 	Privileges    []string
 }
 
+// IDriver 为远程存储驱动, url为相对于根地址的路径, 各段已做URL转义
 type IDriver interface {
 	// 认证
 	Auth(name, password string)
@@ -45,6 +46,17 @@ type IDriver interface {
 	Update(local, url string) error
 }
 
+// IDirDriver 由支持创建目录和移动文件的驱动实现
+type IDirDriver interface {
+	Mkdir(url string) error
+	Move(from, to string) error
+}
+
+// IStreamDriver 由支持流式下载的驱动实现, 从offset处开始读取, 不必将整个文件读入内存
+type IStreamDriver interface {
+	GetStream(url string, offset int64) (io.ReadCloser, error)
+}
+
 type DriverConfigAll struct {
 	cfg     string
 	data    map[string]*DriverConfig
@@ -24,8 +24,8 @@ type JianguoDriver struct {
 
 // 定义结构体与XML节点对应
 type Response struct {
-	Href     string `xml:"href"`
-	Propstat Propstat
+	Href     string   `xml:"href"`
+	Propstat Propstat `xml:"propstat"`
 }
 
 type Propstat struct {
@@ -44,7 +44,7 @@ type Prop struct {
 }
 
 type ResourceType struct {
-	Collection interface{} `xml:"collection"`
+	Collection *struct{} `xml:"collection"`
 }
 
 type CurrentUserPrivilegeSet struct {
@@ -68,6 +68,14 @@ func NewJianguoDriver(iconf IDriverConfig) IDriver {
 	}
 }
 
+// SetEntry 设置远程根地址, 用于连接其他WebDAV服务
+func (d *JianguoDriver) SetEntry(entry string) {
+	if !strings.HasSuffix(entry, "/") {
+		entry += "/"
+	}
+	d.entry = entry
+}
+
 func (d *JianguoDriver) SetIgnore(p []string) {
 	for _, item := range p {
 		d.ignores[item] = struct{}{}
@@ -126,6 +134,42 @@ func (d *JianguoDriver) GetData(url string) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
+// GetStream 从offset处开始下载文件, 服务端不支持Range时跳过前offset个字节
+func (d *JianguoDriver) GetStream(url string, offset int64) (io.ReadCloser, error) {
+	if !d.IsAuth() {
+		return nil, ErrNotAuth
+	}
+	req, err := http.NewRequest("GET", d.entry+url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.SetBasicAuth(d.authName, d.authPassword)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading file: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// offset已超出文件末尾
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("error downloading file. Status code: %d", resp.StatusCode)
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil && err != io.EOF {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error downloading file: %w", err)
+	}
+	return resp.Body, nil
+}
+
 func (d *JianguoDriver) GetStat(url string) ([]byte, string, error) {
 	if !d.IsAuth() {
 		return nil, "", ErrNotAuth
@@ -189,6 +233,9 @@ func (d *JianguoDriver) List(url string) ([]FileItem, error) {
 		return nil, fmt.Errorf("error: %w", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("error: %w", os.ErrNotExist)
+	}
 	body, _ := io.ReadAll(resp.Body)
 	// 解析XML响应
 	ms := Multistatus{}
@@ -204,11 +251,14 @@ func (d *JianguoDriver) List(url string) ([]FileItem, error) {
 			Href:          resp.Href,
 			Owner:         resp.Propstat.Prop.Owner,
 			Status:        resp.Propstat.Status,
-			ResourceType:  resp.Propstat.Prop.ResourceType.Collection,
 			ContentType:   resp.Propstat.Prop.GetContentType,
 			ContentLength: resp.Propstat.Prop.GetContentLength,
 			LastModify:    resp.Propstat.Prop.GetLastModified,
 		}
+		// 目录的ResourceType为"collection"
+		if resp.Propstat.Prop.ResourceType.Collection != nil {
+			item.ResourceType = "collection"
+		}
 		privilege := []string{}
 		for _, priv := range resp.Propstat.Prop.CurrentUserPrivilegeSet.Privileges {
 			privilege = append(privilege, priv.Name)
@@ -227,7 +277,7 @@ func (d *JianguoDriver) Delete(remote string) error {
 		return ErrInvUrl
 	}
 
-	req, err := http.NewRequest("DELETE", d.DecodeUrl(d.entry+remote), nil)
+	req, err := http.NewRequest("DELETE", d.entry+remote, nil)
 	if err != nil {
 		return err
 	}
@@ -292,7 +342,7 @@ func (d *JianguoDriver) UpdateData(data io.Reader, url string) error {
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", d.DecodeUrl(d.entry+url), data)
+	req, err := http.NewRequest("PUT", d.entry+url, data)
 	if err != nil {
 		return err
 	}
@@ -337,10 +387,68 @@ func (d *JianguoDriver) createDirectories(local string) error {
 			return err
 		}
 		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		// 目录已存在时返回405
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent &&
+			resp.StatusCode != http.StatusMethodNotAllowed {
 			return fmt.Errorf("failed to upload file: %s", resp.Status)
 		}
 	}
 
 	return nil
 }
+
+// Mkdir 创建远程目录
+func (d *JianguoDriver) Mkdir(url string) error {
+	if !d.IsAuth() {
+		return ErrNotAuth
+	}
+	if url == "" {
+		return ErrInvUrl
+	}
+
+	req, err := http.NewRequest("MKCOL", d.entry+url, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(d.authName, d.authPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to create directory: %s", resp.Status)
+	}
+	return nil
+}
+
+// Move 在远程移动文件或目录, 覆盖已存在的目标
+func (d *JianguoDriver) Move(from, to string) error {
+	if !d.IsAuth() {
+		return ErrNotAuth
+	}
+	if from == "" || to == "" {
+		return ErrInvUrl
+	}
+
+	req, err := http.NewRequest("MOVE", d.entry+from, nil)
+	if err != nil {
+		return err
+	}
+	dst, err := url.Parse(d.entry + to)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", dst.String())
+	req.Header.Set("Overwrite", "T")
+	req.SetBasicAuth(d.authName, d.authPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to move file: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,444 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/webdav/driver"
+	"golang.org/x/net/webdav"
+)
+
+// DriverFS is a file system over a remote storage driver, so that a
+// remote account can be served to local clients with local users and
+// rules. Files opened for writing are buffered in temporary files and
+// uploaded when closed, if they were written to.
+type DriverFS struct {
+	Driver driver.IDriver
+	// Root is the remote directory served, the root of the account when
+	// empty.
+	Root string
+	// TempDir holds the files being written, os.TempDir() when empty.
+	TempDir string
+	// CacheTTL is how long directory listings are reused.
+	CacheTTL time.Duration
+
+	mu       sync.Mutex
+	listings map[string]driverListing
+}
+
+type driverListing struct {
+	entries []os.FileInfo
+	expires time.Time
+}
+
+// remote returns the URL of name relative to the entry of the driver,
+// each segment escaped. Directories end with a slash.
+func (d *DriverFS) remote(name string, dir bool) string {
+	p := strings.TrimPrefix(path.Join("/", d.Root, path.Clean("/"+name)), "/")
+	if p == "" {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	p = strings.Join(segments, "/")
+	if dir {
+		p += "/"
+	}
+	return p
+}
+
+// open returns the content of the remote file at u from offset,
+// streamed when the driver supports it.
+func (d *DriverFS) open(u string, offset int64) (io.ReadCloser, error) {
+	if sd, ok := d.Driver.(driver.IStreamDriver); ok {
+		return sd.GetStream(u, offset)
+	}
+	data, err := d.Driver.GetData(u)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data[min(offset, int64(len(data))):])), nil
+}
+
+// list returns the entries of the directory name.
+func (d *DriverFS) list(name string) ([]os.FileInfo, error) {
+	key := d.remote(name, true)
+
+	d.mu.Lock()
+	l, ok := d.listings[key]
+	d.mu.Unlock()
+	if ok && time.Now().Before(l.expires) {
+		return l.entries, nil
+	}
+
+	items, err := d.Driver.List(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The directory itself is listed too, with the shortest href.
+	self := -1
+	for i, item := range items {
+		if self < 0 || len(strings.TrimSuffix(item.Href, "/")) < len(strings.TrimSuffix(items[self].Href, "/")) {
+			self = i
+		}
+	}
+	entries := []os.FileInfo{}
+	for i, item := range items {
+		if i == self {
+			continue
+		}
+		entries = append(entries, newDriverFileInfo(item))
+	}
+
+	if d.CacheTTL > 0 {
+		d.mu.Lock()
+		if d.listings == nil {
+			d.listings = map[string]driverListing{}
+		}
+		d.listings[key] = driverListing{entries: entries, expires: time.Now().Add(d.CacheTTL)}
+		d.mu.Unlock()
+	}
+	return entries, nil
+}
+
+// invalidate forgets the cached listings after a change.
+func (d *DriverFS) invalidate() {
+	d.mu.Lock()
+	d.listings = nil
+	d.mu.Unlock()
+}
+
+func (d *DriverFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return driverFileInfo{name: "/", dir: true}, nil
+	}
+
+	entries, err := d.list(path.Dir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	} else if err != nil {
+		return nil, err
+	}
+	for _, info := range entries {
+		if info.Name() == path.Base(name) {
+			return info, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (d *DriverFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	info, err := d.Stat(ctx, name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			entries, err := d.list(name)
+			if err != nil {
+				return nil, err
+			}
+			return &driverDir{info: info, entries: entries}, nil
+		}
+		return &driverFile{fs: d, url: d.remote(name, false), info: info}, nil
+	}
+
+	switch {
+	case info != nil && info.IsDir() && flag&(os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0:
+		// Opened to patch its properties, which are not stored.
+		return &driverDir{info: info}, nil
+	case info != nil && info.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	case info != nil && flag&os.O_EXCL != 0 && flag&os.O_CREATE != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case info == nil && flag&os.O_CREATE == 0:
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(d.TempDir, "webdav-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	f := &driverUpload{tmp: tmp, fs: d, url: d.remote(name, false), name: path.Base(path.Clean("/" + name)), flag: flag}
+	if flag&os.O_TRUNC == 0 {
+		// The current content is only fetched, and the file uploaded
+		// again, when it is used.
+		f.info = info
+	}
+	f.dirty = f.info == nil
+	return f, nil
+}
+
+func (d *DriverFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	dd, ok := d.Driver.(driver.IDirDriver)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if _, err := d.Stat(ctx, name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	defer d.invalidate()
+	return dd.Mkdir(d.remote(name, true))
+}
+
+func (d *DriverFS) RemoveAll(ctx context.Context, name string) error {
+	if path.Clean("/"+name) == "/" {
+		return os.ErrPermission
+	}
+	info, err := d.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer d.invalidate()
+	return d.Driver.Delete(d.remote(name, info.IsDir()))
+}
+
+func (d *DriverFS) Rename(ctx context.Context, oldName, newName string) error {
+	if path.Clean("/"+oldName) == "/" || path.Clean("/"+newName) == "/" {
+		return os.ErrPermission
+	}
+	info, err := d.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	defer d.invalidate()
+
+	if dd, ok := d.Driver.(driver.IDirDriver); ok {
+		return dd.Move(d.remote(oldName, info.IsDir()), d.remote(newName, info.IsDir()))
+	}
+	if err := copyFS(ctx, d, oldName, d, newName); err != nil {
+		return err
+	}
+	return d.Driver.Delete(d.remote(oldName, info.IsDir()))
+}
+
+// driverFileInfo describes an entry of a remote listing.
+type driverFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func newDriverFileInfo(item driver.FileItem) driverFileInfo {
+	href := strings.TrimSuffix(item.Href, "/")
+	name, err := url.PathUnescape(path.Base(href))
+	if err != nil {
+		name = path.Base(href)
+	}
+	modTime, _ := http.ParseTime(item.LastModify)
+	return driverFileInfo{
+		name:    name,
+		size:    item.ContentLength,
+		modTime: modTime,
+		dir: item.ResourceType != nil || strings.HasSuffix(item.Href, "/") ||
+			item.ContentType == "httpd/unix-directory",
+	}
+}
+
+func (fi driverFileInfo) Name() string       { return fi.name }
+func (fi driverFileInfo) Size() int64        { return fi.size }
+func (fi driverFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi driverFileInfo) IsDir() bool        { return fi.dir }
+func (fi driverFileInfo) Sys() interface{}   { return nil }
+
+func (fi driverFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// driverDir is a remote directory opened for reading.
+type driverDir struct {
+	info    os.FileInfo
+	entries []os.FileInfo
+	off     int
+}
+
+func (d *driverDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.entries[d.off:]
+	if count <= 0 {
+		d.off = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(rest))
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *driverDir) Stat() (os.FileInfo, error) { return d.info, nil }
+
+func (d *driverDir) Read(p []byte) (int, error) { return 0, os.ErrInvalid }
+
+func (d *driverDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (d *driverDir) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (d *driverDir) Close() error { return nil }
+
+// driverFile is a remote file opened for reading. Its content is
+// streamed from the first read, so that PROPFIND does not fetch it, and
+// again from the new position after a seek.
+type driverFile struct {
+	fs   *DriverFS
+	url  string
+	info os.FileInfo
+	pos  int64
+	r    io.ReadCloser
+}
+
+func (f *driverFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		r, err := f.fs.open(f.url, f.pos)
+		if err != nil {
+			return 0, err
+		}
+		f.r = r
+	}
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *driverFile) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += f.info.Size()
+	}
+	if pos < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.info.Name(), Err: fs.ErrInvalid}
+	}
+	if pos != f.pos && f.r != nil {
+		f.r.Close()
+		f.r = nil
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *driverFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (f *driverFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+func (f *driverFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (f *driverFile) Close() error {
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
+
+// driverUpload is a remote file opened for writing, buffered in a
+// temporary file uploaded on Close when it was changed.
+type driverUpload struct {
+	tmp  *os.File
+	fs   *DriverFS
+	url  string
+	name string
+	flag int
+	// info is the remote file until its content is fetched.
+	info  os.FileInfo
+	dirty bool
+}
+
+// fetch copies the current content of the remote file to the temporary
+// file.
+func (f *driverUpload) fetch() error {
+	if f.info == nil {
+		return nil
+	}
+	r, err := f.fs.open(f.url, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(f.tmp, r); err != nil {
+		return err
+	}
+	if f.flag&os.O_APPEND == 0 {
+		if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	f.info = nil
+	return nil
+}
+
+func (f *driverUpload) Read(p []byte) (int, error) {
+	if err := f.fetch(); err != nil {
+		return 0, err
+	}
+	return f.tmp.Read(p)
+}
+
+func (f *driverUpload) Write(p []byte) (int, error) {
+	if err := f.fetch(); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	return f.tmp.Write(p)
+}
+
+func (f *driverUpload) Seek(offset int64, whence int) (int64, error) {
+	if err := f.fetch(); err != nil {
+		return 0, err
+	}
+	return f.tmp.Seek(offset, whence)
+}
+
+func (f *driverUpload) Stat() (os.FileInfo, error) {
+	if f.info != nil {
+		return f.info, nil
+	}
+	info, err := f.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return renamedInfo{info, f.name}, nil
+}
+
+func (f *driverUpload) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (f *driverUpload) Close() error {
+	defer f.discard()
+	if !f.dirty {
+		return nil
+	}
+	defer f.fs.invalidate()
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return f.fs.Driver.UpdateData(f.tmp, f.url)
+}
+
+// discard closes and removes the temporary file.
+func (f *driverUpload) discard() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
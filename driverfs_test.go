@@ -0,0 +1,274 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wwqdrh/webdav/driver"
+	"golang.org/x/net/webdav"
+)
+
+// testRemote serves a temporary directory as a remote WebDAV account and
+// returns the directory and the URL of the account.
+func testRemote(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	h := &webdav.Handler{FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "remote" || pass != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return dir, srv.URL
+}
+
+func TestDriverFS(t *testing.T) {
+	dir, url := testRemote(t)
+	if err := os.MkdirAll(filepath.Join(dir, "root", "docs"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "root", "docs", "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d := driver.NewJianguoDriver(nil).(*driver.JianguoDriver)
+	d.SetEntry(url)
+	d.Auth("remote", "secret")
+	fs := &DriverFS{Driver: d, Root: "root", TempDir: t.TempDir()}
+	ctx := context.Background()
+
+	info, err := fs.Stat(ctx, "/docs")
+	if err != nil || !info.IsDir() || info.Name() != "docs" {
+		t.Fatalf("expected the docs directory, got %v %v", info, err)
+	}
+	info, err = fs.Stat(ctx, "/docs/a.txt")
+	if err != nil || info.IsDir() || info.Size() != 5 {
+		t.Fatalf("expected a 5 byte file, got %v %v", info, err)
+	}
+	if _, err := fs.Stat(ctx, "/docs/missing.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file, got %v", err)
+	}
+	if _, err := fs.Stat(ctx, "/missing/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing directory, got %v", err)
+	}
+
+	f, err := fs.OpenFile(ctx, "/docs", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	infos, err := f.Readdir(-1)
+	if err != nil || len(infos) != 1 || infos[0].Name() != "a.txt" {
+		t.Errorf("expected a.txt to be listed, got %v %v", infos, err)
+	}
+	f.Close()
+
+	f, err = fs.OpenFile(ctx, "/docs/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "hello" {
+		t.Errorf("expected the remote content, got %q %v", data, err)
+	}
+	f.Close()
+
+	f, err = fs.OpenFile(ctx, "/docs/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Write([]byte(" world"))
+	if data, _ := os.ReadFile(filepath.Join(dir, "root", "docs", "a.txt")); string(data) != "hello" {
+		t.Errorf("expected no upload before Close, got %q", data)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "root", "docs", "a.txt")); string(data) != "hello world" {
+		t.Errorf("expected the appended content to be uploaded, got %q", data)
+	}
+
+	if err := fs.Mkdir(ctx, "/new", 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := fs.Rename(ctx, "/docs/a.txt", "/new/b.txt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "root", "new", "b.txt")); err != nil {
+		t.Errorf("expected the file to be moved: %v", err)
+	}
+	if err := fs.RemoveAll(ctx, "/new"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "root", "new")); !os.IsNotExist(err) {
+		t.Errorf("expected the directory to be removed, got %v", err)
+	}
+}
+
+func TestConfigServeHTTPRemote(t *testing.T) {
+	dir, url := testRemote(t)
+	if err := os.MkdirAll(filepath.Join(dir, "bob"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := testConfig(t, `{"modify": true, "scope": "{username}",
+		"remote": {"url": "`+url+`", "username": "remote", "password": "secret", "cacheTTL": "1m"},
+		"users": [{"username": "bob", "password": "bob", "rules": [{"path": "/private", "allow": false}]}]}`)
+	do := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("bob", "bob")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("PUT", "/a.txt", "remote content", nil); w.Code != http.StatusCreated {
+		t.Fatalf("expected upload, got %d", w.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "bob", "a.txt")); string(data) != "remote content" {
+		t.Errorf("expected the file on the remote, got %q", data)
+	}
+	if w := do("GET", "/a.txt", "", nil); w.Code != http.StatusOK || w.Body.String() != "remote content" {
+		t.Errorf("expected the file back, got %d %q", w.Code, w.Body)
+	}
+	if w := do("MKCOL", "/docs", "", nil); w.Code != http.StatusCreated {
+		t.Errorf("expected the directory to be created, got %d", w.Code)
+	}
+	if w := do("MOVE", "/a.txt", "", map[string]string{"Destination": "/docs/a.txt"}); w.Code != http.StatusCreated {
+		t.Errorf("expected the file to be moved, got %d", w.Code)
+	}
+	w := do("PROPFIND", "/docs/", "", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:href>/docs/a.txt</D:href>") {
+		t.Errorf("expected the moved file to be listed, got %d %s", w.Code, w.Body)
+	}
+	if w := do("PUT", "/private/b.txt", "b", nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected the local rules to apply, got %d", w.Code)
+	}
+	if w := do("DELETE", "/docs", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("expected the directory to be deleted, got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bob", "docs")); !os.IsNotExist(err) {
+		t.Errorf("expected the directory to be gone from the remote, got %v", err)
+	}
+}
+
+func TestDriverFSNames(t *testing.T) {
+	dir, url := testRemote(t)
+	d := driver.NewJianguoDriver(nil).(*driver.JianguoDriver)
+	d.SetEntry(url)
+	d.Auth("remote", "secret")
+	fs := &DriverFS{Driver: d, TempDir: t.TempDir()}
+	ctx := context.Background()
+
+	if err := fs.Mkdir(ctx, "/a+b %#?", 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"1+1.txt", "100%.txt", "c#d.txt", "e?f.txt", "g h.txt", "%2B.txt"} {
+		t.Run(name, func(t *testing.T) {
+			p := "/a+b %#?/" + name
+			f, err := fs.OpenFile(ctx, p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			f.Write([]byte(name))
+			if err := f.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, "a+b %#?", name)); err != nil || string(data) != name {
+				t.Errorf("expected the file under its name, got %q %v", data, err)
+			}
+
+			info, err := fs.Stat(ctx, p)
+			if err != nil || info.Name() != name {
+				t.Fatalf("expected the file to be found, got %v %v", info, err)
+			}
+			f, err = fs.OpenFile(ctx, p, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if data, err := io.ReadAll(f); err != nil || string(data) != name {
+				t.Errorf("expected the content back, got %q %v", data, err)
+			}
+			f.Close()
+
+			if err := fs.Rename(ctx, p, p+".moved"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "a+b %#?", name+".moved")); err != nil {
+				t.Errorf("expected the file to be moved: %v", err)
+			}
+			if err := fs.RemoveAll(ctx, p+".moved"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "a+b %#?", name+".moved")); !os.IsNotExist(err) {
+				t.Errorf("expected the file to be removed, got %v", err)
+			}
+		})
+	}
+	if err := fs.RemoveAll(ctx, "/a+b %#?"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a+b %#?")); !os.IsNotExist(err) {
+		t.Errorf("expected the directory to be removed, got %v", err)
+	}
+}
+
+func TestDriverFSOpen(t *testing.T) {
+	dir, url := testRemote(t)
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file := filepath.Join(dir, "docs", "a.txt")
+	if err := os.WriteFile(file, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(file, old, old)
+
+	d := driver.NewJianguoDriver(nil).(*driver.JianguoDriver)
+	d.SetEntry(url)
+	d.Auth("remote", "secret")
+	fs := &DriverFS{Driver: d, TempDir: t.TempDir()}
+	ctx := context.Background()
+
+	// Opening for PROPPATCH neither uploads the file nor fails on
+	// directories.
+	for _, name := range []string{"/docs", "/docs/a.txt"} {
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if info, err := os.Stat(file); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("expected the file not to be uploaded again, got %v %v", info, err)
+	}
+
+	f, err := fs.OpenFile(ctx, "/docs/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expected the head of the file, got %q %v", buf, err)
+	}
+	if _, err := f.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "world" {
+		t.Errorf("expected the tail of the file, got %q %v", data, err)
+	}
+}
@@ -0,0 +1,456 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/webdav"
+)
+
+// Layout of encrypted files: a header made of a magic string and a random
+// salt deriving the key of the file, then the content in chunks sealed
+// with AES-GCM. The nonce of a chunk is its index and a flag marking the
+// last one, so that chunks cannot be reordered, and the file cannot be
+// truncated, unnoticed.
+const (
+	encMagic      = "WDENC\x00\x01\x00"
+	encSaltSize   = 16
+	encHeaderSize = len(encMagic) + encSaltSize
+	encChunkSize  = 64 * 1024
+	encTagSize    = 16
+	encSealedSize = encChunkSize + encTagSize
+)
+
+// ErrCorrupted is returned when an encrypted file does not authenticate.
+var ErrCorrupted = errors.New("encrypted file corrupted")
+
+// LoadMasterKey reads a master key: at least 32 random bytes, raw or hex
+// encoded.
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := hex.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+		data = key
+	}
+	if len(data) < 32 {
+		return nil, fmt.Errorf("master key %s: want at least 32 bytes, got %d", path, len(data))
+	}
+	return data, nil
+}
+
+// DeriveKey returns the key of the scope id, derived from master.
+func DeriveKey(master []byte, id string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("webdav scope "+id)), key)
+	return key
+}
+
+// EncryptedFS stores the content of the files of FileSystem encrypted
+// with Key, 32 bytes. Names and directories are left as they are. Files
+// are read with random access, and Stat reports the size of their
+// content. They can only be written from the start, as PUT does.
+type EncryptedFS struct {
+	webdav.FileSystem
+	Key []byte
+}
+
+func (e EncryptedFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if keyIDReserved(name) {
+		return os.ErrPermission
+	}
+	return e.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (e EncryptedFS) RemoveAll(ctx context.Context, name string) error {
+	if keyIDReserved(name) {
+		return os.ErrPermission
+	}
+	return e.FileSystem.RemoveAll(ctx, name)
+}
+
+func (e EncryptedFS) Rename(ctx context.Context, oldName, newName string) error {
+	if keyIDReserved(oldName) || keyIDReserved(newName) {
+		return os.ErrPermission
+	}
+	return e.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func (e EncryptedFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if keyIDReserved(name) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	info, err := e.FileSystem.Stat(ctx, name)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	return plainInfo(info)
+}
+
+func (e EncryptedFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if keyIDReserved(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := e.FileSystem.OpenFile(ctx, name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if info.IsDir() {
+			return encryptedDir{File: f, root: path.Clean("/"+name) == "/"}, nil
+		}
+		return e.openReader(f, info)
+	}
+
+	if flag&os.O_APPEND != 0 {
+		return nil, errors.ErrUnsupported
+	}
+	if flag&os.O_TRUNC == 0 {
+		// Rewriting part of a file would need to reseal it all.
+		if info, err := e.FileSystem.Stat(ctx, name); err == nil && info.Size() > 0 {
+			return nil, errors.ErrUnsupported
+		}
+	}
+	f, err := e.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return e.openWriter(f)
+}
+
+// fileAEAD returns the cipher of the file with header.
+func (e EncryptedFS) fileAEAD(header []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	salt := header[len(encMagic):]
+	if _, err := io.ReadFull(hkdf.New(sha256.New, e.Key, salt, []byte("webdav file")), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk at index.
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// plainSize returns the size of the content of an encrypted file of
+// size bytes. Empty files, which were never written, are empty.
+func plainSize(size int64) (int64, error) {
+	if size == 0 {
+		return 0, nil
+	}
+	body := size - int64(encHeaderSize)
+	if body < encTagSize {
+		return 0, ErrCorrupted
+	}
+	chunks := (body + encSealedSize - 1) / encSealedSize
+	if body-(chunks-1)*encSealedSize < encTagSize {
+		return 0, ErrCorrupted
+	}
+	return body - chunks*encTagSize, nil
+}
+
+// plainInfo returns info with the size of the content of the file.
+func plainInfo(info os.FileInfo) (os.FileInfo, error) {
+	size, err := plainSize(info.Size())
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: info.Name(), Err: err}
+	}
+	return sizedInfo{info, size}, nil
+}
+
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizedInfo) Size() int64 { return fi.size }
+
+func (e EncryptedFS) openReader(f webdav.File, info os.FileInfo) (webdav.File, error) {
+	r := &encryptedReader{File: f, chunk: -1}
+	var err error
+	if r.info, err = plainInfo(info); err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.size = r.info.Size()
+	if info.Size() == 0 {
+		return r, nil
+	}
+
+	r.header = make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(f, r.header); err != nil || string(r.header[:len(encMagic)]) != encMagic {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: info.Name(), Err: ErrCorrupted}
+	}
+	if r.aead, err = e.fileAEAD(r.header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// encryptedReader decrypts an encrypted file one chunk at a time.
+type encryptedReader struct {
+	webdav.File
+	info   os.FileInfo
+	size   int64
+	header []byte
+	aead   cipher.AEAD
+
+	pos   int64
+	chunk int64
+	plain []byte
+}
+
+// load decrypts the chunk at index.
+func (r *encryptedReader) load(index int64) error {
+	offset := int64(encHeaderSize) + index*encSealedSize
+	if _, err := r.File.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, encSealedSize)
+	n, err := io.ReadFull(r.File, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := index == (r.size+encChunkSize-1)/encChunkSize-1 || r.size == 0
+	if r.plain, err = r.aead.Open(sealed[:0], chunkNonce(index, last), sealed[:n], r.header); err != nil {
+		return &os.PathError{Op: "read", Path: r.info.Name(), Err: ErrCorrupted}
+	}
+	r.chunk = index
+	return nil
+}
+
+func (r *encryptedReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / encChunkSize
+	if index != r.chunk {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-index*encChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *encryptedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// ReadAt lets archives in encrypted scopes be browsed.
+func (r *encryptedReader) ReadAt(p []byte, off int64) (int, error) {
+	pos := r.pos
+	defer func() { r.pos = pos }()
+	r.pos = off
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *encryptedReader) Stat() (os.FileInfo, error) { return r.info, nil }
+
+func (r *encryptedReader) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (e EncryptedFS) openWriter(f webdav.File) (webdav.File, error) {
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	if _, err := rand.Read(header[len(encMagic):]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	aead, err := e.fileAEAD(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encryptedWriter{File: f, header: header, aead: aead, buf: make([]byte, 0, encSealedSize)}, nil
+}
+
+// encryptedWriter encrypts a file written from the start. A full chunk
+// is sealed once more content follows, so that the last one is known.
+type encryptedWriter struct {
+	webdav.File
+	header []byte
+	aead   cipher.AEAD
+
+	buf   []byte
+	chunk int64
+	n     int64
+	err   error
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == encChunkSize {
+			if w.err = w.seal(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := min(encChunkSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		w.n += int64(n)
+	}
+	return written, nil
+}
+
+// seal encrypts and writes the buffered chunk.
+func (w *encryptedWriter) seal(last bool) error {
+	sealed := w.aead.Seal(w.buf[:0], chunkNonce(w.chunk, last), w.buf, w.header)
+	if _, err := w.File.Write(sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.chunk++
+	return nil
+}
+
+func (w *encryptedWriter) Close() error {
+	err := w.err
+	if err == nil {
+		err = w.seal(true)
+	}
+	if cerr := w.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *encryptedWriter) Read(p []byte) (int, error) { return 0, os.ErrInvalid }
+
+func (w *encryptedWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekCurrent || whence == io.SeekEnd) {
+		return w.n, nil
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (w *encryptedWriter) Stat() (os.FileInfo, error) {
+	info, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return sizedInfo{info, w.n}, nil
+}
+
+// encryptedDir lists the sizes of the content of the files it holds.
+// The root hides the file of the key identifier.
+type encryptedDir struct {
+	webdav.File
+	root bool
+}
+
+func (d encryptedDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	entries := infos[:0]
+	for _, info := range infos {
+		switch {
+		case d.root && info.Name() == EncryptionKeyIDFile:
+			continue
+		case info.IsDir():
+		default:
+			if size, serr := plainSize(info.Size()); serr == nil {
+				info = sizedInfo{info, size}
+			}
+		}
+		entries = append(entries, info)
+	}
+	return entries, err
+}
+
+// EncryptionKeyIDFile is the file keeping the identifier the key of a
+// scope is derived from, so that the scope can be moved. It is hidden
+// from clients.
+const EncryptionKeyIDFile = ".webdav-key-id"
+
+// keyIDReserved reports whether name is the file of the key identifier.
+func keyIDReserved(name string) bool {
+	return path.Clean("/"+name) == "/"+EncryptionKeyIDFile
+}
+
+// encryptionKeyID returns the identifier keys are derived from for a
+// scope, creating it the first time. A new scope gets a random one; a
+// scope already holding files keeps its path, which keys were derived
+// from before the identifier was kept.
+func encryptionKeyID(scope string) (string, error) {
+	file := filepath.Join(scope, EncryptionKeyIDFile)
+	if data, err := os.ReadFile(file); err == nil {
+		if id := string(bytes.TrimSpace(data)); id != "" {
+			return id, nil
+		}
+		return "", fmt.Errorf("encryption key id %s: empty", file)
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("encryption key id: %w", err)
+	}
+
+	entries, err := os.ReadDir(scope)
+	if err != nil {
+		return "", fmt.Errorf("encryption key id: %w", err)
+	}
+	id := filepath.Clean(scope)
+	if len(entries) == 0 {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		id = hex.EncodeToString(b)
+	}
+	if err := writeFileAtomic(file, []byte(id+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("encryption key id: %w", err)
+	}
+	return id, nil
+}
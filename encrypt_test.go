@@ -0,0 +1,214 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestEncryptedFS(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fs := EncryptedFS{FileSystem: webdav.Dir(dir), Key: DeriveKey(bytes.Repeat([]byte{1}, 32), "scope")}
+
+	write := func(name string, data []byte) {
+		t.Helper()
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	for _, size := range []int{0, 5, encChunkSize, encChunkSize + 1, 3*encChunkSize - 7} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+			write("/file", data)
+
+			raw, _ := os.ReadFile(filepath.Join(dir, "file"))
+			if size > 0 && bytes.Contains(raw, data[:min(size, 64)]) {
+				t.Errorf("expected the content to be encrypted on disk")
+			}
+			info, err := fs.Stat(ctx, "/file")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if info.Size() != int64(size) {
+				t.Errorf("expected size %d, got %d", size, info.Size())
+			}
+
+			f, err := fs.OpenFile(ctx, "/file", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer f.Close()
+			got, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("expected the content back")
+			}
+
+			if size < 10 {
+				return
+			}
+			// Reads from the middle, as Range requests do.
+			off := int64(size - 10)
+			if _, err := f.Seek(off, io.SeekStart); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, _ = io.ReadAll(f)
+			if !bytes.Equal(got, data[off:]) {
+				t.Errorf("expected the content from %d, got %v", off, got)
+			}
+		})
+	}
+
+	// Tampering is detected.
+	write("/file", []byte("hello world"))
+	raw, _ := os.ReadFile(filepath.Join(dir, "file"))
+	raw[encHeaderSize] ^= 1
+	os.WriteFile(filepath.Join(dir, "file"), raw, 0644)
+	f, err := fs.OpenFile(ctx, "/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := io.ReadAll(f); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected ErrCorrupted, got %v", err)
+	}
+	f.Close()
+
+	// As is another key.
+	write("/file", []byte("hello world"))
+	other := EncryptedFS{FileSystem: webdav.Dir(dir), Key: DeriveKey(bytes.Repeat([]byte{1}, 32), "other")}
+	if f, err := other.OpenFile(ctx, "/file", os.O_RDONLY, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := io.ReadAll(f); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected ErrCorrupted with another key, got %v", err)
+	}
+
+	if _, err := fs.OpenFile(ctx, "/file", os.O_RDWR, 0); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("expected partial writes to be unsupported, got %v", err)
+	}
+}
+
+func TestConfigServeHTTPEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+	cfg := testConfig(t, `{"scope": "`+dir+`/{username}", "modify": true, "encryptionKeyFile": "`+keyFile+`",
+		"provision": {}, "users": [{"username": "bob", "password": "bob"}, {"username": "eve", "password": "eve"}]}`)
+
+	do := func(user, method, target, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth(user, user)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("bob", "PUT", "/secret.txt", "top secret content"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	if raw, _ := os.ReadFile(filepath.Join(dir, "bob", "secret.txt")); bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("expected the file to be encrypted on disk, got %q", raw)
+	}
+	if w := do("bob", "GET", "/secret.txt", ""); w.Body.String() != "top secret content" {
+		t.Errorf("expected the content back, got %q", w.Body)
+	}
+	if w := do("bob", "GET", "/secret.txt", "", "Range", "bytes=4-9"); w.Code != http.StatusPartialContent || w.Body.String() != "secret" {
+		t.Errorf("expected the range, got %d %q", w.Code, w.Body)
+	}
+	if w := do("bob", "PROPFIND", "/secret.txt", "", "Depth", "0"); !strings.Contains(w.Body.String(), "<D:getcontentlength>18</D:getcontentlength>") {
+		t.Errorf("expected the size of the content, got %s", w.Body)
+	}
+
+	// Scopes have keys of their own.
+	raw, _ := os.ReadFile(filepath.Join(dir, "bob", "secret.txt"))
+	os.WriteFile(filepath.Join(dir, "eve", "secret.txt"), raw, 0644)
+	if w := do("eve", "GET", "/secret.txt", ""); w.Body.String() == "top secret content" {
+		t.Errorf("expected the file not to decrypt in another scope")
+	}
+}
+
+func TestConfigServeHTTPEncryptionRelocated(t *testing.T) {
+	root := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+	serve := func(scope string) func(method, target, body string) *httptest.ResponseRecorder {
+		cfg := testConfig(t, `{"scope": "`+scope+`", "modify": true, "encryptionKeyFile": "`+keyFile+`",
+			"users": [{"username": "bob", "password": "bob"}]}`)
+		return func(method, target, body string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, target, strings.NewReader(body))
+			r.SetBasicAuth("bob", "bob")
+			w := httptest.NewRecorder()
+			cfg.ServeHTTP(w, r)
+			return w
+		}
+	}
+
+	before := filepath.Join(root, "before")
+	os.Mkdir(before, 0755)
+	do := serve(before)
+	if w := do("PUT", "/secret.txt", "top secret content"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	if w := do("PROPFIND", "/", ""); strings.Contains(w.Body.String(), EncryptionKeyIDFile) {
+		t.Errorf("expected the key identifier to be hidden, got %s", w.Body)
+	}
+	if w := do("DELETE", "/"+EncryptionKeyIDFile, ""); w.Code != http.StatusNotFound && w.Code != http.StatusForbidden {
+		t.Errorf("expected the key identifier not to be removed, got %d", w.Code)
+	}
+
+	after := filepath.Join(root, "after")
+	if err := os.Rename(before, after); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	do = serve(after)
+	if w := do("GET", "/secret.txt", ""); w.Body.String() != "top secret content" {
+		t.Errorf("expected the content back after the move, got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestEncryptionKeyID(t *testing.T) {
+	empty := t.TempDir()
+	id, err := encryptionKeyID(empty)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again, err := encryptionKeyID(empty); err != nil || again != id {
+		t.Errorf("expected the identifier to be kept, got %q %v", again, err)
+	}
+	if id == filepath.Clean(empty) {
+		t.Errorf("expected a new scope to get a random identifier, got %q", id)
+	}
+
+	// Scopes encrypted before the identifier was kept keep their key.
+	legacy := t.TempDir()
+	os.WriteFile(filepath.Join(legacy, "a.txt"), nil, 0644)
+	if id, err := encryptionKeyID(legacy); err != nil || id != filepath.Clean(legacy) {
+		t.Errorf("expected the path of the scope, got %q %v", id, err)
+	}
+}
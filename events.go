@@ -0,0 +1,136 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// Types of file events.
+const (
+	EventCreate = "create"
+	EventModify = "modify"
+	EventDelete = "delete"
+	EventMove   = "move"
+	EventMkdir  = "mkdir"
+)
+
+var eventTypes = []string{EventCreate, EventModify, EventDelete, EventMove, EventMkdir}
+
+// Event reports a change made through the server. Paths are those seen
+// by the user, relative to its scope or mount table.
+type Event struct {
+	ID          string    `json:"id"`
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Path        string    `json:"path"`
+	Destination string    `json:"destination,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	// Scope is the local directory the paths are in, empty when the user
+	// has mounts, the scopes are not local directories or their files are
+	// encrypted.
+	Scope string `json:"-"`
+
+	// handler serves the file system the paths are in.
+	handler *webdav.Handler
+}
+
+// EventSink receives the events of the changes that succeeded. Send must
+// not block the request.
+type EventSink interface {
+	Send(ev Event)
+}
+
+// matchesType reports whether an event of type t passes the types
+// filter of a sink, which lets everything through when empty.
+func matchesType(types []string, t string) bool {
+	return len(types) == 0 || slices.Contains(types, t)
+}
+
+// serveEvents serves a request that may change the file system and
+// emits the matching event when it succeeds.
+func (c *Config) serveEvents(w http.ResponseWriter, r *http.Request, u *User, handler *webdav.Handler) {
+	name := strings.TrimPrefix(r.URL.Path, handler.Prefix)
+	ev := Event{Path: path.Clean("/" + name), Username: u.Username, handler: handler}
+	if len(u.Mounts) == 0 && c.Backend == nil && c.MasterKey == nil {
+		ev.Scope = u.Scope
+	}
+
+	exists := func(name string) bool {
+		_, err := handler.FileSystem.Stat(r.Context(), name)
+		return err == nil
+	}
+	switch r.Method {
+	case "PUT":
+		ev.Type = EventCreate
+		if exists(name) {
+			ev.Type = EventModify
+		}
+	case "DELETE":
+		ev.Type = EventDelete
+	case "MKCOL":
+		ev.Type = EventMkdir
+	case "MOVE", "COPY":
+		dst, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			break
+		}
+		dstName := strings.TrimPrefix(dst.Path, handler.Prefix)
+		if r.Method == "MOVE" {
+			ev.Type, ev.Destination = EventMove, path.Clean("/"+dstName)
+			break
+		}
+		// A copy creates or overwrites its destination.
+		ev.Type, ev.Path = EventCreate, path.Clean("/"+dstName)
+		if exists(dstName) {
+			ev.Type = EventModify
+		}
+	}
+	if ev.Type == "" {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	sw := &metricsWriter{ResponseWriter: w}
+	handler.ServeHTTP(sw, r)
+	if sw.status >= 200 && sw.status < 300 {
+		c.emit(ev)
+	}
+}
+
+// emit sends ev to every sink.
+func (c *Config) emit(ev Event) {
+	if ev.ID == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		ev.ID = hex.EncodeToString(id)
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, s := range c.Events {
+		s.Send(ev)
+	}
+	c.eventBroker().Send(ev)
+}
+
+// watched reports whether the events of the changes are wanted.
+func (c *Config) watched() bool {
+	return len(c.Events) > 0 || c.eventBroker().active()
+}
+
+// startEvents starts the sinks delivering in the background.
+func (c *Config) startEvents() {
+	for _, s := range c.Events {
+		if h, ok := s.(*Webhook); ok {
+			h.Start()
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordSink keeps the events it receives.
+type recordSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *recordSink) Send(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+}
+
+func TestConfigServeHTTPEvents(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, `{"scope": "`+dir+`", "users": [{"username": "bob", "password": "bob", "modify": true}]}`)
+	sink := &recordSink{}
+	cfg.Events = []EventSink{sink}
+
+	do := func(method, target, body string, header map[string]string) int {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("bob", "bob")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	do("MKCOL", "/docs", "", nil)
+	do("PUT", "/docs/a.txt", "a", nil)
+	do("PUT", "/docs/a.txt", "b", nil)
+	do("GET", "/docs/a.txt", "", nil)
+	do("COPY", "/docs/a.txt", "", map[string]string{"Destination": "/docs/b.txt"})
+	do("MOVE", "/docs/b.txt", "", map[string]string{"Destination": "/c.txt"})
+	do("DELETE", "/missing.txt", "", nil)
+	do("DELETE", "/docs", "", nil)
+	if code := do("PROPPATCH", "/c.txt", "", nil); code < 400 {
+		t.Errorf("expected the empty PROPPATCH to fail, got %d", code)
+	}
+
+	tests := []Event{
+		{Type: EventMkdir, Path: "/docs"},
+		{Type: EventCreate, Path: "/docs/a.txt"},
+		{Type: EventModify, Path: "/docs/a.txt"},
+		{Type: EventCreate, Path: "/docs/b.txt"},
+		{Type: EventMove, Path: "/docs/b.txt", Destination: "/c.txt"},
+		{Type: EventDelete, Path: "/docs"},
+	}
+	if len(sink.events) != len(tests) {
+		t.Fatalf("expected %d events, got %+v", len(tests), sink.events)
+	}
+	for i, want := range tests {
+		ev := sink.events[i]
+		if ev.Type != want.Type || ev.Path != want.Path || ev.Destination != want.Destination {
+			t.Errorf("event %d: expected %s %s %s, got %s %s %s", i, want.Type, want.Path, want.Destination, ev.Type, ev.Path, ev.Destination)
+		}
+		if ev.Username != "bob" || ev.Scope != dir || ev.ID == "" || ev.Time.IsZero() {
+			t.Errorf("event %d: unexpected details %+v", i, ev)
+		}
+	}
+	if code := do("PUT", "/x.txt", "x", nil); code != http.StatusCreated {
+		t.Errorf("expected upload, got %d", code)
+	}
+}
@@ -0,0 +1,310 @@
+package webdav
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+	"golang.org/x/net/websocket"
+)
+
+// EventsPath is the endpoint streaming the changes below a path, given
+// by the path parameter, to the authenticated user: as Server-Sent Events
+// or, on a WebSocket upgrade, as JSON messages. A "resync" event tells a
+// client that it missed events and should list the subtree again.
+const EventsPath = APIPrefix + "events"
+
+// EventResync is sent to a subscriber that missed events.
+const EventResync = "resync"
+
+// eventHeartbeat is the interval of the comments keeping idle streams
+// open through proxies.
+var eventHeartbeat = 30 * time.Second
+
+// eventBroker passes the events to the subscribed clients.
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+// subscription is a client following the changes below path in the file
+// system served by handler. access is the access of the client, checked
+// against the rules of user for each event.
+type subscription struct {
+	user    *User
+	access  Access
+	handler *webdav.Handler
+	path    string
+	events  chan Event
+	done    chan struct{}
+
+	mu     sync.Mutex
+	missed bool
+	closed bool
+}
+
+// eventBroker returns the broker of the configuration, creating it the
+// first time.
+func (c *Config) eventBroker() *eventBroker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.broker == nil {
+		c.broker = &eventBroker{subs: map[*subscription]struct{}{}}
+	}
+	return c.broker
+}
+
+// active reports whether anybody is subscribed.
+func (b *eventBroker) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+func (b *eventBroker) subscribe(u *User, access Access, handler *webdav.Handler, name string) *subscription {
+	s := &subscription{
+		user:    u,
+		access:  access,
+		handler: handler,
+		path:    path.Clean("/" + name),
+		events:  make(chan Event, 64),
+		done:    make(chan struct{}),
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+func (b *eventBroker) unsubscribe(s *subscription) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	b.mu.Unlock()
+	s.close()
+}
+
+// closeAll ends every subscription, so that the clients reconnect to the
+// configuration replacing this one.
+func (b *eventBroker) closeAll() {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = map[*subscription]struct{}{}
+	b.mu.Unlock()
+	for s := range subs {
+		s.close()
+	}
+}
+
+func (b *eventBroker) Send(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if s.wants(ev) {
+			s.send(ev)
+		}
+	}
+}
+
+// wants reports whether the subscriber may see ev.
+func (s *subscription) wants(ev Event) bool {
+	if ev.handler != s.handler {
+		return false
+	}
+	a := s.access
+	a.Time = time.Now()
+	for _, p := range []string{ev.Path, ev.Destination} {
+		a.Path = s.handler.Prefix + p
+		if p != "" && within(p, s.path) && s.user.DecideAccess(a).Allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues ev without blocking, recording the events that did not
+// fit.
+func (s *subscription) send(ev Event) {
+	select {
+	case s.events <- ev:
+	default:
+		s.mu.Lock()
+		s.missed = true
+		s.mu.Unlock()
+	}
+}
+
+// next waits for the next event to deliver. It returns false when the
+// subscription ended or the heartbeat interval elapsed.
+func (s *subscription) next(timeout <-chan time.Time) (Event, bool) {
+	s.mu.Lock()
+	missed := s.missed
+	s.missed = false
+	s.mu.Unlock()
+	if missed {
+		return Event{Type: EventResync, Path: s.path, Time: time.Now()}, true
+	}
+
+	select {
+	case ev := <-s.events:
+		return ev, true
+	case <-s.done:
+	case <-timeout:
+	}
+	return Event{}, false
+}
+
+func (s *subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// within reports whether name is dir or below it.
+func within(name, dir string) bool {
+	return dir == "/" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// serveEventStream streams the changes below the path parameter to u.
+func (c *Config) serveEventStream(w http.ResponseWriter, r *http.Request, u *User) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	handler, err := c.mount(u)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	name := path.Clean("/" + r.URL.Query().Get("path"))
+	access := RequestAccess(r)
+	access.Path, access.NoModification = handler.Prefix+name, true
+	if !c.DecideAccess(u, access).Allowed {
+		stateOf(r).denied = true
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if info, err := handler.FileSystem.Stat(r.Context(), name); err != nil || !info.IsDir() {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	b := c.eventBroker()
+	s := b.subscribe(u, access, handler, name)
+	defer b.unsubscribe(s)
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		ws := websocket.Server{
+			Handshake: func(_ *websocket.Config, r *http.Request) error { return c.checkOrigin(r) },
+			Handler: func(conn *websocket.Conn) {
+				go func() {
+					// The connection ends when the client goes away.
+					var msg []byte
+					for websocket.Message.Receive(conn, &msg) == nil {
+					}
+					s.close()
+				}()
+				c.streamEvents(s, func(ev Event) error {
+					if ev.Type == "" {
+						return nil
+					}
+					return websocket.JSON.Send(conn, ev)
+				})
+			},
+		}
+		ws.ServeHTTP(hijackWriter{w}, r)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	go func() {
+		<-r.Context().Done()
+		s.close()
+	}()
+	c.streamEvents(s, func(ev Event) error {
+		if ev.Type == "" {
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+			return err
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+}
+
+// streamEvents passes the events of s to write until s ends or write
+// fails. Write receives an empty event on every heartbeat.
+func (c *Config) streamEvents(s *subscription, write func(ev Event) error) {
+	t := time.NewTicker(eventHeartbeat)
+	defer t.Stop()
+
+	for {
+		ev, ok := s.next(t.C)
+		if !ok {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+		}
+		if err := write(ev); err != nil {
+			return
+		}
+	}
+}
+
+// checkOrigin accepts the WebSocket handshakes of clients without an
+// origin, of pages served from the same host and of the origins allowed
+// by CORS. Browsers send credentials along, so other pages could use
+// them otherwise.
+func (c *Config) checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return nil
+	}
+	if c.CORS != nil && c.CORS.allowOrigin(origin) {
+		return nil
+	}
+	return fmt.Errorf("origin %q not allowed", origin)
+}
+
+// hijackWriter lets the WebSocket server take over the connection below
+// the wrappers of the response writer.
+type hijackWriter struct {
+	http.ResponseWriter
+}
+
+func (w hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
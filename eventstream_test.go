@@ -0,0 +1,148 @@
+package webdav
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+	"golang.org/x/net/websocket"
+)
+
+func TestConfigServeHTTPEventStream(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "docs", "secret"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := testConfig(t, `{"scope": "`+dir+`", "modify": true, "users": [
+		{"username": "alice", "password": "alice"},
+		{"username": "bob", "password": "bob", "rules": [{"path": "/docs/secret", "allow": false}]}
+	]}`)
+	srv := httptest.NewServer(cfg)
+	defer srv.Close()
+
+	put := func(target string) {
+		t.Helper()
+		r, _ := http.NewRequest("PUT", srv.URL+target, strings.NewReader("x"))
+		r.SetBasicAuth("alice", "alice")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected upload of %s, got %d", target, resp.StatusCode)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", srv.URL+EventsPath+"?path=/docs", nil)
+	r.SetBasicAuth("bob", "bob")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	put("/outside.txt")
+	put("/docs/secret/hidden.txt")
+	put("/docs/a.txt")
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+		close(lines)
+	}()
+	var got []string
+	for len(got) < 3 {
+		select {
+		case line := <-lines:
+			if line != "" {
+				got = append(got, line)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected an event, got %q", got)
+		}
+	}
+	if !strings.HasPrefix(got[0], "id: ") || got[1] != "event: create" {
+		t.Errorf("unexpected event %q", got)
+	}
+	var ev Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(got[2], "data: ")), &ev); err != nil || ev.Path != "/docs/a.txt" || ev.Username != "alice" {
+		t.Errorf("expected the upload below the subtree only, got %q %v", got[2], err)
+	}
+
+	r, _ = http.NewRequest("GET", srv.URL+EventsPath+"?path=/docs/secret", nil)
+	r.SetBasicAuth("bob", "bob")
+	if resp, err := http.DefaultClient.Do(r); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a denied subtree to be refused, got %v %v", resp, err)
+	}
+}
+
+func TestSubscriptionWants(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	u := &User{Rules: []*Rule{
+		{Path: "/", Allow: false},
+		{Path: "/lan/", Allow: true, Networks: []*net.IPNet{lan}},
+	}}
+	handler := &webdav.Handler{}
+	b := &eventBroker{subs: map[*subscription]struct{}{}}
+	office := b.subscribe(u, Access{NoModification: true, IP: net.ParseIP("10.1.2.3")}, handler, "/")
+	remote := b.subscribe(u, Access{NoModification: true, IP: net.ParseIP("203.0.113.5")}, handler, "/")
+
+	ev := Event{Type: EventCreate, Path: "/lan/a.txt", handler: handler}
+	if !office.wants(ev) {
+		t.Errorf("expected the event to reach the subscriber in the network")
+	}
+	if remote.wants(ev) {
+		t.Errorf("expected the event to be hidden from the subscriber outside the network")
+	}
+}
+
+func TestConfigServeHTTPEventWebSocket(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, `{"scope": "`+dir+`", "modify": true, "users": [{"username": "bob", "password": "bob"}]}`)
+	srv := httptest.NewServer(cfg)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + EventsPath
+	wc, err := websocket.NewConfig(wsURL, srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wc.Header.Set("Authorization", "Basic Ym9iOmJvYg==")
+	conn, err := websocket.DialConfig(wc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	r, _ := http.NewRequest("MKCOL", srv.URL+"/new", nil)
+	r.SetBasicAuth("bob", "bob")
+	if resp, err := http.DefaultClient.Do(r); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the directory to be created, got %v %v", resp, err)
+	}
+
+	var ev Event
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := websocket.JSON.Receive(conn, &ev); err != nil || ev.Type != EventMkdir || ev.Path != "/new" {
+		t.Errorf("expected the mkdir event, got %+v %v", ev, err)
+	}
+
+	wc.Origin, _ = wc.Origin.Parse("https://evil.example")
+	if _, err := websocket.DialConfig(wc); err == nil {
+		t.Errorf("expected a foreign origin to be refused")
+	}
+}
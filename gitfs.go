@@ -0,0 +1,692 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/gokit/logger"
+	"golang.org/x/net/webdav"
+)
+
+// HistoryFolder is the read-only folder of a GitFS holding a folder per
+// commit, named after its time and hash, with the files as they were
+// then. Copying from it over the current files rolls them back.
+const HistoryFolder = "/.history"
+
+// GitVersioning makes local scopes Git repositories.
+type GitVersioning struct {
+	// Scopes are the path.Match patterns of the scopes versioned, every
+	// local scope when empty.
+	Scopes []string
+	// Window is how long changes are gathered into a commit.
+	Window time.Duration
+	// HistoryLimit is the number of commits listed in the history
+	// folder, 100 when 0.
+	HistoryLimit int
+}
+
+func (v *GitVersioning) applies(scope string) bool {
+	if len(v.Scopes) == 0 {
+		return true
+	}
+	for _, pattern := range v.Scopes {
+		if ok, _ := path.Match(pattern, scope); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// historySource returns the URL path of the file that name shows when
+// it is in a commit of the history folder of a versioned scope of u, and
+// name otherwise.
+func (c *Config) historySource(u *User, name string) string {
+	if c.Git == nil || c.Backend != nil || !strings.HasPrefix(name, c.Prefix) {
+		return name
+	}
+	var roots []string
+	if len(u.Mounts) == 0 {
+		if c.Git.applies(u.Scope) {
+			roots = append(roots, "")
+		}
+	} else {
+		for _, mp := range u.Mounts {
+			if c.Git.applies(mp.Scope) {
+				roots = append(roots, strings.TrimSuffix(path.Clean("/"+mp.Path), "/"))
+			}
+		}
+	}
+
+	p := path.Clean("/" + strings.TrimPrefix(name, c.Prefix))
+	for _, root := range roots {
+		rest, ok := strings.CutPrefix(p, root+HistoryFolder+"/")
+		if !ok {
+			continue
+		}
+		if _, inner, ok := strings.Cut(rest, "/"); ok {
+			return strings.TrimSuffix(c.Prefix, "/") + path.Join(root+"/", inner)
+		}
+		return name
+	}
+	return name
+}
+
+// DecideAccess decides a with the rules of u as the server does: a file
+// in the history folder also needs access to the file it shows, so that
+// the history does not open the paths the rules close.
+func (c *Config) DecideAccess(u *User, a Access) Decision {
+	d := u.DecideAccess(a)
+	if src := c.historySource(u, a.Path); d.Allowed && src != a.Path {
+		a.Path = src
+		d = u.DecideAccess(a)
+	}
+	return d
+}
+
+// GitFS commits the changes made to the files of FileSystem, whose files
+// are in the work tree Dir of a Git repository. The files written,
+// removed and renamed are committed in the name of the user making the
+// change, once Window has elapsed without further changes or at once
+// when it is zero. The repository itself is hidden.
+type GitFS struct {
+	webdav.FileSystem
+	Dir          string
+	Window       time.Duration
+	HistoryLimit int
+
+	mu      sync.Mutex
+	pending []gitChange
+	timer   *time.Timer
+	closed  bool
+}
+
+// gitChange is a change waiting to be committed.
+type gitChange struct {
+	author string
+	desc   string
+	paths  []string
+}
+
+// gitLocks serializes the Git commands run in a repository, which may
+// be shared by the file systems of successive configurations.
+var gitLocks sync.Map
+
+// NewGitFS returns a GitFS over fs, whose files are in dir, creating the
+// repository with the files already there if needed.
+func NewGitFS(fs webdav.FileSystem, dir string) (*GitFS, error) {
+	g := &GitFS{FileSystem: fs, Dir: dir}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return g, nil
+	}
+
+	unlock := g.lock()
+	defer unlock()
+	ctx := context.Background()
+	if _, err := g.git(ctx, nil, "init", "-q"); err != nil {
+		return nil, err
+	}
+	if _, err := g.git(ctx, nil, "add", "-A"); err != nil {
+		return nil, err
+	}
+	if _, err := g.git(ctx, nil, "commit", "-q", "--allow-empty", "-m", "Initial import"); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *GitFS) lock() func() {
+	key := g.Dir
+	if abs, err := filepath.Abs(g.Dir); err == nil {
+		key = abs
+	}
+	mu, _ := gitLocks.LoadOrStore(key, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// git runs a Git command in the repository. Commits are authored by
+// "webdav" unless env says otherwise.
+func (g *GitFS) git(ctx context.Context, env []string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", g.Dir, "-c", "core.quotepath=off"}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=webdav", "GIT_AUTHOR_EMAIL=",
+		"GIT_COMMITTER_NAME=webdav", "GIT_COMMITTER_EMAIL=")
+	cmd.Env = append(cmd.Env, env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// gitAuthor returns the user making the request of ctx.
+func gitAuthor(ctx context.Context) string {
+	if u := contextState(ctx).user; u != "" {
+		return u
+	}
+	return "anonymous"
+}
+
+// record queues a change for the next commit.
+func (g *GitFS) record(ctx context.Context, desc string, names ...string) {
+	c := gitChange{author: gitAuthor(ctx), desc: desc}
+	for _, name := range names {
+		c.paths = append(c.paths, strings.TrimPrefix(path.Clean("/"+name), "/"))
+	}
+
+	g.mu.Lock()
+	g.pending = append(g.pending, c)
+	now := g.Window <= 0 || g.closed
+	if !now {
+		if g.timer == nil {
+			g.timer = time.AfterFunc(g.Window, g.flushLogged)
+		} else {
+			g.timer.Reset(g.Window)
+		}
+	}
+	g.mu.Unlock()
+
+	if now {
+		g.flushLogged()
+	}
+}
+
+// Close commits the pending changes. The changes still made by the
+// requests in flight are committed at once.
+func (g *GitFS) Close() error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	return g.Flush()
+}
+
+func (g *GitFS) flushLogged() {
+	if err := g.Flush(); err != nil {
+		logger.DefaultLogger.Error("commit " + g.Dir + ": " + err.Error())
+	}
+}
+
+// Flush commits the pending changes, in a commit per author.
+func (g *GitFS) Flush() error {
+	g.mu.Lock()
+	pending := g.pending
+	g.pending = nil
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	g.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var authors []string
+	byAuthor := map[string][]gitChange{}
+	for _, c := range pending {
+		if _, ok := byAuthor[c.author]; !ok {
+			authors = append(authors, c.author)
+		}
+		byAuthor[c.author] = append(byAuthor[c.author], c)
+	}
+
+	unlock := g.lock()
+	defer unlock()
+	var errs []error
+	for _, author := range authors {
+		errs = append(errs, g.commit(author, byAuthor[author]))
+	}
+	return errors.Join(errs...)
+}
+
+// commit commits changes made by author. It must be called with the
+// repository locked.
+func (g *GitFS) commit(author string, changes []gitChange) error {
+	ctx := context.Background()
+	var paths []string
+	seen := map[string]bool{}
+	for _, c := range changes {
+		for _, p := range c.paths {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	if paths, err := g.known(ctx, paths); err != nil {
+		return err
+	} else if len(paths) > 0 {
+		if _, err := g.git(ctx, nil, append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+			return err
+		}
+	}
+	if _, err := g.git(ctx, nil, "diff", "--cached", "--quiet"); err == nil {
+		// The changes left the files as they were.
+		return nil
+	}
+
+	msg := changes[0].desc
+	if len(changes) > 1 {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d changes\n\n", len(changes))
+		for _, c := range changes {
+			b.WriteString(c.desc + "\n")
+		}
+		msg = b.String()
+	}
+	_, err := g.git(ctx, []string{"GIT_AUTHOR_NAME=" + author}, "commit", "-q", "-m", msg)
+	return err
+}
+
+// known returns the paths that exist or are tracked, which Git accepts
+// as pathspecs.
+func (g *GitFS) known(ctx context.Context, paths []string) ([]string, error) {
+	out, err := g.git(ctx, nil, append([]string{"ls-files", "-z", "--"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+	tracked := strings.Split(string(out), "\x00")
+	var known []string
+	for _, p := range paths {
+		if _, err := os.Lstat(filepath.Join(g.Dir, filepath.FromSlash(p))); err == nil {
+			known = append(known, p)
+			continue
+		}
+		for _, t := range tracked {
+			if t == p || strings.HasPrefix(t, p+"/") {
+				known = append(known, p)
+				break
+			}
+		}
+	}
+	return known, nil
+}
+
+// Rollback restores the file or directory name as it was at commit,
+// removing it if it did not exist then, and commits it at once in the
+// name of author, or of the user making the request of ctx when empty.
+func (g *GitFS) Rollback(ctx context.Context, name, commit, author string) error {
+	if err := g.Flush(); err != nil {
+		return err
+	}
+	name = path.Clean("/" + name)
+	rel := strings.TrimPrefix(name, "/")
+	if rel == "" {
+		rel = "."
+	}
+
+	unlock := g.lock()
+	defer unlock()
+	hash, err := g.resolveCommit(ctx, commit)
+	if err != nil {
+		return err
+	}
+	if _, err := g.git(ctx, nil, "rm", "-r", "-q", "--ignore-unmatch", "--", rel); err != nil {
+		return err
+	}
+	if out, err := g.git(ctx, nil, "ls-tree", hash, "--", rel); err != nil {
+		return err
+	} else if len(out) > 0 || rel == "." {
+		if _, err := g.git(ctx, nil, "checkout", hash, "--", rel); err != nil {
+			return err
+		}
+	}
+	if author == "" {
+		author = gitAuthor(ctx)
+	}
+	return g.commit(author, []gitChange{{desc: fmt.Sprintf("Roll back %s to %.12s", name, hash)}})
+}
+
+func (g *GitFS) resolveCommit(ctx context.Context, commit string) (string, error) {
+	out, err := g.git(ctx, nil, "rev-parse", "--verify", "-q", commit+"^{commit}")
+	if err != nil {
+		return "", &os.PathError{Op: "open", Path: commit, Err: os.ErrNotExist}
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitReserved reports whether name is in the repository itself or the
+// history folder, which cannot be changed.
+func gitReserved(name string) bool {
+	name = path.Clean("/" + name)
+	return within(name, "/.git") || within(name, HistoryFolder)
+}
+
+func (g *GitFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if gitReserved(name) {
+		return os.ErrPermission
+	}
+	return g.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (g *GitFS) RemoveAll(ctx context.Context, name string) error {
+	if gitReserved(name) {
+		return os.ErrPermission
+	}
+	if err := g.FileSystem.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	g.record(ctx, "Delete "+path.Clean("/"+name), name)
+	return nil
+}
+
+func (g *GitFS) Rename(ctx context.Context, oldName, newName string) error {
+	if gitReserved(oldName) || gitReserved(newName) {
+		return os.ErrPermission
+	}
+	if err := g.FileSystem.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	g.record(ctx, "Move "+path.Clean("/"+oldName)+" to "+path.Clean("/"+newName), oldName, newName)
+	return nil
+}
+
+func (g *GitFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = path.Clean("/" + name)
+	switch {
+	case within(name, "/.git"):
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	case within(name, HistoryFolder):
+		return g.historyStat(ctx, name)
+	}
+	return g.FileSystem.Stat(ctx, name)
+}
+
+func (g *GitFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = path.Clean("/" + name)
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case within(name, "/.git"):
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case within(name, HistoryFolder) && write:
+		return nil, os.ErrPermission
+	case within(name, HistoryFolder):
+		return g.openHistory(ctx, name)
+	}
+
+	f, err := g.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if write {
+		return &gitFile{File: f, fs: g, ctx: ctx, name: name}, nil
+	}
+	if name == "/" {
+		return &gitRoot{File: f, fs: g, ctx: ctx}, nil
+	}
+	return f, nil
+}
+
+// gitFile records a file written once it is closed.
+type gitFile struct {
+	webdav.File
+	fs   *GitFS
+	ctx  context.Context
+	name string
+}
+
+func (f *gitFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	f.fs.record(f.ctx, "Update "+f.name, f.name)
+	return nil
+}
+
+// gitRoot lists the history folder instead of the repository.
+type gitRoot struct {
+	webdav.File
+	fs     *GitFS
+	ctx    context.Context
+	listed bool
+}
+
+func (d *gitRoot) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	entries := infos[:0]
+	for _, info := range infos {
+		if info.Name() != ".git" {
+			entries = append(entries, info)
+		}
+	}
+	if !d.listed && (err == nil || err == io.EOF) {
+		d.listed = true
+		if info, herr := d.fs.historyStat(d.ctx, HistoryFolder); herr == nil {
+			entries = append(entries, info)
+			err = nil
+		}
+	}
+	return entries, err
+}
+
+// gitCommit is a commit listed in the history folder.
+type gitCommit struct {
+	hash string
+	time time.Time
+}
+
+// folder returns the name of the folder of the commit.
+func (c gitCommit) folder() string {
+	return c.time.UTC().Format("20060102T150405") + "-" + c.hash[:12]
+}
+
+// commits returns the latest commits, newest first.
+func (g *GitFS) commits(ctx context.Context) ([]gitCommit, error) {
+	limit := g.HistoryLimit
+	if limit <= 0 {
+		limit = 100
+	}
+	out, err := g.git(ctx, nil, "log", "-n", strconv.Itoa(limit), "--format=%H %ct")
+	if err != nil {
+		return nil, err
+	}
+	var commits []gitCommit
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		hash, ts, ok := strings.Cut(line, " ")
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		commits = append(commits, gitCommit{hash, time.Unix(sec, 0)})
+	}
+	return commits, nil
+}
+
+// historyPath splits a path of the history folder into its commit and
+// the path in that commit.
+func (g *GitFS) historyPath(ctx context.Context, name string) (gitCommit, string, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(name, HistoryFolder), "/")
+	folder, inner, _ := strings.Cut(rest, "/")
+	notExist := &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	stamp, prefix, ok := strings.Cut(folder, "-")
+	if !ok {
+		return gitCommit{}, "", notExist
+	}
+	out, err := g.git(ctx, nil, "log", "-1", "--format=%H %ct", prefix+"^{commit}", "--")
+	if err != nil {
+		return gitCommit{}, "", notExist
+	}
+	hash, ts, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	sec, _ := strconv.ParseInt(ts, 10, 64)
+	c := gitCommit{hash, time.Unix(sec, 0)}
+	if c.folder() != stamp+"-"+prefix {
+		return gitCommit{}, "", notExist
+	}
+	return c, inner, nil
+}
+
+// treeEntry is an entry listed by git ls-tree.
+type treeEntry struct {
+	name   string
+	dir    bool
+	object string
+	size   int64
+}
+
+// lsTree lists the entry at inner in commit, or the entries of the
+// directory inner when it ends with a slash.
+func (g *GitFS) lsTree(ctx context.Context, commit, inner string) ([]treeEntry, error) {
+	args := []string{"ls-tree", "-l", "-z", commit}
+	if inner != "" {
+		args = append(args, "--", inner)
+	}
+	out, err := g.git(ctx, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	var entries []treeEntry
+	for _, line := range strings.Split(string(out), "\x00") {
+		meta, p, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 4 {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+		entries = append(entries, treeEntry{name: path.Base(p), dir: fields[1] == "tree", object: fields[2], size: size})
+	}
+	return entries, nil
+}
+
+func (g *GitFS) historyStat(ctx context.Context, name string) (os.FileInfo, error) {
+	if name == HistoryFolder {
+		info := historyInfo{name: path.Base(HistoryFolder), dir: true, modTime: time.Now()}
+		if commits, err := g.commits(ctx); err == nil && len(commits) > 0 {
+			info.modTime = commits[0].time
+		}
+		return info, nil
+	}
+	c, inner, err := g.historyPath(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if inner == "" {
+		return historyInfo{name: c.folder(), dir: true, modTime: c.time}, nil
+	}
+	entries, err := g.lsTree(ctx, c.hash, inner)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	e := entries[0]
+	return historyInfo{name: e.name, dir: e.dir, size: e.size, modTime: c.time}, nil
+}
+
+func (g *GitFS) openHistory(ctx context.Context, name string) (webdav.File, error) {
+	info, err := g.historyStat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if name == HistoryFolder {
+		commits, err := g.commits(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d := &historyDir{info: info}
+		for _, c := range commits {
+			d.entries = append(d.entries, historyInfo{name: c.folder(), dir: true, modTime: c.time})
+		}
+		return d, nil
+	}
+
+	c, inner, err := g.historyPath(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if inner != "" {
+			inner += "/"
+		}
+		entries, err := g.lsTree(ctx, c.hash, inner)
+		if err != nil {
+			return nil, err
+		}
+		d := &historyDir{info: info}
+		for _, e := range entries {
+			d.entries = append(d.entries, historyInfo{name: e.name, dir: e.dir, size: e.size, modTime: c.time})
+		}
+		return d, nil
+	}
+
+	entries, err := g.lsTree(ctx, c.hash, inner)
+	if err != nil || len(entries) != 1 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	data, err := g.git(ctx, nil, "cat-file", "blob", entries[0].object)
+	if err != nil {
+		return nil, err
+	}
+	return &historyFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+// historyInfo describes an entry of the history folder.
+type historyInfo struct {
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+func (fi historyInfo) Name() string       { return fi.name }
+func (fi historyInfo) Size() int64        { return fi.size }
+func (fi historyInfo) ModTime() time.Time { return fi.modTime }
+func (fi historyInfo) IsDir() bool        { return fi.dir }
+func (fi historyInfo) Sys() interface{}   { return nil }
+
+func (fi historyInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// historyDir lists a folder of the history.
+type historyDir struct {
+	info    os.FileInfo
+	entries []os.FileInfo
+	listed  int
+}
+
+func (d *historyDir) Close() error                                 { return nil }
+func (d *historyDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *historyDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (d *historyDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (d *historyDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+func (d *historyDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.entries[d.listed:]
+	if count <= 0 {
+		d.listed = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(rest))
+	d.listed += n
+	return rest[:n], nil
+}
+
+// historyFile is the content of a file at a commit.
+type historyFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *historyFile) Close() error                             { return nil }
+func (f *historyFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *historyFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *historyFile) Stat() (os.FileInfo, error)               { return f.info, nil }
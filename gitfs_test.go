@@ -0,0 +1,255 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// gitLog returns the author and subject of the commits of the repository
+// at dir, newest first.
+func gitLog(t *testing.T, dir string) []string {
+	t.Helper()
+	out, err := exec.Command("git", "-C", dir, "log", "--format=%an: %s").Output()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func TestGitFS(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "existing.txt"), []byte("v0"), 0644)
+	g, err := NewGitFS(webdav.Dir(dir), dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), requestStateKey{}, &requestState{user: "bob"})
+
+	write := func(name, content string) {
+		t.Helper()
+		f, err := g.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		io.WriteString(f, content)
+		if err := f.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	read := func(name string) string {
+		t.Helper()
+		f, err := g.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		return string(data)
+	}
+
+	write("/existing.txt", "v1")
+	write("/existing.txt", "v1")
+	if err := g.Rename(ctx, "/existing.txt", "/renamed.txt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	write("/other.txt", "other")
+	if err := g.RemoveAll(ctx, "/other.txt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"bob: Delete /other.txt",
+		"bob: Update /other.txt",
+		"bob: Move /existing.txt to /renamed.txt",
+		"bob: Update /existing.txt",
+		"webdav: Initial import",
+	}
+	if got := gitLog(t, dir); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected the commits %q, got %q", want, got)
+	}
+
+	// The repository is hidden and the history read-only.
+	if _, err := g.Stat(ctx, "/.git/config"); !os.IsNotExist(err) {
+		t.Errorf("expected the repository to be hidden, got %v", err)
+	}
+	if _, err := g.OpenFile(ctx, HistoryFolder+"/x", os.O_RDWR|os.O_CREATE, 0644); !os.IsPermission(err) {
+		t.Errorf("expected the history to be read-only, got %v", err)
+	}
+	root, _ := g.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	infos, _ := root.Readdir(0)
+	root.Close()
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if strings.Join(names, ",") != "renamed.txt,.history" {
+		t.Errorf("expected the files and the history folder, got %v", names)
+	}
+
+	history, _ := g.OpenFile(ctx, HistoryFolder, os.O_RDONLY, 0)
+	commits, _ := history.Readdir(0)
+	history.Close()
+	if len(commits) != 5 {
+		t.Fatalf("expected a folder per commit, got %d", len(commits))
+	}
+	initial := HistoryFolder + "/" + commits[4].Name()
+	if got := read(initial + "/existing.txt"); got != "v0" {
+		t.Errorf("expected the content at the first commit, got %q", got)
+	}
+	if info, err := g.Stat(ctx, initial+"/existing.txt"); err != nil || info.Size() != 2 {
+		t.Errorf("expected the size at the first commit, got %v %v", info, err)
+	}
+	if _, err := g.Stat(ctx, initial+"/renamed.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected later files to be missing, got %v", err)
+	}
+
+	hash := strings.TrimPrefix(commits[4].Name()[strings.Index(commits[4].Name(), "-"):], "-")
+	if err := g.Rollback(ctx, "/", hash, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := read("/existing.txt"); got != "v0" {
+		t.Errorf("expected the rolled back content, got %q", got)
+	}
+	if _, err := g.Stat(ctx, "/renamed.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected the later file to be removed, got %v", err)
+	}
+	if got := gitLog(t, dir)[0]; !strings.HasPrefix(got, "bob: Roll back / to "+hash) {
+		t.Errorf("expected the rollback to be committed, got %q", got)
+	}
+}
+
+func TestConfigServeHTTPGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	cfg := testConfig(t, `{"scope": "`+dir+`", "modify": true, "git": {"window": "0s"},
+		"users": [{"username": "alice", "password": "alice"}, {"username": "bob", "password": "bob"}]}`)
+
+	do := func(user, method, target, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth(user, user)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("alice", "PUT", "/doc.txt", "draft"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	if w := do("bob", "PUT", "/doc.txt", "final"); w.Code != http.StatusCreated && w.Code != http.StatusNoContent {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	log := gitLog(t, dir)
+	if len(log) != 3 || log[0] != "bob: Update /doc.txt" || log[1] != "alice: Update /doc.txt" {
+		t.Errorf("expected a commit per upload by its user, got %q", log)
+	}
+
+	w := do("bob", "PROPFIND", HistoryFolder+"/", "", "Depth", "1")
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected the history to be listed, got %d", w.Code)
+	}
+	out, _ := exec.Command("git", "-C", dir, "log", "-1", "--skip=1", "--format=%cd-%h", "--date=format-local:%Y%m%dT%H%M%S", "--abbrev=12").Output()
+	folder := HistoryFolder + "/" + strings.TrimSpace(string(out))
+	if !strings.Contains(w.Body.String(), folder) {
+		t.Errorf("expected the folder of the commit %s, got %s", folder, w.Body)
+	}
+
+	// Rolling back is copying from the history.
+	if w := do("bob", "COPY", folder+"/doc.txt", "", "Destination", "/doc.txt"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected the copy to succeed, got %d", w.Code)
+	}
+	if w := do("bob", "GET", "/doc.txt", ""); w.Body.String() != "draft" {
+		t.Errorf("expected the rolled back content, got %q", w.Body)
+	}
+	if w := do("bob", "DELETE", HistoryFolder, ""); w.Code < 400 {
+		t.Errorf("expected the history to be read-only, got %d", w.Code)
+	}
+}
+
+func TestConfigServeHTTPGitRules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	cfg := testConfig(t, `{"scope": "`+dir+`", "modify": true, "git": {"window": "0s"}, "users": [
+		{"username": "alice", "password": "alice"},
+		{"username": "bob", "password": "bob", "rules": [{"path": "/secret/", "allow": false}]}
+	]}`)
+
+	do := func(user, method, target string, header ...string) *httptest.ResponseRecorder {
+		var body io.Reader
+		if method == "PUT" {
+			body = strings.NewReader("hunter2")
+		}
+		r := httptest.NewRequest(method, target, body)
+		r.SetBasicAuth(user, user)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	os.Mkdir(filepath.Join(dir, "secret"), 0755)
+	if w := do("alice", "PUT", "/secret/pw.txt"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	out, _ := exec.Command("git", "-C", dir, "log", "-1", "--format=%cd-%h", "--date=format-local:%Y%m%dT%H%M%S", "--abbrev=12").Output()
+	file := HistoryFolder + "/" + strings.TrimSpace(string(out)) + "/secret/pw.txt"
+
+	if w := do("alice", "GET", file); w.Code != http.StatusOK || w.Body.String() != "hunter2" {
+		t.Fatalf("expected the file in the history, got %d %q", w.Code, w.Body)
+	}
+	if w := do("bob", "GET", "/secret/pw.txt"); w.Code != http.StatusForbidden {
+		t.Errorf("expected the file to be denied, got %d", w.Code)
+	}
+	if w := do("bob", "GET", file); w.Code != http.StatusForbidden {
+		t.Errorf("expected the file to stay denied in the history, got %d", w.Code)
+	}
+	if w := do("bob", "COPY", file, "Destination", "/pw.txt"); w.Code != http.StatusForbidden {
+		t.Errorf("expected the copy from the history to be denied, got %d", w.Code)
+	}
+	if w := do("bob", "PROPFIND", HistoryFolder+"/", "Depth", "1"); w.Code != http.StatusMultiStatus {
+		t.Errorf("expected the history to be listed, got %d", w.Code)
+	}
+}
+
+func TestConfigHistorySource(t *testing.T) {
+	cfg := &Config{Prefix: "/dav/", Git: &GitVersioning{Scopes: []string{"/srv/docs"}}}
+	mounted := &User{Mounts: []MountPoint{{Path: "/docs", Scope: "/srv/docs"}, {Path: "/media", Scope: "/srv/media"}}}
+	tests := []struct {
+		user *User
+		name string
+		want string
+	}{
+		{&User{Scope: "/srv/docs"}, "/dav/.history/20240101T000000-abc/secret/pw.txt", "/dav/secret/pw.txt"},
+		{&User{Scope: "/srv/docs"}, "/dav/.history/20240101T000000-abc", "/dav/.history/20240101T000000-abc"},
+		{&User{Scope: "/srv/docs"}, "/dav/secret/pw.txt", "/dav/secret/pw.txt"},
+		{&User{Scope: "/srv/other"}, "/dav/.history/20240101T000000-abc/a.txt", "/dav/.history/20240101T000000-abc/a.txt"},
+		{mounted, "/dav/docs/.history/20240101T000000-abc/a/b.txt", "/dav/docs/a/b.txt"},
+		{mounted, "/dav/media/.history/20240101T000000-abc/a.txt", "/dav/media/.history/20240101T000000-abc/a.txt"},
+		{mounted, "/dav/docs/sub/.history/20240101T000000-abc/a.txt", "/dav/docs/sub/.history/20240101T000000-abc/a.txt"},
+	}
+	for _, tt := range tests {
+		if got := cfg.historySource(tt.user, tt.name); got != tt.want {
+			t.Errorf("historySource(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
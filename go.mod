@@ -3,13 +3,18 @@ module github.com/wwqdrh/webdav
 go 1.22.3
 
 require (
+	github.com/go-ldap/ldap/v3 v3.4.8
 	github.com/joho/godotenv v1.5.1
 	github.com/wwqdrh/gokit/logger v0.0.0-20240610005355-fe9ce6600c3a
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.28.0
 	golang.org/x/net v0.30.0
 )
 
 require (
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/hpcloud/tail v1.0.0 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
@@ -0,0 +1,405 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/gokit/logger"
+)
+
+// Headers of webhook deliveries.
+const (
+	WebhookEventHeader     = "X-Webdav-Event"
+	WebhookDeliveryHeader  = "X-Webdav-Delivery"
+	WebhookSignatureHeader = "X-Webdav-Signature"
+)
+
+// Webhook posts events as JSON to URL. When Secret is set, the body is
+// signed with HMAC-SHA256, sent as "sha256=<hex>" in the signature
+// header. Events are delivered in order; failed deliveries are retried
+// and dropped after MaxAttempts, never when it is not positive. The
+// delay between attempts grows exponentially with the failures of the
+// endpoint, whatever the event, and is reset by a delivery, so that an
+// outage is not waited out again for each event. Events waiting for
+// delivery are kept in QueueDir, when set, and delivered after a
+// restart. At most MaxQueue events wait, when it is positive; the others
+// are dropped.
+type Webhook struct {
+	URL    string
+	Secret []byte
+	// Types, when not empty, limits the events sent.
+	Types       []string
+	QueueDir    string
+	MaxQueue    int
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Client      *http.Client
+
+	start sync.Once
+	mu    sync.Mutex
+	queue []queuedEvent
+	// failures counts the deliveries that failed since the last one that
+	// succeeded, and dropped the events that did not fit in the queue.
+	failures int
+	dropped  int
+	wake     chan struct{}
+	ctx      context.Context
+	stop     context.CancelFunc
+}
+
+// queuedEvent is an event waiting for delivery. File is its copy in the
+// queue directory, if any.
+type queuedEvent struct {
+	body []byte
+	ev   Event
+	file string
+}
+
+// NewWebhook returns a webhook to url with the default retry policy.
+func NewWebhook(url string, secret []byte) *Webhook {
+	return &Webhook{
+		URL:         url,
+		Secret:      secret,
+		MaxQueue:    1000,
+		MaxAttempts: 10,
+		BaseDelay:   time.Second,
+		MaxDelay:    5 * time.Minute,
+	}
+}
+
+// Start loads the events queued by a previous run and starts delivering
+// in the background. It is called by Send when needed.
+func (h *Webhook) Start() {
+	h.start.Do(func() {
+		h.wake = make(chan struct{}, 1)
+		h.ctx, h.stop = context.WithCancel(context.Background())
+		if h.QueueDir != "" {
+			if err := os.MkdirAll(h.QueueDir, 0700); err != nil {
+				logger.DefaultLogger.Warn("create webhook queue: " + err.Error())
+			}
+			h.load()
+		}
+		go h.run()
+	})
+}
+
+// Close stops the deliveries. Events still queued in QueueDir are
+// delivered by the next webhook using it.
+func (h *Webhook) Close() {
+	h.Start()
+	h.stop()
+}
+
+func (h *Webhook) Send(ev Event) {
+	if !matchesType(h.Types, ev.Type) {
+		return
+	}
+	h.Start()
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.MaxQueue > 0 && len(h.queue) >= h.MaxQueue {
+		if h.dropped == 0 {
+			logger.DefaultLogger.Warn("webhook " + h.URL + ": queue full, dropping events")
+		}
+		h.dropped++
+		return
+	}
+	q := queuedEvent{body: body, ev: ev}
+	if h.QueueDir != "" {
+		q.file = filepath.Join(h.QueueDir, fmt.Sprintf("%020d-%s.json", ev.Time.UnixNano(), ev.ID))
+		if err := writeFileAtomic(q.file, body, 0600); err != nil {
+			logger.DefaultLogger.Warn("queue webhook event: " + err.Error())
+			q.file = ""
+		}
+	}
+	h.queue = append(h.queue, q)
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// load queues the events left in the queue directory.
+func (h *Webhook) load() {
+	entries, err := os.ReadDir(h.QueueDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.DefaultLogger.Warn("load webhook queue: " + err.Error())
+		}
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(h.QueueDir, e.Name())
+		body, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		q := queuedEvent{body: body, file: file}
+		if err := json.Unmarshal(body, &q.ev); err != nil {
+			logger.DefaultLogger.Warn("drop invalid webhook event " + file)
+			os.Remove(file)
+			continue
+		}
+		h.queue = append(h.queue, q)
+	}
+}
+
+func (h *Webhook) run() {
+	// attempts counts the deliveries of the event at the head of the
+	// queue, and retry is when the endpoint may be tried again.
+	attempts := 0
+	var retry time.Time
+	for {
+		h.mu.Lock()
+		if len(h.queue) == 0 {
+			h.mu.Unlock()
+			select {
+			case <-h.wake:
+				continue
+			case <-h.ctx.Done():
+				return
+			}
+		}
+		q := h.queue[0]
+		h.mu.Unlock()
+
+		if wait := time.Until(retry); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-h.ctx.Done():
+				return
+			}
+		}
+		err := h.deliver(q)
+		if h.ctx.Err() != nil {
+			return
+		}
+		attempts++
+
+		h.mu.Lock()
+		if err != nil {
+			h.failures++
+			retry = time.Now().Add(h.backoff(h.failures))
+		} else {
+			h.failures = 0
+		}
+		h.mu.Unlock()
+		if err != nil && (h.MaxAttempts <= 0 || attempts < h.MaxAttempts) {
+			logger.DefaultLogger.Debug("webhook " + h.URL + ": " + err.Error())
+			continue
+		}
+		if err != nil {
+			logger.DefaultLogger.Warn(fmt.Sprintf("webhook %s: dropped event %s after %d attempts: %v", h.URL, q.ev.ID, attempts, err))
+		}
+
+		attempts = 0
+		if q.file != "" {
+			os.Remove(q.file)
+		}
+		h.mu.Lock()
+		h.queue = h.queue[1:]
+		if h.dropped > 0 {
+			logger.DefaultLogger.Warn(fmt.Sprintf("webhook %s: dropped %d events while the queue was full", h.URL, h.dropped))
+			h.dropped = 0
+		}
+		h.mu.Unlock()
+	}
+}
+
+// backoff returns the delay before the next attempt after failures.
+func (h *Webhook) backoff(failures int) time.Duration {
+	d := h.BaseDelay
+	for i := 1; i < failures && (h.MaxDelay <= 0 || d < h.MaxDelay); i++ {
+		d *= 2
+	}
+	if h.MaxDelay > 0 && d > h.MaxDelay {
+		d = h.MaxDelay
+	}
+	return d
+}
+
+func (h *Webhook) deliver(q queuedEvent) error {
+	req, err := http.NewRequestWithContext(h.ctx, "POST", h.URL, bytes.NewReader(q.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, q.ev.Type)
+	req.Header.Set(WebhookDeliveryHeader, q.ev.ID)
+	if len(h.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(h.Secret, q.body))
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// same reports whether h delivers the same events to the same place as
+// other, so that other can keep delivering in its place.
+func (h *Webhook) same(other *Webhook) bool {
+	return h.URL == other.URL && bytes.Equal(h.Secret, other.Secret) && slices.Equal(h.Types, other.Types) &&
+		h.QueueDir == other.QueueDir && h.MaxQueue == other.MaxQueue && h.MaxAttempts == other.MaxAttempts &&
+		h.BaseDelay == other.BaseDelay && h.MaxDelay == other.MaxDelay &&
+		(h.Client == nil) == (other.Client == nil) && (h.Client == nil || h.Client.Timeout == other.Client.Timeout)
+}
+
+// SignWebhook returns the signature of a webhook body.
+func SignWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Command runs a local command for every event. The event is passed in
+// the environment as WEBDAV_EVENT, WEBDAV_PATH, WEBDAV_DESTINATION and
+// WEBDAV_USER, along with WEBDAV_FILE and WEBDAV_DESTINATION_FILE, the
+// paths on disk, for local scopes. At most Concurrency commands run at
+// once; a command running longer than Timeout is killed. At most
+// MaxQueue events, 100 when it is not positive, wait for a command to
+// finish; the others are dropped.
+type Command struct {
+	Path string
+	Args []string
+	// Types, when not empty, limits the events handled.
+	Types       []string
+	Timeout     time.Duration
+	Concurrency int
+	MaxQueue    int
+
+	once    sync.Once
+	events  chan Event
+	done    chan struct{}
+	closed  sync.Once
+	mu      sync.Mutex
+	dropped int
+}
+
+// start starts the workers running the commands.
+func (c *Command) start() {
+	c.once.Do(func() {
+		size := c.MaxQueue
+		if size <= 0 {
+			size = 100
+		}
+		c.events = make(chan Event, size)
+		c.done = make(chan struct{})
+		for i := 0; i < max(c.Concurrency, 1); i++ {
+			go c.work()
+		}
+	})
+}
+
+// Close stops the workers once their commands finish. Events still
+// waiting are dropped.
+func (c *Command) Close() {
+	c.start()
+	c.closed.Do(func() { close(c.done) })
+}
+
+func (c *Command) Send(ev Event) {
+	if !matchesType(c.Types, ev.Type) {
+		return
+	}
+	c.start()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	select {
+	case c.events <- ev:
+	default:
+		c.mu.Lock()
+		if c.dropped == 0 {
+			logger.DefaultLogger.Warn("hook " + c.Path + ": queue full, dropping events")
+		}
+		c.dropped++
+		c.mu.Unlock()
+	}
+}
+
+func (c *Command) work() {
+	for {
+		select {
+		case ev := <-c.events:
+			c.mu.Lock()
+			if c.dropped > 0 {
+				logger.DefaultLogger.Warn(fmt.Sprintf("hook %s: dropped %d events while the queue was full", c.Path, c.dropped))
+				c.dropped = 0
+			}
+			c.mu.Unlock()
+			c.run(ev)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// same reports whether c handles the same events the same way as other,
+// so that other can keep handling them in its place.
+func (c *Command) same(other *Command) bool {
+	return c.Path == other.Path && slices.Equal(c.Args, other.Args) && slices.Equal(c.Types, other.Types) &&
+		c.Timeout == other.Timeout && c.Concurrency == other.Concurrency && c.MaxQueue == other.MaxQueue
+}
+
+func (c *Command) run(ev Event) {
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Env = append(os.Environ(),
+		"WEBDAV_EVENT="+ev.Type,
+		"WEBDAV_PATH="+ev.Path,
+		"WEBDAV_DESTINATION="+ev.Destination,
+		"WEBDAV_USER="+ev.Username,
+	)
+	if ev.Scope != "" {
+		cmd.Env = append(cmd.Env, "WEBDAV_FILE="+filepath.Join(ev.Scope, filepath.FromSlash(ev.Path)))
+		if ev.Destination != "" {
+			cmd.Env = append(cmd.Env, "WEBDAV_DESTINATION_FILE="+filepath.Join(ev.Scope, filepath.FromSlash(ev.Destination)))
+		}
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logger.DefaultLogger.Warn(fmt.Sprintf("hook %s for %s %s: %v: %s", c.Path, ev.Type, ev.Path, err, bytes.TrimSpace(out)))
+	}
+}
@@ -0,0 +1,217 @@
+package webdav
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventually fails the test unless cond becomes true within a second.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("condition not met in time")
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []Event
+		failures = 2
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(WebhookSignatureHeader) != SignWebhook([]byte("secret"), body) {
+			t.Errorf("unexpected signature %q", r.Header.Get(WebhookSignatureHeader))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if r.Header.Get(WebhookEventHeader) != ev.Type || r.Header.Get(WebhookDeliveryHeader) != ev.ID {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		received = append(received, ev)
+	}))
+	defer srv.Close()
+
+	queue := t.TempDir()
+	h := NewWebhook(srv.URL, []byte("secret"))
+	h.QueueDir, h.BaseDelay, h.Types = queue, time.Millisecond, []string{EventCreate, EventDelete}
+	defer h.Close()
+
+	h.Send(Event{ID: "1", Type: EventCreate, Path: "/a.txt", Time: time.Now()})
+	h.Send(Event{ID: "2", Type: EventModify, Path: "/a.txt", Time: time.Now()})
+	h.Send(Event{ID: "3", Type: EventDelete, Path: "/a.txt", Time: time.Now()})
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	})
+	if received[0].ID != "1" || received[1].ID != "3" {
+		t.Errorf("expected the filtered events in order after the retries, got %+v", received)
+	}
+	eventually(t, func() bool {
+		entries, _ := os.ReadDir(queue)
+		return len(entries) == 0
+	})
+}
+
+func TestWebhookQueue(t *testing.T) {
+	queue := t.TempDir()
+	down := NewWebhook("http://127.0.0.1:1/", nil)
+	down.QueueDir, down.BaseDelay = queue, time.Hour
+	down.Send(Event{ID: "1", Type: EventCreate, Path: "/a.txt", Time: time.Now()})
+	down.Send(Event{ID: "2", Type: EventDelete, Path: "/a.txt", Time: time.Now()})
+	down.Close()
+
+	if entries, _ := os.ReadDir(queue); len(entries) != 2 {
+		t.Fatalf("expected the undelivered events to be queued, got %d", len(entries))
+	}
+
+	ids := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get(WebhookDeliveryHeader)
+	}))
+	defer srv.Close()
+
+	up := NewWebhook(srv.URL, nil)
+	up.QueueDir = queue
+	up.Start()
+	defer up.Close()
+	for _, want := range []string{"1", "2"} {
+		select {
+		case id := <-ids:
+			if id != want {
+				t.Errorf("expected event %s, got %s", want, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the queued event %s to be delivered", want)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	h := NewWebhook(srv.URL, nil)
+	h.MaxAttempts, h.BaseDelay = 1, time.Hour
+	defer h.Close()
+	h.Send(Event{ID: "1", Type: EventCreate, Path: "/a.txt", Time: time.Now()})
+	h.Send(Event{ID: "2", Type: EventCreate, Path: "/b.txt", Time: time.Now()})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+	eventually(t, func() bool { return count() == 1 })
+
+	// The first event is dropped, but the endpoint is not tried again
+	// before its delay.
+	time.Sleep(50 * time.Millisecond)
+	if got := count(); got != 1 {
+		t.Errorf("expected the next event to wait for the endpoint, got %d requests", got)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.queue) != 1 || h.failures != 1 {
+		t.Errorf("expected one event waiting after one failure, got %d events and %d failures", len(h.queue), h.failures)
+	}
+}
+
+func TestWebhookMaxQueue(t *testing.T) {
+	queue := t.TempDir()
+	h := NewWebhook("http://127.0.0.1:1/", nil)
+	h.QueueDir, h.BaseDelay, h.MaxQueue = queue, time.Hour, 2
+	for _, id := range []string{"1", "2", "3", "4"} {
+		h.Send(Event{ID: id, Type: EventCreate, Path: "/a.txt", Time: time.Now()})
+	}
+	h.Close()
+
+	entries, _ := os.ReadDir(queue)
+	if len(entries) != 2 {
+		t.Fatalf("expected the events beyond the limit to be dropped, got %d queued", len(entries))
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.dropped != 2 {
+		t.Errorf("expected 2 dropped events, got %d", h.dropped)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no shell")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	c := &Command{
+		Path:  "/bin/sh",
+		Args:  []string{"-c", `echo "$WEBDAV_EVENT $WEBDAV_PATH $WEBDAV_DESTINATION $WEBDAV_USER $WEBDAV_FILE" > ` + out},
+		Types: []string{EventMove},
+	}
+	c.Send(Event{Type: EventCreate, Path: "/ignored.txt"})
+	c.Send(Event{Type: EventMove, Path: "/a.txt", Destination: "/b.txt", Username: "bob", Scope: "/srv"})
+
+	var data []byte
+	eventually(t, func() bool {
+		data, _ = os.ReadFile(out)
+		return strings.HasSuffix(string(data), "\n")
+	})
+	if got := strings.TrimSpace(string(data)); got != "move /a.txt /b.txt bob /srv/a.txt" {
+		t.Errorf("unexpected environment %q", got)
+	}
+}
+
+func TestCommandQueue(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no shell")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	c := &Command{
+		Path:     "/bin/sh",
+		Args:     []string{"-c", `echo "$WEBDAV_PATH" >> ` + out + `; sleep 0.1`},
+		MaxQueue: 1,
+	}
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		c.Send(Event{Type: EventCreate, Path: "/a.txt"})
+	}
+
+	eventually(t, func() bool {
+		data, _ := os.ReadFile(out)
+		return len(data) > 0
+	})
+	time.Sleep(300 * time.Millisecond)
+	data, _ := os.ReadFile(out)
+	if n := strings.Count(string(data), "\n"); n > 2 {
+		t.Errorf("expected the events beyond the queue to be dropped, got %d runs", n)
+	}
+}
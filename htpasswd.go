@@ -0,0 +1,170 @@
+package webdav
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAuthenticator authenticates against an Apache htpasswd file
+// with bcrypt, SHA1 or MD5 (apr1) hashes. The file is read again when
+// it changes. Users of the file without a configured User get a copy of
+// Template.
+type HtpasswdAuthenticator struct {
+	Path     string
+	Users    map[string]*User
+	Template *User
+
+	mu      sync.Mutex
+	modTime time.Time
+	hashes  map[string]string
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(username, password string) (*User, error) {
+	hash, err := a.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	if !checkHtpasswd(hash, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return resolveUser(a.Users, a.Template, username)
+}
+
+func (a *HtpasswdAuthenticator) FindUser(username string) (*User, error) {
+	if _, err := a.lookup(username); err != nil {
+		return nil, err
+	}
+	return resolveUser(a.Users, a.Template, username)
+}
+
+func (a *HtpasswdAuthenticator) lookup(username string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return "", err
+	}
+	if a.hashes == nil || !info.ModTime().Equal(a.modTime) {
+		hashes, err := readHtpasswd(a.Path)
+		if err != nil {
+			return "", err
+		}
+		a.hashes, a.modTime = hashes, info.ModTime()
+	}
+
+	hash, ok := a.hashes[username]
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+	return hash, nil
+}
+
+func readHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, hash, ok := strings.Cut(line, ":"); ok {
+			hashes[name] = hash
+		}
+	}
+	return hashes, scanner.Err()
+}
+
+func checkHtpasswd(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(hash[len("$apr1$"):], "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	}
+	// Plain text and crypt(3) hashes are not supported.
+	return false
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes the Apache variant of the MD5-based crypt(3) hash.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(16, i)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	var out bytes.Buffer
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[idx[0]])<<16|uint32(final[idx[1]])<<8|uint32(final[idx[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return magic + salt + "$" + out.String()
+}
@@ -0,0 +1,71 @@
+package webdav
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestApr1(t *testing.T) {
+	// Generated with: openssl passwd -apr1 -salt saltsalt secret
+	if got, want := apr1("secret", "saltsalt"), "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"; got != want {
+		t.Errorf("apr1() = %q, want %q", got, want)
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# comment\n" +
+		"md5:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"bcrypt:" + string(hash) + "\n" +
+		"plain:secret\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	a := &HtpasswdAuthenticator{
+		Path:     path,
+		Users:    map[string]*User{"sha": {Username: "sha", Scope: "/srv/sha", Modify: true}},
+		Template: &User{Scope: "/srv/{username}"},
+	}
+
+	for _, name := range []string{"md5", "sha", "bcrypt"} {
+		u, err := a.Authenticate(name, "secret")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if u.Username != name {
+			t.Errorf("%s: unexpected username %q", name, u.Username)
+		}
+		if _, err := a.Authenticate(name, "wrong"); err == nil {
+			t.Errorf("%s: expected error for wrong password", name)
+		}
+	}
+
+	if u, _ := a.Authenticate("md5", "secret"); u == nil || u.Scope != "/srv/md5" {
+		t.Errorf("expected templated scope, got %+v", u)
+	}
+	if u, _ := a.Authenticate("sha", "secret"); u == nil || u.Scope != "/srv/sha" {
+		t.Errorf("expected configured user, got %+v", u)
+	}
+	if _, err := a.Authenticate("plain", "secret"); err == nil {
+		t.Errorf("expected plain text passwords to be rejected")
+	}
+
+	if u, err := a.FindUser("md5"); err != nil || u.Scope != "/srv/md5" {
+		t.Errorf("expected to find the user, got %+v %v", u, err)
+	}
+	if _, err := a.FindUser("missing"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package webdav
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConn is the subset of *ldap.Conn used by LDAPAuthenticator.
+type LDAPConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// DialLDAP returns a function dialing the LDAP server at url, suitable
+// for LDAPAuthenticator.Dial.
+func DialLDAP(url string) func() (LDAPConn, error) {
+	return func() (LDAPConn, error) {
+		return ldap.DialURL(url)
+	}
+}
+
+// LDAPAuthenticator authenticates users with an LDAP simple bind. The
+// entry of the user is looked up with UserFilter, using BindDN when set
+// and an anonymous search otherwise, and the password is checked by
+// binding as that entry. The user is named after the entry rather than
+// after what the client typed, as directories match names regardless of
+// case. The groups of the user are mapped to configured groups through
+// Groups.
+type LDAPAuthenticator struct {
+	Dial         func() (LDAPConn, error)
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter selects the entry of a user, "%s" being replaced by the
+	// escaped username. Defaults to "(uid=%s)".
+	UserFilter string
+	// UsernameAttribute names the attribute holding the username of an
+	// entry. Defaults to "uid".
+	UsernameAttribute string
+	// GroupBaseDN and GroupFilter select the groups of a user, "%s"
+	// being replaced by the escaped DN of the user. No group lookup is
+	// done when GroupFilter is empty.
+	GroupBaseDN string
+	GroupFilter string
+	// GroupAttribute names the attribute holding the group name looked
+	// up in Groups. Defaults to "cn".
+	GroupAttribute string
+	Groups         map[string]*Group
+
+	Users    map[string]*User
+	Template *User
+	// CacheTTL is how long a successful bind is remembered.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	digest  [sha256.Size]byte
+	user    *User
+	expires time.Time
+}
+
+func (a *LDAPAuthenticator) Authenticate(username, password string) (*User, error) {
+	// An empty password would turn the bind into an unauthenticated one.
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	digest := sha256.Sum256([]byte(username + "\x00" + password))
+	if u, ok := a.cached(username, digest); ok {
+		return u, nil
+	}
+
+	conn, err := a.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dn, name, err := a.entry(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap bind: %w", err)
+	}
+	u, err := a.member(conn, dn, name)
+	if err != nil {
+		return nil, err
+	}
+
+	a.store(username, digest, u)
+	return u, nil
+}
+
+// FindUser looks the entry of username up without binding as it.
+func (a *LDAPAuthenticator) FindUser(username string) (*User, error) {
+	if username == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := a.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dn, name, err := a.entry(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	return a.member(conn, dn, name)
+}
+
+// entry returns the DN and the username of the entry of username.
+func (a *LDAPAuthenticator) entry(conn LDAPConn, username string) (dn, name string, err error) {
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return "", "", fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+
+	filter := a.UserFilter
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+	attr := a.UsernameAttribute
+	if attr == "" {
+		attr = "uid"
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(username)), []string{attr}, nil,
+	))
+	if err != nil {
+		return "", "", fmt.Errorf("ldap user search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return "", "", ErrInvalidCredentials
+	}
+	dn = res.Entries[0].DN
+	if name = res.Entries[0].GetAttributeValue(attr); name == "" {
+		return "", "", fmt.Errorf("ldap entry %s has no %s", dn, attr)
+	}
+	return dn, name, nil
+}
+
+// member returns the user of the entry dn called name, with the groups
+// of the entry.
+func (a *LDAPAuthenticator) member(conn LDAPConn, dn, name string) (*User, error) {
+	groups, err := a.groups(conn, dn)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := resolveUser(a.Users, a.Template, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) > 0 {
+		member := *u
+		member.Groups = append(append([]*Group{}, u.Groups...), groups...)
+		if u, err = member.Expand(); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// groups returns the configured groups matching the LDAP groups of dn.
+func (a *LDAPAuthenticator) groups(conn LDAPConn, dn string) ([]*Group, error) {
+	if a.GroupFilter == "" {
+		return nil, nil
+	}
+
+	attr := a.GroupAttribute
+	if attr == "" {
+		attr = "cn"
+	}
+	base := a.GroupBaseDN
+	if base == "" {
+		base = a.BaseDN
+	}
+
+	// Group lookups are done with the service account when there is one.
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(a.GroupFilter, ldap.EscapeFilter(dn)), []string{attr}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap group search: %w", err)
+	}
+
+	var groups []*Group
+	for _, entry := range res.Entries {
+		for _, name := range entry.GetAttributeValues(attr) {
+			if g, ok := a.Groups[name]; ok {
+				groups = append(groups, g)
+			} else if g, ok := a.Groups[strings.ToLower(name)]; ok {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (a *LDAPAuthenticator) cached(username string, digest [sha256.Size]byte) (*User, bool) {
+	if a.CacheTTL <= 0 {
+		return nil, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.cache[username]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare(entry.digest[:], digest[:]) != 1 {
+		return nil, false
+	}
+	return entry.user, true
+}
+
+func (a *LDAPAuthenticator) store(username string, digest [sha256.Size]byte, u *User) {
+	if a.CacheTTL <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cache == nil {
+		a.cache = map[string]ldapCacheEntry{}
+	}
+	a.cache[username] = ldapCacheEntry{digest: digest, user: u, expires: time.Now().Add(a.CacheTTL)}
+}
@@ -0,0 +1,135 @@
+package webdav
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAP is an in-process stand-in for an LDAP server.
+type fakeLDAP struct {
+	passwords map[string]string            // DN -> password
+	uids      map[string]string            // uid -> DN, matched regardless of case
+	groups    map[string]map[string]string // group cn -> member DNs
+	binds     int
+}
+
+func (f *fakeLDAP) dial() (LDAPConn, error) {
+	return f, nil
+}
+
+func (f *fakeLDAP) Bind(dn, password string) error {
+	f.binds++
+	if pw, ok := f.passwords[dn]; ok && pw == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (f *fakeLDAP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	res := &ldap.SearchResult{}
+	switch {
+	case strings.HasPrefix(req.Filter, "(uid="):
+		uid := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(uid="), ")")
+		for name, dn := range f.uids {
+			if strings.EqualFold(name, uid) {
+				res.Entries = append(res.Entries, ldap.NewEntry(dn, map[string][]string{"uid": {name}}))
+			}
+		}
+	case strings.HasPrefix(req.Filter, "(member="):
+		member := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(member="), ")")
+		for cn, members := range f.groups {
+			if _, ok := members[member]; ok {
+				res.Entries = append(res.Entries, ldap.NewEntry("cn="+cn+",ou=groups,dc=example", map[string][]string{"cn": {cn}}))
+			}
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeLDAP) Close() error {
+	return nil
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	const aliceDN = "uid=alice,ou=people,dc=example"
+	server := &fakeLDAP{
+		passwords: map[string]string{"cn=service,dc=example": "service", aliceDN: "secret"},
+		uids:      map[string]string{"alice": aliceDN},
+		groups:    map[string]map[string]string{"devs": {aliceDN: ""}},
+	}
+
+	devs := &Group{Name: "team", Rules: []*Rule{{Path: "/code/{username}/", Allow: true, Modify: true}}}
+	a := &LDAPAuthenticator{
+		Dial:         server.dial,
+		BindDN:       "cn=service,dc=example",
+		BindPassword: "service",
+		BaseDN:       "dc=example",
+		GroupFilter:  "(member=%s)",
+		Groups:       map[string]*Group{"devs": devs},
+		Template:     &User{Scope: "/home/{username}"},
+		CacheTTL:     time.Minute,
+	}
+
+	u, err := a.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.Username != "alice" || u.Scope != "/home/alice" {
+		t.Errorf("unexpected user %+v", u)
+	}
+	if len(u.Groups) != 1 || !u.Allowed("/code/alice/main.go", false) {
+		t.Errorf("expected group rules to apply, got %+v", u.Groups)
+	}
+
+	if _, err := a.Authenticate("alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := a.Authenticate("bob", "secret"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := a.Authenticate("alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected empty password to be rejected, got %v", err)
+	}
+
+	binds := server.binds
+	if _, err := a.Authenticate("alice", "secret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.binds != binds {
+		t.Errorf("expected cached bind, got %d new binds", server.binds-binds)
+	}
+}
+
+func TestLDAPAuthenticatorCase(t *testing.T) {
+	const aliceDN = "uid=alice,ou=people,dc=example"
+	server := &fakeLDAP{
+		passwords: map[string]string{aliceDN: "secret"},
+		uids:      map[string]string{"alice": aliceDN},
+	}
+	alice := &User{Username: "alice", Scope: "/srv/alice", Rules: []*Rule{{Path: "/", Allow: false}}}
+	a := &LDAPAuthenticator{
+		Dial:     server.dial,
+		BaseDN:   "dc=example",
+		Users:    map[string]*User{"alice": alice},
+		Template: &User{Scope: "/srv/dav/{username}", Modify: true},
+	}
+
+	u, err := a.Authenticate("Alice", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u != alice {
+		t.Errorf("expected the configured user, got %+v", u)
+	}
+
+	if u, err := a.FindUser("ALICE"); err != nil || u != alice {
+		t.Errorf("expected to find the configured user, got %+v %v", u, err)
+	}
+	if _, err := a.FindUser("bob"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package webdav
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LoginGuard throttles failed logins. Failures are counted per username
+// and per client address over a sliding Window. Each failure delays the
+// next attempt exponentially, and reaching the maximum number of
+// failures locks the username or address out for LockoutDuration. At
+// most MaxTracked usernames, and as many addresses, are tracked, when it
+// is positive: the ones that failed least recently are forgotten first,
+// the ones locked out last.
+type LoginGuard struct {
+	Window           time.Duration
+	MaxFailures      int
+	MaxFailuresPerIP int
+	LockoutDuration  time.Duration
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	MaxTracked       int
+	// OnLockout is called, without locks held, when a key gets locked.
+	OnLockout func(kind, key string, until time.Time)
+
+	mu    sync.Mutex
+	users map[string]*loginAttempts
+	ips   map[string]*loginAttempts
+	// swept is when the expired failures were last forgotten.
+	swept time.Time
+}
+
+type loginAttempts struct {
+	failures    []time.Time
+	lockedUntil time.Time
+}
+
+// LockState describes a throttled username or client address.
+type LockState struct {
+	// Kind is "user" or "ip".
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+	RetryAt     time.Time `json:"retryAt,omitempty"`
+}
+
+// NewLoginGuard returns a guard with sensible defaults.
+func NewLoginGuard() *LoginGuard {
+	return &LoginGuard{
+		Window:           15 * time.Minute,
+		MaxFailures:      5,
+		MaxFailuresPerIP: 20,
+		LockoutDuration:  15 * time.Minute,
+		BaseDelay:        time.Second,
+		MaxDelay:         30 * time.Second,
+		MaxTracked:       10000,
+	}
+}
+
+// Check returns how long the client must wait before its credentials
+// for username are checked again, zero when they can be checked now.
+func (g *LoginGuard) Check(username, ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var wait time.Duration
+	if a := g.users[username]; username != "" && a != nil {
+		wait = max(wait, g.wait(a, now))
+	}
+	if a := g.ips[ip]; ip != "" && a != nil {
+		wait = max(wait, g.wait(a, now))
+	}
+	return wait
+}
+
+// Fail records a failed login.
+func (g *LoginGuard) Fail(username, ip string, now time.Time) {
+	var locked []LockState
+
+	g.mu.Lock()
+	if now.Sub(g.swept) >= g.Window {
+		g.sweep(g.users, now)
+		g.sweep(g.ips, now)
+		g.swept = now
+	}
+	if username != "" {
+		if g.users == nil {
+			g.users = map[string]*loginAttempts{}
+		}
+		if until, ok := g.fail(g.users, username, g.MaxFailures, now); ok {
+			locked = append(locked, LockState{Kind: "user", Key: username, LockedUntil: until})
+		}
+	}
+	if ip != "" {
+		if g.ips == nil {
+			g.ips = map[string]*loginAttempts{}
+		}
+		if until, ok := g.fail(g.ips, ip, g.MaxFailuresPerIP, now); ok {
+			locked = append(locked, LockState{Kind: "ip", Key: ip, LockedUntil: until})
+		}
+	}
+	g.mu.Unlock()
+
+	if g.OnLockout != nil {
+		for _, l := range locked {
+			g.OnLockout(l.Kind, l.Key, l.LockedUntil)
+		}
+	}
+}
+
+// Succeed forgets the failures of username after a successful login.
+// The failures of the address are kept, as it may be guessing several
+// accounts.
+func (g *LoginGuard) Succeed(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if a, ok := g.users[username]; ok && a.lockedUntil.IsZero() {
+		delete(g.users, username)
+	}
+}
+
+// Unlock clears the failures of a username ("user") or address ("ip").
+func (g *LoginGuard) Unlock(kind, key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	m := g.users
+	if kind == "ip" {
+		m = g.ips
+	}
+	if _, ok := m[key]; !ok {
+		return false
+	}
+	delete(m, key)
+	return true
+}
+
+// States returns the usernames and addresses with recent failures.
+func (g *LoginGuard) States(now time.Time) []LockState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var states []LockState
+	for kind, m := range map[string]map[string]*loginAttempts{"user": g.users, "ip": g.ips} {
+		g.sweep(m, now)
+		for key, a := range m {
+			s := LockState{Kind: kind, Key: key, Failures: len(a.failures), LockedUntil: a.lockedUntil}
+			if wait := g.wait(a, now); wait > 0 {
+				s.RetryAt = now.Add(wait)
+			}
+			states = append(states, s)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Kind != states[j].Kind {
+			return states[i].Kind > states[j].Kind
+		}
+		return states[i].Key < states[j].Key
+	})
+	return states
+}
+
+// inherit copies the failures and lockouts recorded by old, so that a
+// configuration reload does not lift them.
+func (g *LoginGuard) inherit(old *LoginGuard) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.users = copyAttempts(old.users)
+	g.ips = copyAttempts(old.ips)
+}
+
+func copyAttempts(m map[string]*loginAttempts) map[string]*loginAttempts {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]*loginAttempts, len(m))
+	for key, a := range m {
+		c[key] = &loginAttempts{
+			failures:    append([]time.Time(nil), a.failures...),
+			lockedUntil: a.lockedUntil,
+		}
+	}
+	return c
+}
+
+func (g *LoginGuard) fail(m map[string]*loginAttempts, key string, limit int, now time.Time) (time.Time, bool) {
+	a, ok := m[key]
+	if !ok {
+		if g.MaxTracked > 0 && len(m) >= g.MaxTracked {
+			g.evict(m, now)
+		}
+		a = &loginAttempts{}
+		m[key] = a
+	}
+	g.prune(a, now)
+	a.failures = append(a.failures, now)
+
+	if limit > 0 && len(a.failures) >= limit && a.lockedUntil.IsZero() {
+		a.lockedUntil = now.Add(g.LockoutDuration)
+		return a.lockedUntil, true
+	}
+	return time.Time{}, false
+}
+
+// sweep forgets the keys without recent failures or lockout.
+func (g *LoginGuard) sweep(m map[string]*loginAttempts, now time.Time) {
+	for key, a := range m {
+		g.prune(a, now)
+		if len(a.failures) == 0 && a.lockedUntil.IsZero() {
+			delete(m, key)
+		}
+	}
+}
+
+// evict makes room in m, which is full: it forgets the expired keys or,
+// failing that, a tenth of the keys, those that failed least recently
+// and are not locked out first.
+func (g *LoginGuard) evict(m map[string]*loginAttempts, now time.Time) {
+	g.sweep(m, now)
+	if len(m) < g.MaxTracked {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	last := func(a *loginAttempts) time.Time {
+		if len(a.failures) == 0 {
+			return time.Time{}
+		}
+		return a.failures[len(a.failures)-1]
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := m[keys[i]], m[keys[j]]
+		if a.lockedUntil.IsZero() != b.lockedUntil.IsZero() {
+			return a.lockedUntil.IsZero()
+		}
+		return last(a).Before(last(b))
+	})
+	for _, key := range keys[:len(keys)-g.MaxTracked*9/10] {
+		delete(m, key)
+	}
+}
+
+// prune drops failures outside the window and expired lockouts.
+func (g *LoginGuard) prune(a *loginAttempts, now time.Time) {
+	if !a.lockedUntil.IsZero() && !now.Before(a.lockedUntil) {
+		a.lockedUntil = time.Time{}
+		a.failures = nil
+	}
+	i := 0
+	for i < len(a.failures) && now.Sub(a.failures[i]) >= g.Window {
+		i++
+	}
+	a.failures = a.failures[i:]
+}
+
+func (g *LoginGuard) wait(a *loginAttempts, now time.Time) time.Duration {
+	g.prune(a, now)
+	if !a.lockedUntil.IsZero() {
+		return a.lockedUntil.Sub(now)
+	}
+	if len(a.failures) == 0 || g.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := g.BaseDelay << (len(a.failures) - 1)
+	if delay <= 0 || (g.MaxDelay > 0 && delay > g.MaxDelay) {
+		delay = g.MaxDelay
+	}
+	if retry := a.failures[len(a.failures)-1].Add(delay); now.Before(retry) {
+		return retry.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginGuard(t *testing.T) {
+	g := NewLoginGuard()
+	g.MaxFailures = 3
+	g.MaxFailuresPerIP = 10
+	var locked []string
+	g.OnLockout = func(kind, key string, until time.Time) {
+		locked = append(locked, kind+" "+key)
+	}
+
+	now := time.Date(2024, 10, 18, 12, 0, 0, 0, time.UTC)
+	if wait := g.Check("alice", "10.0.0.1", now); wait != 0 {
+		t.Errorf("expected no wait, got %v", wait)
+	}
+
+	g.Fail("alice", "10.0.0.1", now)
+	if wait := g.Check("alice", "10.0.0.1", now); wait != time.Second {
+		t.Errorf("expected 1s delay, got %v", wait)
+	}
+	g.Fail("alice", "10.0.0.1", now.Add(time.Second))
+	if wait := g.Check("alice", "10.0.0.2", now.Add(time.Second)); wait != 2*time.Second {
+		t.Errorf("expected 2s delay, got %v", wait)
+	}
+	if wait := g.Check("bob", "10.0.0.2", now.Add(time.Second)); wait != 0 {
+		t.Errorf("expected other user and address to be unaffected, got %v", wait)
+	}
+
+	g.Fail("alice", "10.0.0.1", now.Add(3*time.Second))
+	if len(locked) != 1 || locked[0] != "user alice" {
+		t.Errorf("expected alice to be locked, got %v", locked)
+	}
+	if wait := g.Check("alice", "10.0.0.3", now.Add(time.Minute)); wait != 15*time.Minute-time.Minute+3*time.Second {
+		t.Errorf("expected lockout, got %v", wait)
+	}
+
+	states := g.States(now.Add(time.Minute))
+	if len(states) != 2 || states[0].Kind != "user" || states[0].LockedUntil.IsZero() {
+		t.Errorf("unexpected states %+v", states)
+	}
+
+	if !g.Unlock("user", "alice") {
+		t.Errorf("expected unlock to succeed")
+	}
+	if wait := g.Check("alice", "10.0.0.3", now.Add(time.Minute)); wait != 0 {
+		t.Errorf("expected unlocked user, got %v", wait)
+	}
+
+	// Failures leave the sliding window.
+	if wait := g.Check("", "10.0.0.1", now.Add(time.Hour)); wait != 0 {
+		t.Errorf("expected failures to expire, got %v", wait)
+	}
+}
+
+func TestLoginGuardBounded(t *testing.T) {
+	g := NewLoginGuard()
+	g.MaxFailures, g.MaxTracked = 2, 10
+	now := time.Date(2024, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	g.Fail("admin", "", now)
+	g.Fail("admin", "", now)
+	for i := 0; i < 100; i++ {
+		g.Fail(fmt.Sprintf("guess%d", i), "", now.Add(time.Duration(i)*time.Second))
+	}
+	if len(g.users) > g.MaxTracked {
+		t.Errorf("expected at most %d usernames, got %d", g.MaxTracked, len(g.users))
+	}
+	if g.users["guess99"] == nil {
+		t.Errorf("expected the latest failure to be tracked")
+	}
+	if g.Check("admin", "", now.Add(time.Minute)) == 0 {
+		t.Errorf("expected the lockout to outlast the eviction")
+	}
+
+	// The failures out of the window are forgotten by the next one.
+	g.Fail("", "10.0.0.1", now.Add(time.Hour))
+	if len(g.users) != 0 {
+		t.Errorf("expected the expired usernames to be forgotten, got %d", len(g.users))
+	}
+}
+
+func TestConfigServeHTTPLockout(t *testing.T) {
+	cfg := testConfig(t, `{
+		"scope": "`+t.TempDir()+`",
+		"lockout": {"maxFailures": 2, "baseDelay": "0s"},
+		"users": [
+			{"username": "alice", "password": "a"},
+			{"username": "admin", "password": "admin", "admin": true}
+		]
+	}`)
+	var audit bytes.Buffer
+	cfg.Audit = &LogAuditor{W: &audit}
+
+	do := func(method, target, user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do("PROPFIND", "/", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	}
+	w := do("PROPFIND", "/", "alice", "a")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected locked account to be rejected, got %d", w.Code)
+	}
+	if !strings.Contains(audit.String(), `"type":"lockout","username":"alice"`) {
+		t.Errorf("expected lockout to be audited, got %q", audit.String())
+	}
+
+	if w := do("GET", adminPrefix+"lockouts", "alice", "a"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected locked user to stay locked, got %d", w.Code)
+	}
+	w = do("GET", adminPrefix+"lockouts", "admin", "admin")
+	var states []LockState
+	if err := json.NewDecoder(w.Body).Decode(&states); err != nil || len(states) != 2 {
+		t.Errorf("unexpected lockouts %d %v %+v", w.Code, err, states)
+	}
+
+	if w := do("DELETE", adminPrefix+"lockouts/user/alice", "admin", "admin"); w.Code != http.StatusNoContent {
+		t.Errorf("expected unlock, got %d", w.Code)
+	}
+	if w := do("PROPFIND", "/", "alice", "a"); w.Code != http.StatusMultiStatus {
+		t.Errorf("expected unlocked user to log in, got %d", w.Code)
+	}
+}
+
+func TestConfigServeHTTPLockoutChallenge(t *testing.T) {
+	cfg := testConfig(t, `{
+		"scope": "`+t.TempDir()+`",
+		"lockout": {},
+		"users": [{"username": "alice", "password": "a"}]
+	}`)
+
+	// Clients send their credentials after an anonymous challenge.
+	for i := 0; i < 30; i++ {
+		r := httptest.NewRequest("PROPFIND", "/", nil)
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected a challenge, got %d", w.Code)
+		}
+
+		r = httptest.NewRequest("PROPFIND", "/", nil)
+		r.SetBasicAuth("alice", "a")
+		w = httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("expected connect %d to succeed, got %d", i, w.Code)
+		}
+	}
+}
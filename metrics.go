@@ -0,0 +1,225 @@
+package webdav
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsPath is the URL path the metrics are served at.
+const MetricsPath = "/metrics"
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics collects statistics about the server and exposes them in the
+// Prometheus text format.
+type Metrics struct {
+	inFlight    atomic.Int64
+	connections atomic.Int64
+
+	mu           sync.Mutex
+	requests     map[[3]string]uint64 // method, status, user
+	durations    map[string]*histogram
+	bytes        map[[2]string]uint64 // direction, user
+	authFailures uint64
+	denials      map[string]uint64
+	locks        map[string]uint64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewMetrics returns an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  map[[3]string]uint64{},
+		durations: map[string]*histogram{},
+		bytes:     map[[2]string]uint64{},
+		denials:   map[string]uint64{},
+		locks:     map[string]uint64{},
+	}
+}
+
+// ConnState tracks the open connections when set as http.Server.ConnState.
+func (m *Metrics) ConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		m.connections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		m.connections.Add(-1)
+	}
+}
+
+// metricMethods are the methods labelled as such. Clients make up the
+// others, which are labelled "other" so that they cannot add series.
+var metricMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "OPTIONS": true, "PATCH": true,
+	"PROPFIND": true, "PROPPATCH": true, "MKCOL": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
+func (m *Metrics) observe(method string, status int, st *requestState, elapsed time.Duration, in, out int64) {
+	if !metricMethods[method] {
+		method = "other"
+	}
+	user := st.user
+	if user == "" {
+		user = "anonymous"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[[3]string{method, strconv.Itoa(status), user}]++
+
+	h, ok := m.durations[method]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[method] = h
+	}
+	for i, b := range durationBuckets {
+		if elapsed.Seconds() <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += elapsed.Seconds()
+	h.count++
+
+	m.bytes[[2]string{"in", user}] += uint64(in)
+	m.bytes[[2]string{"out", user}] += uint64(out)
+
+	if st.authFailed {
+		m.authFailures++
+	}
+	if st.denied {
+		m.denials[user]++
+	}
+	if method == "LOCK" && status == http.StatusOK {
+		m.locks["lock"]++
+	}
+	if method == "UNLOCK" && status == http.StatusNoContent {
+		m.locks["unlock"]++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+	header(&b, "webdav_requests_total", "counter", "Requests by method, status and user.")
+	for _, k := range sortedKeys(m.requests, func(k [3]string) string { return strings.Join(k[:], "\x00") }) {
+		fmt.Fprintf(&b, "webdav_requests_total{method=%s,status=%s,user=%s} %d\n", label(k[0]), label(k[1]), label(k[2]), m.requests[k])
+	}
+
+	header(&b, "webdav_request_duration_seconds", "histogram", "Request durations by method.")
+	for _, method := range sortedKeys(m.durations, func(k string) string { return k }) {
+		h := m.durations[method]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(&b, "webdav_request_duration_seconds_bucket{method=%s,le=\"%s\"} %d\n", label(method), strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(&b, "webdav_request_duration_seconds_bucket{method=%s,le=\"+Inf\"} %d\n", label(method), h.count)
+		fmt.Fprintf(&b, "webdav_request_duration_seconds_sum{method=%s} %s\n", label(method), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "webdav_request_duration_seconds_count{method=%s} %d\n", label(method), h.count)
+	}
+
+	header(&b, "webdav_bytes_total", "counter", "Bytes received (in) and sent (out) by user.")
+	for _, k := range sortedKeys(m.bytes, func(k [2]string) string { return k[0] + "\x00" + k[1] }) {
+		fmt.Fprintf(&b, "webdav_bytes_total{direction=%s,user=%s} %d\n", label(k[0]), label(k[1]), m.bytes[k])
+	}
+
+	header(&b, "webdav_auth_failures_total", "counter", "Failed authentications.")
+	fmt.Fprintf(&b, "webdav_auth_failures_total %d\n", m.authFailures)
+
+	header(&b, "webdav_rule_denials_total", "counter", "Requests denied by the rules, by user.")
+	for _, user := range sortedKeys(m.denials, func(k string) string { return k }) {
+		fmt.Fprintf(&b, "webdav_rule_denials_total{user=%s} %d\n", label(user), m.denials[user])
+	}
+
+	header(&b, "webdav_locks_total", "counter", "Successful LOCK and UNLOCK requests.")
+	for _, op := range []string{"lock", "unlock"} {
+		fmt.Fprintf(&b, "webdav_locks_total{op=%s} %d\n", label(op), m.locks[op])
+	}
+	m.mu.Unlock()
+
+	header(&b, "webdav_requests_in_flight", "gauge", "Requests being served.")
+	fmt.Fprintf(&b, "webdav_requests_in_flight %d\n", m.inFlight.Load())
+	header(&b, "webdav_connections_active", "gauge", "Open client connections.")
+	fmt.Fprintf(&b, "webdav_connections_active %d\n", m.connections.Load())
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func header(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func sortedKeys[K comparable, V any](m map[K]V, key func(K) string) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return key(keys[i]) < key(keys[j]) })
+	return keys
+}
+
+// metricsWriter records the status and size of a response.
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody records the size of a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,112 @@
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigServeHTTPMetrics(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := testConfig(t, `{
+		"scope": "`+dir+`",
+		"metrics": true,
+		"users": [
+			{"username": "bob", "password": "bob", "modify": true,
+			 "rules": [{"path": "/secret", "allow": false}]},
+			{"username": "prometheus", "password": "scrape", "admin": true}
+		]
+	}`)
+
+	requests := []struct {
+		method   string
+		target   string
+		password string
+		body     string
+		status   int
+	}{
+		{"GET", "/file.txt", "bob", "", http.StatusOK},
+		{"PUT", "/new.txt", "bob", "hello", http.StatusCreated},
+		{"GET", "/secret", "bob", "", http.StatusForbidden},
+		{"GET", "/file.txt", "wrong", "", http.StatusUnauthorized},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(req.method, req.target, strings.NewReader(req.body))
+		r.SetBasicAuth("bob", req.password)
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		if w.Code != req.status {
+			t.Fatalf("%s %s: expected status %d, got %d", req.method, req.target, req.status, w.Code)
+		}
+	}
+
+	// Metrics name the users, so only administrators get them.
+	scrape := func(user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", MetricsPath, nil)
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+	if w := scrape("", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous scrapes to be refused, got %d", w.Code)
+	}
+	if w := scrape("bob", "bob"); w.Code != http.StatusForbidden {
+		t.Errorf("expected scrapes of users to be refused, got %d", w.Code)
+	}
+	w := scrape("prometheus", "scrape")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+
+	for _, want := range []string{
+		"# TYPE webdav_requests_total counter\n",
+		`webdav_requests_total{method="GET",status="200",user="bob"} 1` + "\n",
+		`webdav_requests_total{method="PUT",status="201",user="bob"} 1` + "\n",
+		`webdav_requests_total{method="GET",status="403",user="bob"} 1` + "\n",
+		`webdav_requests_total{method="GET",status="401",user="anonymous"} 1` + "\n",
+		`webdav_request_duration_seconds_count{method="GET"} 3` + "\n",
+		`webdav_request_duration_seconds_bucket{method="PUT",le="+Inf"} 1` + "\n",
+		`webdav_bytes_total{direction="in",user="bob"} 5` + "\n",
+		// The file and the "Created" body of the PUT.
+		`webdav_bytes_total{direction="out",user="bob"} 11` + "\n",
+		"webdav_auth_failures_total 1\n",
+		`webdav_rule_denials_total{user="bob"} 1` + "\n",
+		`webdav_locks_total{op="lock"} 0` + "\n",
+		"webdav_requests_in_flight 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	if got, want := label("a\"b\\c\nd"), `"a\"b\\c\nd"`; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestMetricsMethods(t *testing.T) {
+	m := NewMetrics()
+	for _, method := range []string{"GET", "PROPFIND", "BREW", "X-RANDOM-1", "X-RANDOM-2"} {
+		m.observe(method, http.StatusMethodNotAllowed, &requestState{}, time.Millisecond, 0, 0)
+	}
+	if len(m.durations) != 3 || m.durations["other"] == nil || m.durations["other"].count != 3 {
+		t.Errorf("expected the unknown methods to be labelled other, got %v", m.durations)
+	}
+	if n := m.requests[[3]string{"other", "405", "anonymous"}]; n != 3 {
+		t.Errorf("expected 3 requests with other methods, got %d", n)
+	}
+}
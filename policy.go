@@ -0,0 +1,343 @@
+package webdav
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/wwqdrh/gokit/logger"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	// ErrUploadTooLarge is the violation of UploadPolicy.MaxSize.
+	ErrUploadTooLarge = errors.New("upload too large")
+	// ErrUploadType is the violation of the extensions or types of an
+	// UploadPolicy.
+	ErrUploadType = errors.New("upload type not allowed")
+)
+
+// UploadPolicy restricts the files that may be uploaded. Extensions are
+// compared case-insensitively, with or without their dot; types are
+// MIME types detected from the content, "image/*" matching every image.
+// Empty lists allow everything.
+type UploadPolicy struct {
+	// Path, when not empty, limits the policy to that subtree.
+	Path              string   `json:"path,omitempty"`
+	MaxSize           int64    `json:"maxSize,omitempty"`
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+	DeniedExtensions  []string `json:"deniedExtensions,omitempty"`
+	AllowedTypes      []string `json:"allowedTypes,omitempty"`
+	DeniedTypes       []string `json:"deniedTypes,omitempty"`
+}
+
+func (p UploadPolicy) applies(name string) bool {
+	prefix := strings.TrimSuffix(p.Path, "/")
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// checkName checks the extension of name.
+func (p UploadPolicy) checkName(name string) error {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	matches := func(exts []string) bool {
+		for _, e := range exts {
+			if strings.ToLower(strings.TrimPrefix(e, ".")) == ext {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(p.DeniedExtensions) || (len(p.AllowedExtensions) > 0 && !matches(p.AllowedExtensions)) {
+		return fmt.Errorf("%w: %q", ErrUploadType, path.Base(name))
+	}
+	return nil
+}
+
+// checkType checks a MIME type detected from the content.
+func (p UploadPolicy) checkType(contentType string) error {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mt
+	}
+	matches := func(types []string) bool {
+		for _, t := range types {
+			if t == contentType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(t, "*"))) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(p.DeniedTypes) || (len(p.AllowedTypes) > 0 && !matches(p.AllowedTypes)) {
+		return fmt.Errorf("%w: %s", ErrUploadType, contentType)
+	}
+	return nil
+}
+
+// uploadPolicies returns the policies of u applying to the URL path name.
+func uploadPolicies(u *User, name string) []UploadPolicy {
+	var policies []UploadPolicy
+	for _, p := range u.UploadPolicies {
+		if p.applies(name) {
+			policies = append(policies, p)
+		}
+	}
+	return policies
+}
+
+// checkUpload checks what is known of an upload before it starts: its
+// declared size and the extension of the file it creates. The policies
+// left to enforce while the content is written are attached to the
+// request state. It replies and returns false when the upload is
+// refused.
+func checkUpload(w http.ResponseWriter, r *http.Request, u *User) bool {
+	name := r.URL.Path
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		dst, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			return true
+		}
+		name = dst.Path
+	}
+	st := stateOf(r)
+	st.upload = r.Method == "PUT"
+	policies := uploadPolicies(u, name)
+	if len(policies) == 0 {
+		return true
+	}
+
+	for _, p := range policies {
+		err := p.checkName(name)
+		if err == nil && r.Method == "PUT" && p.MaxSize > 0 && r.ContentLength > p.MaxSize {
+			err = ErrUploadTooLarge
+		}
+		if err != nil {
+			http.Error(w, err.Error(), policyStatus(err))
+			return false
+		}
+	}
+	if st.upload {
+		st.uploads = policies
+	}
+	return true
+}
+
+func policyStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUploadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUploadInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrScanFailed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnsupportedMediaType
+}
+
+// policyWriter replaces the reply of the handler when an upload policy
+// was violated or the upload was flagged, as the handler does not know
+// about them.
+type policyWriter struct {
+	http.ResponseWriter
+	st       *requestState
+	replaced bool
+}
+
+func (w *policyWriter) WriteHeader(status int) {
+	if status >= 400 && w.st.violation != nil {
+		w.replaced = true
+		http.Error(w.ResponseWriter, w.st.violation.Error(), policyStatus(w.st.violation))
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *policyWriter) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *policyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// uploadStagingPrefix starts the names of the files uploads are written
+// to until they are checked. WebDavDir hides them.
+const uploadStagingPrefix = ".upload-"
+
+// uploadStaging reports whether name is the file of an upload being
+// checked.
+func uploadStaging(name string) bool {
+	return strings.HasPrefix(path.Base(path.Clean("/"+name)), uploadStagingPrefix)
+}
+
+// stagingDir hides the uploads being checked from the listings.
+type stagingDir struct {
+	webdav.File
+}
+
+func (d stagingDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	entries := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), uploadStagingPrefix) {
+			entries = append(entries, info)
+		}
+	}
+	return entries, err
+}
+
+// openUpload opens name for an upload subject to policies or scanning.
+// The content is written to a temporary file next to name, which
+// replaces name when closed if no policy was violated and the scanner
+// let it through, and is removed otherwise.
+func (d WebDavDir) openUpload(ctx context.Context, name string, flag int, perm os.FileMode, st *requestState) (webdav.File, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	name = path.Clean("/" + name)
+	tmp := path.Join(path.Dir(name), uploadStagingPrefix+hex.EncodeToString(id)+"-"+path.Base(name))
+
+	f, err := d.files().OpenFile(ctx, tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	u := &uploadFile{File: f, dir: d.files(), local: d.Dir, ctx: ctx, name: name, tmp: tmp, st: st, scanning: d.Scanning, auditor: d.Audit}
+	if flag&os.O_TRUNC == 0 {
+		// Start from the current content, as the handler expects.
+		if err := u.copyCurrent(); err != nil {
+			u.discard()
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// uploadFile enforces the upload policies of st while it is written, and
+// has it scanned when closed.
+type uploadFile struct {
+	webdav.File
+	dir       webdav.FileSystem
+	local     webdav.Dir
+	ctx       context.Context
+	name, tmp string
+	st        *requestState
+	scanning  *Scanning
+	auditor   Auditor
+
+	n       int64
+	head    []byte
+	checked bool
+}
+
+func (f *uploadFile) copyCurrent() error {
+	src, err := f.dir.OpenFile(f.ctx, f.name, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(f, src)
+	return err
+}
+
+func (f *uploadFile) Write(p []byte) (int, error) {
+	if f.st.violation != nil {
+		return 0, f.st.violation
+	}
+	f.n += int64(len(p))
+	for _, pol := range f.st.uploads {
+		if pol.MaxSize > 0 && f.n > pol.MaxSize {
+			return 0, f.fail(ErrUploadTooLarge)
+		}
+	}
+	if !f.checked {
+		f.head = append(f.head, p[:min(len(p), 512-len(f.head))]...)
+		if len(f.head) == 512 {
+			if err := f.checkType(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return f.File.Write(p)
+}
+
+// checkType checks the type detected from the head of the content.
+func (f *uploadFile) checkType() error {
+	f.checked = true
+	contentType := http.DetectContentType(f.head)
+	for _, pol := range f.st.uploads {
+		if err := pol.checkType(contentType); err != nil {
+			return f.fail(err)
+		}
+	}
+	return nil
+}
+
+func (f *uploadFile) fail(err error) error {
+	f.st.violation = err
+	return err
+}
+
+func (f *uploadFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return renamedInfo{info, path.Base(f.name)}, nil
+}
+
+func (f *uploadFile) Close() error {
+	if f.st.violation == nil && !f.checked {
+		f.checkType()
+	}
+	if f.st.violation != nil {
+		f.discard()
+		return f.st.violation
+	}
+	if err := f.File.Close(); err != nil {
+		f.dir.RemoveAll(f.ctx, f.tmp)
+		return err
+	}
+	if f.scanning == nil {
+		return f.dir.Rename(f.ctx, f.tmp, f.name)
+	}
+
+	v, err := f.scanning.scan(f)
+	if err != nil {
+		f.dir.RemoveAll(f.ctx, f.tmp)
+		return f.fail(err)
+	}
+	if err := f.dir.Rename(f.ctx, f.tmp, f.name); err != nil {
+		return err
+	}
+	if f.scanning.Verdicts != nil {
+		if err := f.scanning.Verdicts.Put(localPath(f.local, f.name), v); err != nil {
+			logger.DefaultLogger.Warn("store verdict of " + f.name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (f *uploadFile) audit(ev AuditEvent) {
+	if f.auditor != nil {
+		f.auditor.Audit(ev)
+		return
+	}
+	(&LogAuditor{}).Audit(ev)
+}
+
+// discard closes and removes the temporary file.
+func (f *uploadFile) discard() {
+	f.File.Close()
+	f.dir.RemoveAll(f.ctx, f.tmp)
+}
@@ -0,0 +1,111 @@
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadPolicyCheck(t *testing.T) {
+	p := UploadPolicy{
+		AllowedExtensions: []string{".JPG", "png"},
+		DeniedTypes:       []string{"image/gif", "text/*"},
+	}
+	tests := []struct {
+		name, contentType string
+		ok                bool
+	}{
+		{"/a.jpg", "image/jpeg", true},
+		{"/a.PNG", "image/png", true},
+		{"/a.gif", "image/png", false},
+		{"/a.png", "image/gif", false},
+		{"/a.png", "text/plain; charset=utf-8", false},
+	}
+	for _, tt := range tests {
+		err := p.checkName(tt.name)
+		if err == nil {
+			err = p.checkType(tt.contentType)
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %s: expected ok=%t, got %v", tt.name, tt.contentType, tt.ok, err)
+		}
+	}
+}
+
+func TestConfigServeHTTPUploadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "keep.txt"), []byte("original"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "images"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := testConfig(t, `{"scope": "`+dir+`", "modify": true,
+		"uploadPolicies": [{"maxSize": 10, "deniedExtensions": ["exe"]}],
+		"users": [{"username": "bob", "password": "bob", "uploadPolicies": [{"path": "/images", "allowedTypes": ["image/*"]}]}]}`)
+	do := func(method, target, body string, header map[string]string, chunked bool) int {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if chunked {
+			r.ContentLength = -1
+		}
+		r.SetBasicAuth("bob", "bob")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	png := "\x89PNG\r\n\x1a\n"
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		header  map[string]string
+		chunked bool
+		status  int
+	}{
+		{"allowed", "PUT", "/ok.txt", "ok", nil, false, http.StatusCreated},
+		{"denied extension", "PUT", "/run.exe", "x", nil, false, http.StatusUnsupportedMediaType},
+		{"declared size", "PUT", "/big.txt", "0123456789abc", nil, false, http.StatusRequestEntityTooLarge},
+		{"streamed size", "PUT", "/big.txt", "0123456789abc", nil, true, http.StatusRequestEntityTooLarge},
+		{"overwrite too large", "PUT", "/keep.txt", "0123456789abc", nil, true, http.StatusRequestEntityTooLarge},
+		{"detected type", "PUT", "/images/fake.png", "text", nil, false, http.StatusUnsupportedMediaType},
+		{"image", "PUT", "/images/real.png", png, nil, false, http.StatusCreated},
+		{"renamed to denied extension", "MOVE", "/ok.txt", "", map[string]string{"Destination": "/ok.exe"}, false, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := do(tt.method, tt.target, tt.body, tt.header, tt.chunked); status != tt.status {
+				t.Errorf("expected %d, got %d", tt.status, status)
+			}
+		})
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dir, "keep.txt")); string(data) != "original" {
+		t.Errorf("expected a refused upload to keep the file, got %q", data)
+	}
+	for _, name := range []string{"big.txt", "images/fake.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected no %s, got %v", name, err)
+		}
+	}
+	var left []string
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), ".upload-") {
+			left = append(left, p)
+		}
+		return nil
+	})
+	if len(left) > 0 {
+		t.Errorf("expected the partial uploads to be removed, got %v", left)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "images", "real.png")); string(data) != png {
+		t.Errorf("expected the image to be stored, got %q", data)
+	}
+}
@@ -0,0 +1,182 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the request rate and the bandwidth of a user. Zero
+// values mean unlimited.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	// Burst is the number of requests that may exceed the rate at once,
+	// RequestsPerSecond rounded up when zero.
+	Burst                  int   `json:"burst,omitempty"`
+	UploadBytesPerSecond   int64 `json:"uploadBytesPerSecond,omitempty"`
+	DownloadBytesPerSecond int64 `json:"downloadBytesPerSecond,omitempty"`
+}
+
+// tokenBucket is a token bucket refilled continuously at rate tokens per
+// second up to burst tokens.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = math.Ceil(rate)
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long
+// the caller must wait for the debt to be paid off.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes a token if one is available, otherwise it reports how long
+// until one is.
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// wait blocks until n tokens were taken from the bucket.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	delay := b.reserve(float64(n), time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chunk is the largest amount of bytes moved before waiting.
+func (b *tokenBucket) chunk() int {
+	return max(int(b.burst), 512)
+}
+
+// rateLimiter holds the buckets of one user.
+type rateLimiter struct {
+	limit    RateLimit
+	requests *tokenBucket
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+func newRateLimiter(l RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:    l,
+		requests: newTokenBucket(l.RequestsPerSecond, float64(l.Burst)),
+		upload:   newTokenBucket(float64(l.UploadBytesPerSecond), 0),
+		download: newTokenBucket(float64(l.DownloadBytesPerSecond), 0),
+	}
+}
+
+// limiter returns the rate limiter of u, nil when it is unlimited.
+func (c *Config) limiter(u *User) *rateLimiter {
+	limit := c.RateLimit
+	if u.RateLimit != nil {
+		limit = *u.RateLimit
+	}
+	if limit == (RateLimit{}) {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.limiters[u.Username]
+	if !ok || l.limit != limit {
+		l = newRateLimiter(limit)
+		if c.limiters == nil {
+			c.limiters = map[string]*rateLimiter{}
+		}
+		c.limiters[u.Username] = l
+	}
+	return l
+}
+
+// throttledWriter limits the bandwidth of a response.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (w throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), w.bucket.chunk())
+		if err := w.bucket.wait(w.ctx, n); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledBody limits the bandwidth of a request body.
+type throttledBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (b throttledBody) Read(p []byte) (int, error) {
+	if len(p) > b.bucket.chunk() {
+		p = p[:b.bucket.chunk()]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.bucket.wait(b.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,79 @@
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2024, 10, 18, 12, 0, 0, 0, time.UTC)
+	b := newTokenBucket(2, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.allow(now); !ok {
+			t.Fatalf("expected burst to be allowed")
+		}
+	}
+	if ok, wait := b.allow(now); ok || wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ := b.allow(now.Add(500 * time.Millisecond)); !ok {
+		t.Errorf("expected refilled token to be allowed")
+	}
+
+	bytes := newTokenBucket(1000, 0)
+	if wait := bytes.reserve(1500, now); wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms for the debt, got %v", wait)
+	}
+
+	if newTokenBucket(0, 10) != nil {
+		t.Errorf("expected no bucket for unlimited rate")
+	}
+}
+
+func TestConfigServeHTTPRateLimit(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(strings.Repeat("x", 1500)), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := testConfig(t, `{
+		"scope": "`+dir+`",
+		"modify": true,
+		"rateLimit": {"requestsPerSecond": 1, "burst": 2},
+		"users": [
+			{"username": "alice", "password": "a"},
+			{"username": "bob", "password": "b", "rateLimit": {"downloadBytesPerSecond": 1000}}
+		]
+	}`)
+
+	do := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/file.txt", nil)
+		r.SetBasicAuth(user, user[:1])
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do("alice"); w.Code != http.StatusOK {
+			t.Errorf("expected burst to be served, got %d", w.Code)
+		}
+	}
+	if w := do("alice"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected rate limit, got %d", w.Code)
+	}
+
+	start := time.Now()
+	if w := do("bob"); w.Code != http.StatusOK || w.Body.Len() != 1500 {
+		t.Errorf("expected throttled download, got %d %d", w.Code, w.Body.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected download to be throttled, took %v", elapsed)
+	}
+}
@@ -0,0 +1,284 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wwqdrh/gokit/logger"
+	"golang.org/x/net/webdav"
+)
+
+// ErrInvalidConfig is returned by Reloader.Update when the changed
+// configuration does not build.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Reloader serves the configuration loaded from a file and replaces it,
+// without dropping the requests in flight, when the file changes or
+// Reload is called. A file that does not parse or build is rejected and
+// the current configuration kept.
+type Reloader struct {
+	Path string
+
+	current atomic.Pointer[Config]
+	file    atomic.Pointer[FileConfig]
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// NewReloader loads the configuration at path.
+func NewReloader(path string) (*Reloader, error) {
+	rl := &Reloader{Path: path}
+	if err := rl.Reload(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// Config returns the configuration in use.
+func (rl *Reloader) Config() *Config {
+	return rl.current.Load()
+}
+
+// FileConfig returns the file the configuration in use was built from.
+func (rl *Reloader) FileConfig() *FileConfig {
+	return rl.file.Load()
+}
+
+// Reload loads the file and swaps it in. The handlers of the scopes that
+// are still mounted the same way are kept, and so are their locks, along
+// with the rate limiters, the login throttling state, the share links
+// and the metrics.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	info, err := os.Stat(rl.Path)
+	if err != nil {
+		return err
+	}
+	fc, err := LoadConfig(rl.Path)
+	if err != nil {
+		return err
+	}
+	cfg, err := fc.Build()
+	if err != nil {
+		return err
+	}
+	rl.swap(fc, cfg, info)
+	return nil
+}
+
+// Update applies fn to a copy of the file configuration and, when the
+// result builds, writes it back to the file and swaps it in.
+func (rl *Reloader) Update(fn func(fc *FileConfig) error) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	data, err := json.Marshal(rl.file.Load())
+	if err != nil {
+		return err
+	}
+	fc := &FileConfig{}
+	if err := json.Unmarshal(data, fc); err != nil {
+		return err
+	}
+	if err := fn(fc); err != nil {
+		return err
+	}
+	cfg, err := fc.Build()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if data, err = json.MarshalIndent(fc, "", "  "); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(rl.Path, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	info, err := os.Stat(rl.Path)
+	if err != nil {
+		return err
+	}
+	rl.swap(fc, cfg, info)
+	return nil
+}
+
+// swap makes cfg, built from fc, the configuration in use. It must be
+// called with mu held.
+func (rl *Reloader) swap(fc *FileConfig, cfg *Config, info os.FileInfo) {
+	cfg.reloader = rl
+
+	if old := rl.current.Load(); old != nil {
+		if prev := rl.file.Load(); prev.Address != fc.Address || prev.Port != fc.Port {
+			logger.DefaultLogger.Warn("the listen address only changes on restart")
+		}
+		cfg.inherit(old)
+		cfg.audit(AuditEvent{Type: "reload", Detail: rl.Path})
+	}
+	cfg.startEvents()
+
+	rl.modTime = info.ModTime()
+	rl.file.Store(fc)
+	rl.current.Store(cfg)
+}
+
+// Watch reloads the configuration whenever the modification time of the
+// file changes, checking every interval until ctx is done. Failed
+// reloads are logged.
+func (rl *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		info, err := os.Stat(rl.Path)
+		if err != nil {
+			continue
+		}
+		rl.mu.Lock()
+		changed := !info.ModTime().Equal(rl.modTime)
+		rl.mu.Unlock()
+		if !changed {
+			continue
+		}
+
+		if err := rl.Reload(); err != nil {
+			logger.DefaultLogger.Error("reload " + rl.Path + ": " + err.Error())
+			// Do not retry the same broken file on every tick.
+			rl.mu.Lock()
+			rl.modTime = info.ModTime()
+			rl.mu.Unlock()
+		} else {
+			logger.DefaultLogger.Info("reloaded " + rl.Path)
+		}
+	}
+}
+
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.Config().ServeHTTP(w, r)
+}
+
+// inherit takes over the state of old that is still valid for c.
+func (c *Config) inherit(old *Config) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The audit log stays open as long as it is the same file.
+	if a, ok := c.Audit.(*FileAuditor); ok {
+		if oa, ok := old.Audit.(*FileAuditor); ok && oa.Path == a.Path {
+			c.Audit = oa
+		}
+	}
+	if oa, ok := old.Audit.(*FileAuditor); ok && c.Audit != old.Audit {
+		oa.Close()
+	}
+
+	// Handlers over a Backend, scanning uploads or committing changes are
+	// rebuilt, as those may have changed, and so are those auditing
+	// elsewhere. The locks of the scopes are kept either way.
+	if c.Prefix == old.Prefix && c.NoSniff == old.NoSniff && c.BrowseArchives == old.BrowseArchives &&
+		c.Backend == nil && old.Backend == nil && c.Scanning == nil && old.Scanning == nil &&
+		bytes.Equal(c.MasterKey, old.MasterKey) && c.Git == nil && old.Git == nil && c.Audit == old.Audit {
+		for scope, h := range old.handlers {
+			if c.handlers == nil {
+				c.handlers = map[string]*webdav.Handler{}
+			}
+			c.handlers[scope] = h
+		}
+	} else {
+		for _, h := range old.handlers {
+			retire(h.FileSystem)
+		}
+	}
+	for key, ls := range old.locks {
+		if c.locks == nil {
+			c.locks = map[string]webdav.LockSystem{}
+		}
+		c.locks[key] = ls
+	}
+	for username, l := range old.limiters {
+		if c.limiters == nil {
+			c.limiters = map[string]*rateLimiter{}
+		}
+		c.limiters[username] = l
+	}
+
+	if c.Guard != nil && old.Guard != nil {
+		c.Guard.inherit(old.Guard)
+	}
+	if c.Shares != nil && old.Shares != nil &&
+		c.Shares.Path == old.Shares.Path && bytes.Equal(c.Shares.Secret, old.Shares.Secret) {
+		c.Shares = old.Shares
+	}
+	if c.Metrics != nil && old.Metrics != nil {
+		c.Metrics = old.Metrics
+	}
+	c.sessions = old.sessions
+	c.archives = old.archives
+	// Subscribers reconnect to pick up the changes to their user.
+	if old.broker != nil {
+		old.broker.closeAll()
+	}
+
+	// Hooks handling the events the same way keep their queue and
+	// workers; the others stop.
+	reused := make([]bool, len(old.Events))
+	for i, s := range c.Events {
+		for j, prev := range old.Events {
+			if !reused[j] && sameSink(s, prev) {
+				c.Events[i] = prev
+				reused[j] = true
+				break
+			}
+		}
+	}
+	for j, prev := range old.Events {
+		if h, ok := prev.(interface{ Close() }); ok && !reused[j] {
+			h.Close()
+		}
+	}
+}
+
+// sameSink reports whether the hooks a and b handle the same events the
+// same way.
+func sameSink(a, b EventSink) bool {
+	switch a := a.(type) {
+	case *Webhook:
+		b, ok := b.(*Webhook)
+		return ok && a.same(b)
+	case *Command:
+		b, ok := b.(*Command)
+		return ok && a.same(b)
+	}
+	return false
+}
+
+// retire commits the changes a replaced file system still holds, so that
+// the one replacing it does not commit in the same repository alongside.
+func retire(fs webdav.FileSystem) {
+	switch fs := fs.(type) {
+	case *GitFS:
+		fs.Close()
+	case *MountFS:
+		for _, m := range fs.mounts {
+			retire(m.FileSystem)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	scope := filepath.Join(dir, "data")
+	if err := os.Mkdir(scope, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(dir, "config.json")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	status := func(rl *Reloader, method, user string) int {
+		r := httptest.NewRequest(method, "/", nil)
+		r.SetBasicAuth(user, user)
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	write(`{"scope": "` + scope + `", "metrics": true,
+		"users": [{"username": "bob", "password": "bob"}]}`)
+	rl, err := NewReloader(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := status(rl, "PROPFIND", "bob"); got != http.StatusMultiStatus {
+		t.Fatalf("expected bob to be served, got %d", got)
+	}
+	if got := status(rl, "PROPFIND", "alice"); got != http.StatusUnauthorized {
+		t.Fatalf("expected alice to be unknown, got %d", got)
+	}
+	old := rl.Config()
+
+	write(`{"scope": "` + scope + `", "metrics": true, "users": [
+		{"username": "bob", "password": "bob", "rules": [{"path": "/", "allow": false}]},
+		{"username": "alice", "password": "alice"}
+	]}`)
+	if err := rl.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := rl.Config()
+	if cfg == old {
+		t.Fatal("expected the configuration to be replaced")
+	}
+	if got := status(rl, "PROPFIND", "bob"); got != http.StatusForbidden {
+		t.Errorf("expected the new rules of bob to apply, got %d", got)
+	}
+	if got := status(rl, "PROPFIND", "alice"); got != http.StatusMultiStatus {
+		t.Errorf("expected alice to be served, got %d", got)
+	}
+	if cfg.handlers[scope] != old.handlers[scope] {
+		t.Error("expected the handler of the unchanged scope to be kept")
+	}
+	if cfg.Metrics != old.Metrics {
+		t.Error("expected the metrics to be kept")
+	}
+
+	write(`{"users": [{"username": "bob", "groups": ["missing"]}]}`)
+	if err := rl.Reload(); err == nil {
+		t.Error("expected an invalid configuration to be rejected")
+	}
+	if rl.Config() != cfg {
+		t.Error("expected the configuration to be kept")
+	}
+
+	write(`{"scope": "` + scope + `", "users": [{"username": "carol", "password": "carol"}]}`)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.Watch(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for status(rl, "PROPFIND", "carol") != http.StatusMultiStatus {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the changed file to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloaderAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	write := func(log string) {
+		t.Helper()
+		data := `{"scope": "` + dir + `", "auditLog": "` + filepath.Join(dir, log) + `",
+			"users": [{"username": "bob", "password": "bob"}]}`
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	write("audit.log")
+	rl, err := NewReloader(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := rl.Config().Audit.(*FileAuditor)
+	if _, err := os.Stat(first.Path); !os.IsNotExist(err) {
+		t.Errorf("expected the audit log to be opened with the first event, got %v", err)
+	}
+
+	// Each reload records an event in the same file.
+	for i := 0; i < 3; i++ {
+		if err := rl.Reload(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rl.Config().Audit != first {
+			t.Fatal("expected the audit log to be kept")
+		}
+	}
+	if data, _ := os.ReadFile(first.Path); len(strings.Split(strings.TrimSpace(string(data)), "\n")) != 3 {
+		t.Errorf("expected the reloads in the audit log, got %q", data)
+	}
+
+	write("other.log")
+	if err := rl.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rl.Config().Audit == first {
+		t.Fatal("expected the audit log to change")
+	}
+	first.mu.Lock()
+	closed := first.f == nil
+	first.mu.Unlock()
+	if !closed {
+		t.Error("expected the previous audit log to be closed")
+	}
+}
+
+func TestReloaderGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	scope := filepath.Join(dir, "data")
+	if err := os.Mkdir(scope, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(dir, "config.json")
+	data := `{"scope": "` + scope + `", "modify": true, "git": {"window": "1h"},
+		"users": [{"username": "bob", "password": "bob"}]}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl, err := NewReloader(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("bob", "bob")
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("PUT", "/a.txt", "draft"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the upload to succeed, got %d", w.Code)
+	}
+	lock := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+	w := do("LOCK", "/a.txt", lock, "Timeout", "Second-3600")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the lock to be granted, got %d", w.Code)
+	}
+	token := w.Header().Get("Lock-Token")
+
+	if err := rl.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if log := gitLog(t, scope); len(log) != 2 || log[0] != "bob: Update /a.txt" {
+		t.Errorf("expected the pending change to be committed by the reload, got %q", log)
+	}
+	if w := do("PUT", "/a.txt", "final"); w.Code != http.StatusLocked {
+		t.Errorf("expected the lock to be kept, got %d", w.Code)
+	}
+	if w := do("PUT", "/a.txt", "final", "If", "("+token+")"); w.Code != http.StatusNoContent && w.Code != http.StatusCreated {
+		t.Errorf("expected the lock holder to write, got %d", w.Code)
+	}
+}
@@ -0,0 +1,376 @@
+package webdav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/gokit/logger"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	// ErrUploadInfected is returned for an upload its scanner flagged.
+	ErrUploadInfected = errors.New("upload flagged by the scanner")
+	// ErrScanFailed is returned for an upload that could not be scanned.
+	ErrScanFailed = errors.New("upload could not be scanned")
+)
+
+// ScanVerdictProperty is the property reporting the verdict of the scan
+// of a file, such as "clean".
+var ScanVerdictProperty = xml.Name{Space: "urn:x-webdav:scan", Local: "verdict"}
+
+// Verdict is the outcome of a scan.
+type Verdict struct {
+	Clean bool `json:"clean"`
+	// Threat names what was found in a file that is not clean.
+	Threat  string    `json:"threat,omitempty"`
+	Scanner string    `json:"scanner"`
+	Time    time.Time `json:"time"`
+	// Error is set instead when the scan failed.
+	Error string `json:"error,omitempty"`
+}
+
+func (v Verdict) String() string {
+	switch {
+	case v.Error != "":
+		return "unscanned: " + v.Error
+	case v.Clean:
+		return "clean"
+	}
+	return "infected: " + v.Threat
+}
+
+// Scanner checks the content of an uploaded file, name being its path
+// in the scope it is uploaded to.
+type Scanner interface {
+	Scan(ctx context.Context, name string, r io.Reader) (Verdict, error)
+}
+
+// Scanning checks the files uploaded with PUT before they become
+// visible. Flagged files are moved to Quarantine, along with their
+// verdict, or deleted when it is empty. Files that cannot be scanned are
+// refused unless FailOpen is set.
+type Scanning struct {
+	Scanner    Scanner
+	Quarantine string
+	FailOpen   bool
+	// Verdicts, when not nil, keeps the verdicts of the published files
+	// for ScanVerdictProperty.
+	Verdicts *VerdictStore
+}
+
+// scan checks the temporary file of an upload. It returns the verdict of
+// a file to publish, and quarantines the others.
+func (s *Scanning) scan(f *uploadFile) (Verdict, error) {
+	r, err := f.dir.OpenFile(f.ctx, f.tmp, os.O_RDONLY, 0)
+	if err != nil {
+		return Verdict{}, err
+	}
+	v, err := s.Scanner.Scan(f.ctx, f.name, r)
+	r.Close()
+	if err != nil {
+		v = Verdict{Error: err.Error(), Time: time.Now()}
+	} else if v.Time.IsZero() {
+		v.Time = time.Now()
+	}
+	f.audit(AuditEvent{Type: "scan", Username: f.st.user, Path: f.name, Detail: v.String()})
+
+	switch {
+	case err != nil && s.FailOpen:
+		return v, nil
+	case err != nil:
+		f.dir.RemoveAll(f.ctx, f.tmp)
+		return v, fmt.Errorf("%w: %v", ErrScanFailed, err)
+	case v.Clean:
+		return v, nil
+	}
+
+	if err := s.quarantine(f, v); err != nil {
+		logger.DefaultLogger.Error("quarantine " + f.name + ": " + err.Error())
+		f.dir.RemoveAll(f.ctx, f.tmp)
+	}
+	return v, fmt.Errorf("%w: %s", ErrUploadInfected, v.Threat)
+}
+
+// quarantine moves a flagged upload to the quarantine directory, with
+// its verdict in a JSON file alongside.
+func (s *Scanning) quarantine(f *uploadFile, v Verdict) error {
+	if s.Quarantine == "" {
+		return f.dir.RemoveAll(f.ctx, f.tmp)
+	}
+	if err := os.MkdirAll(s.Quarantine, 0700); err != nil {
+		return err
+	}
+
+	base := fmt.Sprintf("%s-%s", v.Time.UTC().Format("20060102T150405.000000000"), path.Base(f.name))
+	dst := filepath.Join(s.Quarantine, base)
+	// Encrypted uploads stay encrypted there.
+	src := localPath(f.local, f.tmp)
+	if err := os.Rename(src, dst); err != nil {
+		// The quarantine may be on another file system.
+		if err := copyLocalFile(src, dst); err != nil {
+			return err
+		}
+		os.Remove(src)
+	}
+
+	data, err := json.MarshalIndent(struct {
+		Path     string  `json:"path"`
+		Username string  `json:"username,omitempty"`
+		Verdict  Verdict `json:"verdict"`
+	}{f.name, f.st.user, v}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst+".json", data, 0600)
+}
+
+// localPath returns the path on disk of name in d.
+func localPath(d webdav.Dir, name string) string {
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func copyLocalFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// VerdictStore keeps the verdicts of files on disk, in the JSON file at
+// Path when it is not empty. A verdict is dropped once its file changes.
+type VerdictStore struct {
+	Path string
+
+	mu       sync.Mutex
+	verdicts map[string]storedVerdict
+}
+
+type storedVerdict struct {
+	Verdict Verdict   `json:"verdict"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// NewVerdictStore loads the verdicts stored at path, if any.
+func NewVerdictStore(path string) (*VerdictStore, error) {
+	s := &VerdictStore{Path: path, verdicts: map[string]storedVerdict{}}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.verdicts); err != nil {
+		return nil, err
+	}
+	// Forget the files that changed while the server was down.
+	for file, sv := range s.verdicts {
+		if info, err := os.Stat(file); err != nil || !sv.matches(info) {
+			delete(s.verdicts, file)
+		}
+	}
+	return s, nil
+}
+
+func (sv storedVerdict) matches(info os.FileInfo) bool {
+	return sv.Size == info.Size() && sv.ModTime.Equal(info.ModTime())
+}
+
+// Get returns the verdict of the file at the local path file.
+func (s *VerdictStore) Get(file string) (Verdict, bool) {
+	s.mu.Lock()
+	sv, ok := s.verdicts[file]
+	s.mu.Unlock()
+	if !ok {
+		return Verdict{}, false
+	}
+	if info, err := os.Stat(file); err != nil || !sv.matches(info) {
+		return Verdict{}, false
+	}
+	return sv.Verdict, true
+}
+
+// Put records the verdict of the file at the local path file.
+func (s *VerdictStore) Put(file string, v Verdict) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verdicts[file] = storedVerdict{Verdict: v, Size: info.Size(), ModTime: info.ModTime()}
+	if s.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.verdicts)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, data, 0600)
+}
+
+// scannedFile reports the verdict of a file as a dead property.
+type scannedFile struct {
+	webdav.File
+	verdict Verdict
+}
+
+func (f scannedFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(f.verdict.String()))
+	return map[xml.Name]webdav.Property{
+		ScanVerdictProperty: {XMLName: ScanVerdictProperty, InnerXML: []byte(b.String())},
+	}, nil
+}
+
+// Patch refuses every change, as files without dead properties do.
+func (f scannedFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	st := webdav.Propstat{Status: 403}
+	for _, p := range patches {
+		for _, prop := range p.Props {
+			st.Props = append(st.Props, webdav.Property{XMLName: prop.XMLName})
+		}
+	}
+	return []webdav.Propstat{st}, nil
+}
+
+// ClamdScanner scans with a clamd daemon, using its INSTREAM command.
+// Network is "unix" or "tcp".
+type ClamdScanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// clamdChunk is the size of the chunks streamed to clamd.
+const clamdChunk = 32 * 1024
+
+func (s *ClamdScanner) Scan(ctx context.Context, name string, r io.Reader) (Verdict, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriterSize(conn, clamdChunk+4)
+	w.WriteString("zINSTREAM\x00")
+	buf := make([]byte, clamdChunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.Write(w, binary.BigEndian, uint32(n))
+			w.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Verdict{}, err
+		}
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return Verdict{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return Verdict{}, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses replies such as "stream: OK" and
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (Verdict, error) {
+	_, result, _ := strings.Cut(reply, ": ")
+	switch {
+	case result == "OK":
+		return Verdict{Clean: true, Scanner: "clamd"}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{Threat: strings.TrimSuffix(result, " FOUND"), Scanner: "clamd"}, nil
+	}
+	return Verdict{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// ExecScanner scans with a command reading the content on its standard
+// input, with the path of the file in WEBDAV_PATH. Exit status 0 means
+// clean and 1 flagged, the first line of the output naming the threat,
+// as with clamdscan; other statuses are failures.
+type ExecScanner struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (s *ExecScanner) Scan(ctx context.Context, name string, r io.Reader) (Verdict, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.Path, s.Args...)
+	cmd.Stdin, cmd.Stdout = r, &out
+	cmd.Env = append(os.Environ(), "WEBDAV_PATH="+name)
+	err := cmd.Run()
+
+	v := Verdict{Scanner: path.Base(s.Path)}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		v.Clean = true
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		v.Threat, _, _ = strings.Cut(strings.TrimSpace(out.String()), "\n")
+		if v.Threat == "" {
+			v.Threat = "flagged"
+		}
+	default:
+		return Verdict{}, err
+	}
+	return v, nil
+}
@@ -0,0 +1,244 @@
+package webdav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubScanner flags the content containing "EICAR" and fails on
+// "FAIL".
+type stubScanner struct{}
+
+func (stubScanner) Scan(ctx context.Context, name string, r io.Reader) (Verdict, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Verdict{}, err
+	}
+	switch {
+	case bytes.Contains(data, []byte("FAIL")):
+		return Verdict{}, errors.New("scanner unavailable")
+	case bytes.Contains(data, []byte("EICAR")):
+		return Verdict{Threat: "Eicar-Test-Signature", Scanner: "stub"}, nil
+	}
+	return Verdict{Clean: true, Scanner: "stub"}, nil
+}
+
+// serveClamd answers the INSTREAM commands on l like clamd, flagging the
+// streams containing "EICAR".
+func serveClamd(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+				t.Errorf("unexpected command %q %v", cmd, err)
+				return
+			}
+			var data []byte
+			for {
+				var n uint32
+				if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+					return
+				}
+				if n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				if _, err := io.ReadFull(r, chunk); err != nil {
+					return
+				}
+				data = append(data, chunk...)
+			}
+			if bytes.Contains(data, []byte("EICAR")) {
+				io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				return
+			}
+			io.WriteString(conn, "stream: OK\x00")
+		}()
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	go serveClamd(t, l)
+
+	s := &ClamdScanner{Network: "tcp", Address: l.Addr().String()}
+	tests := []struct {
+		content string
+		want    Verdict
+	}{
+		{strings.Repeat("clean ", clamdChunk), Verdict{Clean: true, Scanner: "clamd"}},
+		{"X5O!P%@AP EICAR", Verdict{Threat: "Eicar-Test-Signature", Scanner: "clamd"}},
+	}
+	for _, tt := range tests {
+		v, err := s.Scan(context.Background(), "/a.txt", strings.NewReader(tt.content))
+		if err != nil || v != tt.want {
+			t.Errorf("expected %+v, got %+v %v", tt.want, v, err)
+		}
+	}
+
+	if _, err := parseClamdReply("stream: INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Errorf("expected an error reply to fail the scan")
+	}
+}
+
+func TestExecScanner(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no shell")
+	}
+	s := &ExecScanner{Path: "/bin/sh", Args: []string{"-c", `
+		case "$(cat)" in
+		*EICAR*) echo "Eicar in $WEBDAV_PATH"; exit 1;;
+		*FAIL*) exit 2;;
+		esac`}}
+
+	if v, err := s.Scan(context.Background(), "/a.txt", strings.NewReader("hello")); err != nil || !v.Clean {
+		t.Errorf("expected a clean verdict, got %+v %v", v, err)
+	}
+	if v, err := s.Scan(context.Background(), "/a.txt", strings.NewReader("EICAR")); err != nil || v.Clean || v.Threat != "Eicar in /a.txt" {
+		t.Errorf("expected a flagged verdict, got %+v %v", v, err)
+	}
+	if _, err := s.Scan(context.Background(), "/a.txt", strings.NewReader("FAIL")); err == nil {
+		t.Errorf("expected the scan to fail")
+	}
+}
+
+func TestConfigServeHTTPScanning(t *testing.T) {
+	dir, quarantine := t.TempDir(), t.TempDir()
+	cfg := testConfig(t, `{"scope": "`+dir+`", "modify": true, "users": [{"username": "bob", "password": "bob"}]}`)
+	verdicts, err := NewVerdictStore(filepath.Join(t.TempDir(), "verdicts.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg.Scanning = &Scanning{Scanner: stubScanner{}, Quarantine: quarantine, Verdicts: verdicts}
+	var audit bytes.Buffer
+	cfg.Audit = &LogAuditor{W: &audit}
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("bob", "bob")
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("PUT", "/clean.txt", "hello"); w.Code != http.StatusCreated {
+		t.Errorf("expected a clean upload, got %d", w.Code)
+	}
+	if w := do("PUT", "/virus.txt", "EICAR"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected the flagged upload to be refused, got %d", w.Code)
+	}
+	if w := do("PUT", "/unscanned.txt", "FAIL"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the unscanned upload to be refused, got %d", w.Code)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "clean.txt" {
+		t.Errorf("expected only the clean file to be visible, got %v", entries)
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(quarantine, "*-virus.txt"))
+	if len(quarantined) != 1 {
+		t.Fatalf("expected the flagged file in quarantine, got %v", quarantined)
+	}
+	if data, _ := os.ReadFile(quarantined[0]); string(data) != "EICAR" {
+		t.Errorf("expected the quarantined content, got %q", data)
+	}
+	if data, _ := os.ReadFile(quarantined[0] + ".json"); !strings.Contains(string(data), "Eicar-Test-Signature") {
+		t.Errorf("expected the verdict next to the quarantined file, got %s", data)
+	}
+	if !strings.Contains(audit.String(), `"detail":"infected: Eicar-Test-Signature"`) || !strings.Contains(audit.String(), `"detail":"clean"`) {
+		t.Errorf("expected the verdicts in the audit log, got %s", audit.String())
+	}
+
+	body := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><S:verdict xmlns:S="urn:x-webdav:scan"/></D:prop></D:propfind>`
+	if w := do("PROPFIND", "/clean.txt", body); !strings.Contains(w.Body.String(), ">clean</") {
+		t.Errorf("expected the verdict property, got %s", w.Body)
+	}
+
+	cfg.Scanning.FailOpen = true
+	if w := do("PUT", "/unscanned.txt", "FAIL"); w.Code != http.StatusCreated {
+		t.Errorf("expected the unscanned upload to be accepted, got %d", w.Code)
+	}
+	if w := do("PROPFIND", "/unscanned.txt", body); !strings.Contains(w.Body.String(), ">unscanned: scanner unavailable</") {
+		t.Errorf("expected the failure in the verdict property, got %s", w.Body)
+	}
+}
+
+// blockingScanner waits for release before passing the content.
+type blockingScanner struct {
+	started, release chan struct{}
+}
+
+func (s blockingScanner) Scan(ctx context.Context, name string, r io.Reader) (Verdict, error) {
+	close(s.started)
+	<-s.release
+	return Verdict{Clean: true}, nil
+}
+
+func TestConfigServeHTTPScanningHidden(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, `{"scope": "`+dir+`", "modify": true, "users": [{"username": "bob", "password": "bob"}]}`)
+	s := blockingScanner{started: make(chan struct{}), release: make(chan struct{})}
+	cfg.Scanning = &Scanning{Scanner: s}
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("bob", "bob")
+		r.Header.Set("Depth", "1")
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan int)
+	go func() { done <- do("PUT", "/a.txt", "hello").Code }()
+	<-s.started
+
+	staged, _ := filepath.Glob(filepath.Join(dir, ".upload-*"))
+	if len(staged) != 1 {
+		t.Fatalf("expected the upload to be staged, got %v", staged)
+	}
+	if w := do("PROPFIND", "/", ""); strings.Contains(w.Body.String(), ".upload-") {
+		t.Errorf("expected the staged upload not to be listed, got %s", w.Body)
+	}
+	name := "/" + filepath.Base(staged[0])
+	if w := do("GET", name, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the staged upload not to be served, got %d", w.Code)
+	}
+	r := httptest.NewRequest("COPY", name, nil)
+	r.SetBasicAuth("bob", "bob")
+	r.Header.Set("Destination", "/copy.txt")
+	w := httptest.NewRecorder()
+	cfg.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the staged upload not to be copied, got %d", w.Code)
+	}
+
+	close(s.release)
+	if code := <-done; code != http.StatusCreated {
+		t.Errorf("expected the upload to succeed, got %d", code)
+	}
+	if w := do("GET", "/a.txt", ""); w.Body.String() != "hello" {
+		t.Errorf("expected the scanned upload, got %q", w.Body)
+	}
+}
@@ -0,0 +1,210 @@
+package webdav
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// UsernamePlaceholder is replaced by the name of the user in scopes and
+// rule paths.
+const UsernamePlaceholder = "{username}"
+
+// ExpandUsername replaces the username placeholder in s.
+func ExpandUsername(s, username string) string {
+	return strings.ReplaceAll(s, UsernamePlaceholder, username)
+}
+
+// Expand returns a copy of the user whose scope and rules, including the
+// defaults and the rules inherited from its groups, have the username placeholder
+// replaced. The user itself is returned when there is nothing to expand.
+// Usernames that are not a single path element are refused, so that they
+// cannot reach outside of a templated scope.
+func (u *User) Expand() (*User, error) {
+	if !u.templated() {
+		return u, nil
+	}
+	if !validUsername(u.Username) {
+		return nil, fmt.Errorf("invalid username %q for a templated scope", u.Username)
+	}
+
+	expanded := *u
+	expanded.Scope = ExpandUsername(u.Scope, u.Username)
+	if u.Mounts != nil {
+		expanded.Mounts = make([]MountPoint, len(u.Mounts))
+		for i, mp := range u.Mounts {
+			mp.Scope = ExpandUsername(mp.Scope, u.Username)
+			expanded.Mounts[i] = mp
+		}
+	}
+
+	var err error
+	if expanded.Rules, err = expandRules(u.Rules, u.Username); err != nil {
+		return nil, err
+	}
+	if expanded.Defaults, err = expandRules(u.Defaults, u.Username); err != nil {
+		return nil, err
+	}
+
+	expanded.Groups = make([]*Group, len(u.Groups))
+	for i, g := range u.Groups {
+		eg := *g
+		if eg.Rules, err = expandRules(g.Rules, u.Username); err != nil {
+			return nil, fmt.Errorf("group %q: %w", g.Name, err)
+		}
+		expanded.Groups[i] = &eg
+	}
+
+	return &expanded, nil
+}
+
+// validUsername reports whether username can stand for a path element.
+func validUsername(username string) bool {
+	return username != "" && username != "." && username != ".." && !strings.ContainsAny(username, "/\\\x00")
+}
+
+func (u *User) templated() bool {
+	if strings.Contains(u.Scope, UsernamePlaceholder) || rulesTemplated(u.Rules) || rulesTemplated(u.Defaults) {
+		return true
+	}
+	for _, mp := range u.Mounts {
+		if strings.Contains(mp.Scope, UsernamePlaceholder) {
+			return true
+		}
+	}
+	for _, g := range u.Groups {
+		if rulesTemplated(g.Rules) {
+			return true
+		}
+	}
+	return false
+}
+
+func rulesTemplated(rules []*Rule) bool {
+	for _, rule := range rules {
+		if strings.Contains(rule.Pattern(), UsernamePlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+func expandRules(rules []*Rule, username string) ([]*Rule, error) {
+	expanded := make([]*Rule, len(rules))
+	for i, rule := range rules {
+		if !strings.Contains(rule.Pattern(), UsernamePlaceholder) {
+			expanded[i] = rule
+			continue
+		}
+
+		er := *rule
+		er.Path = ExpandUsername(rule.Path, username)
+		if rule.Regex {
+			re, err := regexp.Compile(strings.ReplaceAll(rule.Pattern(), UsernamePlaceholder, regexp.QuoteMeta(username)))
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %w", rule.Pattern(), err)
+			}
+			er.Regexp = re
+		}
+		expanded[i] = &er
+	}
+	return expanded, nil
+}
+
+// Provision describes how missing user scopes are created the first time
+// the user connects.
+type Provision struct {
+	// Perm is the permission of the created directories.
+	Perm os.FileMode
+	// Skeleton is an optional folder whose content is copied into new
+	// scopes.
+	Skeleton string
+}
+
+// Ensure creates dir and fills it from the skeleton if it doesn't exist.
+func (p *Provision) Ensure(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	perm := p.Perm
+	if perm == 0 {
+		perm = 0755
+	}
+	if p.Skeleton == "" {
+		return os.MkdirAll(dir, perm)
+	}
+
+	// Copy into a sibling first so a failed copy doesn't leave a
+	// half-provisioned scope behind.
+	if err := os.MkdirAll(filepath.Dir(dir), perm); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".provision-")
+	if err != nil {
+		return err
+	}
+	if err := copyTree(p.Skeleton, tmp, perm); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+func copyTree(src, dst string, perm os.FileMode) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if d.IsDir() {
+			return os.MkdirAll(target, perm)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
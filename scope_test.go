@@ -0,0 +1,114 @@
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserExpand(t *testing.T) {
+	cfg := testConfig(t, `{
+		"scope": "/srv/dav/{username}",
+		"groups": [{"name": "team", "rules": [{"path": "^/inbox/{username}/", "regex": true, "allow": true, "modify": true}]}],
+		"users": [
+			{"username": "a.b", "groups": ["team"], "modify": false,
+			 "rules": [{"path": "/home/{username}/", "allow": true, "modify": true}]},
+			{"username": "plain", "scope": "/srv/plain"}
+		]
+	}`)
+
+	u := cfg.Users["a.b"]
+	if u.Scope != "/srv/dav/a.b" {
+		t.Errorf("expected expanded scope, got %q", u.Scope)
+	}
+	if !u.Allowed("/home/a.b/file", false) || u.Allowed("/home/other/file", false) {
+		t.Errorf("expected user rule to be expanded")
+	}
+	if !u.Allowed("/inbox/a.b/file", false) || u.Allowed("/inbox/aXb/file", false) {
+		t.Errorf("expected group rule to be expanded and quoted")
+	}
+	if cfg.Users["plain"].Scope != "/srv/plain" {
+		t.Errorf("unexpected scope %q", cfg.Users["plain"].Scope)
+	}
+}
+
+func TestUserExpandInvalid(t *testing.T) {
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"a..b", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../root", false},
+		{"a/b", false},
+		{`a\b`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			u := &User{Username: tt.username, Scope: "/srv/dav/{username}"}
+			expanded, err := u.Expand()
+			if tt.valid && (err != nil || expanded.Scope != "/srv/dav/"+tt.username) {
+				t.Errorf("expected the scope to be expanded, got %v %v", expanded, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected the username to be refused, got scope %q", expanded.Scope)
+			}
+		})
+	}
+
+	// Usernames are only checked where they are expanded.
+	u := &User{Username: "a/b", Scope: "/srv/dav"}
+	if _, err := u.Expand(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestProvisionEnsure(t *testing.T) {
+	root := t.TempDir()
+	skeleton := filepath.Join(root, "skeleton")
+	if err := os.MkdirAll(filepath.Join(skeleton, "docs"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(skeleton, "docs", "README.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := testConfig(t, `{
+		"scope": "`+root+`/home/{username}",
+		"provision": {"perm": "0750", "skeleton": "`+skeleton+`"},
+		"users": [{"username": "alice", "password": "a"}]
+	}`)
+
+	r := httptest.NewRequest("GET", "/docs/README.txt", nil)
+	r.SetBasicAuth("alice", "a")
+	w := httptest.NewRecorder()
+	cfg.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("expected skeleton file, got %d %q", w.Code, w.Body.String())
+	}
+
+	info, err := os.Stat(filepath.Join(root, "home", "alice"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("expected perm 0750, got %v", info.Mode().Perm())
+	}
+
+	// An existing scope is left untouched.
+	if err := os.Remove(filepath.Join(root, "home", "alice", "docs", "README.txt")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cfg.Provision.Ensure(filepath.Join(root, "home", "alice")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "home", "alice", "docs", "README.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected existing scope to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package webdav
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionIdleTimeout is how long a session is listed after its last
+// request.
+const SessionIdleTimeout = 30 * time.Minute
+
+// Session describes the recent requests of a user from one client.
+// WebDAV is stateless, so a session is identified by the username, the
+// client address and the user agent.
+type Session struct {
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Started   time.Time `json:"started"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Requests  int       `json:"requests"`
+	// Active is the number of requests being served.
+	Active int `json:"active"`
+}
+
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions map[[3]string]*Session
+}
+
+// sessionTable returns the sessions of c, which survive reloads.
+func (c *Config) sessionTable() *sessionTable {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sessions == nil {
+		c.sessions = &sessionTable{sessions: map[[3]string]*Session{}}
+	}
+	return c.sessions
+}
+
+// track records a request of u and returns the function to call once it
+// has been served.
+func (t *sessionTable) track(u *User, r *http.Request) func() {
+	key := [3]string{u.Username, clientIP(r), r.UserAgent()}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[key]
+	if !ok || (s.Active == 0 && now.Sub(s.LastSeen) > SessionIdleTimeout) {
+		s = &Session{Username: key[0], IP: key[1], UserAgent: key[2], Started: now}
+		t.sessions[key] = s
+	}
+	s.LastSeen = now
+	s.Requests++
+	s.Active++
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		s.Active--
+		s.LastSeen = time.Now()
+	}
+}
+
+// list returns the sessions that are active or were recently, most
+// recent first, and forgets the others.
+func (t *sessionTable) list(now time.Time) []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := []Session{}
+	for key, s := range t.sessions {
+		if s.Active == 0 && now.Sub(s.LastSeen) > SessionIdleTimeout {
+			delete(t.sessions, key)
+			continue
+		}
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+	return sessions
+}
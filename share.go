@@ -0,0 +1,517 @@
+package webdav
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/gokit/logger"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/webdav"
+)
+
+// SharePrefix is the URL path under which share links are served.
+const SharePrefix = APIPrefix + "s/"
+
+const sharesPath = APIPrefix + "shares"
+
+// DefaultShareTTL is the lifetime of share links created without expiry.
+const DefaultShareTTL = 7 * 24 * time.Hour
+
+var (
+	ErrShareNotFound = errors.New("share not found")
+	ErrShareExpired  = errors.New("share expired")
+)
+
+// Share is a link giving anonymous read access to a file or folder of
+// its owner, within the restrictions of the credentials it was created
+// with.
+type Share struct {
+	ID           string        `json:"id"`
+	Owner        string        `json:"owner"`
+	Restrictions []Restriction `json:"restrictions,omitempty"`
+	Path         string        `json:"path"`
+	Created      time.Time     `json:"created"`
+	Expires      time.Time     `json:"expires"`
+	// Password is an optional bcrypt hash visitors must match.
+	Password string `json:"password,omitempty"`
+	// MaxDownloads limits the number of downloads when positive.
+	MaxDownloads int `json:"maxDownloads,omitempty"`
+	Downloads    int `json:"downloads"`
+}
+
+func (s *Share) usable(now time.Time) bool {
+	return now.Before(s.Expires) && (s.MaxDownloads <= 0 || s.Downloads < s.MaxDownloads)
+}
+
+// ShareStore keeps the share links, persisting them to a JSON file when
+// Path is set. Links are signed with Secret.
+type ShareStore struct {
+	Path   string
+	Secret []byte
+
+	mu     sync.Mutex
+	shares map[string]*Share
+}
+
+// NewShareStore returns a store loaded from path, which may not exist yet.
+func NewShareStore(path string, secret []byte) (*ShareStore, error) {
+	s := &ShareStore{Path: path, Secret: secret, shares: map[string]*Share{}}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var shares []*Share
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, err
+	}
+	for _, sh := range shares {
+		s.shares[sh.ID] = sh
+	}
+	return s, nil
+}
+
+// Create stores a new share and fills in its ID. A plain text password
+// is hashed.
+func (s *ShareStore) Create(sh *Share) (*Share, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	sh.ID = hex.EncodeToString(id)
+	sh.Created = time.Now()
+	if sh.Expires.IsZero() {
+		sh.Expires = sh.Created.Add(DefaultShareTTL)
+	}
+	if sh.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(sh.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		sh.Password = string(hash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shares == nil {
+		s.shares = map[string]*Share{}
+	}
+	s.shares[sh.ID] = sh
+	return sh, s.save()
+}
+
+// List returns the shares of owner, or every share when owner is empty.
+func (s *ShareStore) List(owner string) []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var shares []Share
+	for _, sh := range s.shares {
+		if owner == "" || sh.Owner == owner {
+			shares = append(shares, *sh)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+	return shares
+}
+
+// Revoke deletes a share of owner, or of anyone when owner is empty.
+func (s *ShareStore) Revoke(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sh, ok := s.shares[id]
+	if !ok || (owner != "" && sh.Owner != owner) {
+		return ErrShareNotFound
+	}
+	delete(s.shares, id)
+	return s.save()
+}
+
+// Link returns the URL path of a share.
+func (s *ShareStore) Link(sh Share) string {
+	return SharePrefix + sh.ID + "." + s.sign(sh.ID) + "/"
+}
+
+// open returns the share a signed token refers to.
+func (s *ShareStore) open(token string) (Share, error) {
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(id))) {
+		return Share{}, ErrShareNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sh, ok := s.shares[id]
+	if !ok {
+		return Share{}, ErrShareNotFound
+	}
+	if !sh.usable(time.Now()) {
+		return Share{}, ErrShareExpired
+	}
+	return *sh, nil
+}
+
+// download counts a download of a share, failing when it is used up.
+func (s *ShareStore) download(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sh, ok := s.shares[id]
+	if !ok {
+		return ErrShareNotFound
+	}
+	if !sh.usable(time.Now()) {
+		return ErrShareExpired
+	}
+	sh.Downloads++
+	return s.save()
+}
+
+func (s *ShareStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// save writes the shares to Path. It must be called with mu held.
+func (s *ShareStore) save() error {
+	if s.Path == "" {
+		return nil
+	}
+
+	shares := make([]*Share, 0, len(s.shares))
+	for _, sh := range s.shares {
+		shares = append(shares, sh)
+	}
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, data, 0600)
+}
+
+// writeFileAtomic replaces the file at name so that readers see either
+// the old or the new content.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// shareRequest is the body of a share creation request.
+type shareRequest struct {
+	Path string `json:"path"`
+	// ExpiresIn is a duration such as "72h".
+	ExpiresIn    string `json:"expiresIn"`
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"maxDownloads"`
+}
+
+type shareResponse struct {
+	Share
+	URL string `json:"url"`
+}
+
+// serveSharesAPI lists (GET), creates (POST) and revokes (DELETE) the
+// shares of u. Administrators see and revoke every share.
+func (c *Config) serveSharesAPI(w http.ResponseWriter, r *http.Request, u *User) {
+	owner := u.Username
+	if u.Admin {
+		owner = ""
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == sharesPath:
+		shares := c.Shares.List(owner)
+		res := make([]shareResponse, 0, len(shares))
+		for _, sh := range shares {
+			sh.Password = ""
+			res = append(res, shareResponse{Share: sh, URL: c.Shares.Link(sh)})
+		}
+		writeJSON(w, http.StatusOK, res)
+
+	case r.Method == "POST" && r.URL.Path == sharesPath:
+		var req shareRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		req.Path = path.Clean("/" + req.Path)
+
+		access := RequestAccess(r)
+		access.Path, access.NoModification = req.Path, true
+		if !c.DecideAccess(u, access).Allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler, err := c.mount(u)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := handler.FileSystem.Stat(r.Context(), strings.TrimPrefix(req.Path, c.Prefix)); err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		sh := &Share{
+			Owner:        u.Username,
+			Restrictions: u.Restrictions,
+			Path:         req.Path,
+			Password:     req.Password,
+			MaxDownloads: req.MaxDownloads,
+		}
+		if req.ExpiresIn != "" {
+			ttl, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || ttl <= 0 {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			sh.Expires = time.Now().Add(ttl)
+		}
+		if sh, err = c.Shares.Create(sh); err != nil {
+			logger.DefaultLogger.Error("create share: " + err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		res := shareResponse{Share: *sh, URL: c.Shares.Link(*sh)}
+		res.Password = ""
+		writeJSON(w, http.StatusCreated, res)
+
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, sharesPath+"/"):
+		if err := c.Shares.Revoke(owner, strings.TrimPrefix(r.URL.Path, sharesPath+"/")); err != nil {
+			if errors.Is(err, ErrShareNotFound) {
+				http.Error(w, "Not Found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveShare serves the content of a share link anonymously. Files are
+// downloaded, folders are listed and can be fetched as a zip archive with
+// "?archive=zip".
+func (c *Config) serveShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, SharePrefix), "/")
+	sh, err := c.Shares.open(token)
+	if err != nil {
+		if errors.Is(err, ErrShareExpired) {
+			http.Error(w, "Gone", http.StatusGone)
+		} else {
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+		return
+	}
+
+	if sh.Password != "" {
+		_, password, _ := r.BasicAuth()
+		if bcrypt.CompareHashAndPassword([]byte(sh.Password), []byte(password)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Share"`)
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// The owner may have been removed, or have lost access to the shared
+	// path, since.
+	owner, err := c.shareOwner(sh)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			http.Error(w, "Gone", http.StatusGone)
+		} else {
+			logger.DefaultLogger.Error("find owner of share " + sh.ID + ": " + err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	urlPath := path.Join(sh.Path, path.Clean("/"+sub))
+	access := RequestAccess(r)
+	access.Path = urlPath
+	if !c.DecideAccess(owner, access).Allowed {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	handler, err := c.mount(owner)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	fs := handler.FileSystem
+	name := strings.TrimPrefix(urlPath, c.Prefix)
+	allow := func(p string) bool {
+		access.Path = c.Prefix + p
+		return c.DecideAccess(owner, access).Allowed
+	}
+
+	ctx := r.Context()
+	info, err := fs.Stat(ctx, name)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	format := r.URL.Query().Get("archive")
+	if _, ok := archiveFormats[format]; format != "" && !ok {
+		http.Error(w, "unsupported archive format", http.StatusBadRequest)
+		return
+	}
+	if info.IsDir() && format == "" {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		c.listShare(ctx, w, fs, name, info.Name(), allow)
+		return
+	}
+
+	if r.Method == "GET" {
+		if err := c.Shares.download(sh.ID); err != nil {
+			http.Error(w, "Gone", http.StatusGone)
+			return
+		}
+	}
+
+	if info.IsDir() {
+		base := info.Name()
+		if base == "/" || base == "" {
+			base = "share"
+		}
+		streamArchive(w, r, format, base, fs, []archiveEntry{{Name: name, Base: base}}, allow)
+		return
+	}
+
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// shareOwner returns the owner of sh, bound by the restrictions of the
+// share. It fails with ErrInvalidCredentials when the owner no longer
+// exists or is disabled, or when the authenticator cannot tell.
+func (c *Config) shareOwner(sh Share) (*User, error) {
+	owner, err := c.findUser(sh.Owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range sh.Restrictions {
+		owner = owner.Restrict(r)
+	}
+	return owner, nil
+}
+
+var shareListing = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Download all as <a href="?archive=zip">zip</a> or <a href="?archive=tar.gz">tar.gz</a></p>
+<ul>
+{{range .Entries}}<li><a href="{{.Href}}">{{.Name}}</a>{{if not .Dir}} ({{.Size}} bytes){{end}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type listingEntry struct {
+	Name string
+	Href string
+	Dir  bool
+	Size int64
+}
+
+func (c *Config) listShare(ctx context.Context, w http.ResponseWriter, fs webdav.FileSystem, name, title string, allow func(string) bool) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+
+	data := struct {
+		Name    string
+		Entries []listingEntry
+	}{Name: title}
+	for _, child := range children {
+		if !allow(path.Join(name, child.Name())) {
+			continue
+		}
+		e := listingEntry{Name: child.Name(), Href: (&url.URL{Path: "./" + child.Name()}).String(), Dir: child.IsDir(), Size: child.Size()}
+		if e.Dir {
+			e.Href += "/"
+		}
+		data.Entries = append(data.Entries, e)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	shareListing.Execute(w, data)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
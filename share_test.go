@@ -0,0 +1,250 @@
+package webdav
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testShareConfig(t *testing.T) (*Config, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"docs/a.txt":        "a",
+		"docs/sub/b.txt":    "b",
+		"docs/secret/c.txt": "c",
+		"top.txt":           "top",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	cfg := testConfig(t, `{
+		"scope": "`+dir+`",
+		"shares": {"store": "`+filepath.Join(dir, "shares.json")+`", "secret": "secret"},
+		"users": [
+			{"username": "alice", "password": "a", "rules": [{"path": "/docs/secret", "allow": false}],
+			 "appPasswords": [{"name": "phone", "password": "phone", "path": "/docs/sub"}]},
+			{"username": "bob", "password": "b"}
+		]
+	}`)
+	return cfg, dir
+}
+
+func testCreateShare(t *testing.T, cfg *Config, user, body string, status int) shareResponse {
+	t.Helper()
+
+	r := httptest.NewRequest("POST", sharesPath, strings.NewReader(body))
+	r.SetBasicAuth(user, user[:1])
+	w := httptest.NewRecorder()
+	cfg.ServeHTTP(w, r)
+	if w.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+
+	var res shareResponse
+	if status == http.StatusCreated {
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return res
+}
+
+func testGet(cfg *Config, target, password string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	if password != "" {
+		r.SetBasicAuth("", password)
+	}
+	w := httptest.NewRecorder()
+	cfg.ServeHTTP(w, r)
+	return w
+}
+
+func TestShareFile(t *testing.T) {
+	cfg, _ := testShareConfig(t)
+
+	testCreateShare(t, cfg, "alice", `{"path": "/docs/secret/c.txt"}`, http.StatusForbidden)
+	testCreateShare(t, cfg, "alice", `{"path": "/missing.txt"}`, http.StatusNotFound)
+
+	sh := testCreateShare(t, cfg, "alice", `{"path": "/top.txt", "password": "pw", "maxDownloads": 1}`, http.StatusCreated)
+	if sh.Password != "" {
+		t.Errorf("expected password hash to be hidden")
+	}
+
+	if w := testGet(cfg, sh.URL, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without password, got %d", w.Code)
+	}
+	w := testGet(cfg, sh.URL, "pw")
+	if w.Code != http.StatusOK || w.Body.String() != "top" {
+		t.Errorf("expected file content, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Disposition"); got != "attachment; filename=top.txt" {
+		t.Errorf("unexpected disposition %q", got)
+	}
+	if w := testGet(cfg, sh.URL, "pw"); w.Code != http.StatusGone {
+		t.Errorf("expected download limit to apply, got %d", w.Code)
+	}
+
+	forged := sh.URL[:len(sh.URL)-2] + "x/"
+	if w := testGet(cfg, forged, "pw"); w.Code != http.StatusNotFound {
+		t.Errorf("expected forged link to be rejected, got %d", w.Code)
+	}
+
+	// Shares survive a restart.
+	reloaded, err := NewShareStore(cfg.Shares.Path, cfg.Shares.Secret)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if shares := reloaded.List("alice"); len(shares) != 1 || shares[0].Downloads != 1 {
+		t.Errorf("unexpected persisted shares %+v", shares)
+	}
+}
+
+func TestShareFolder(t *testing.T) {
+	cfg, _ := testShareConfig(t)
+	sh := testCreateShare(t, cfg, "alice", `{"path": "/docs", "expiresIn": "1h"}`, http.StatusCreated)
+
+	w := testGet(cfg, sh.URL, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected listing, got %d", w.Code)
+	}
+	listing := w.Body.String()
+	if !strings.Contains(listing, `href="./sub/"`) || strings.Contains(listing, "secret") {
+		t.Errorf("unexpected listing %s", listing)
+	}
+
+	if w := testGet(cfg, sh.URL+"sub/b.txt", ""); w.Code != http.StatusOK || w.Body.String() != "b" {
+		t.Errorf("expected nested file, got %d %q", w.Code, w.Body.String())
+	}
+	if w := testGet(cfg, sh.URL+"../top.txt", ""); w.Code == http.StatusOK && w.Body.String() == "top" {
+		t.Errorf("expected share to be confined to its folder")
+	}
+	if w := testGet(cfg, sh.URL+"secret/c.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected denied path to be hidden, got %d", w.Code)
+	}
+
+	w = testGet(cfg, sh.URL+"?archive=zip", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected archive, got %d", w.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name == "docs/sub/b.txt" {
+			rc, _ := f.Open()
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			if string(data) != "b" {
+				t.Errorf("unexpected archived content %q", data)
+			}
+		}
+	}
+	if got := strings.Join(names, ","); got != "docs/,docs/a.txt,docs/sub/,docs/sub/b.txt" {
+		t.Errorf("unexpected archive entries %s", got)
+	}
+}
+
+func TestSharesAPI(t *testing.T) {
+	cfg, _ := testShareConfig(t)
+	sh := testCreateShare(t, cfg, "alice", `{"path": "/top.txt"}`, http.StatusCreated)
+
+	list := func(user string) []shareResponse {
+		r := httptest.NewRequest("GET", sharesPath, nil)
+		r.SetBasicAuth(user, user[:1])
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		var res []shareResponse
+		json.NewDecoder(w.Body).Decode(&res)
+		return res
+	}
+	if len(list("alice")) != 1 || len(list("bob")) != 0 {
+		t.Errorf("expected shares to be listed for their owner only")
+	}
+
+	revoke := func(user string) int {
+		r := httptest.NewRequest("DELETE", sharesPath+"/"+sh.ID, nil)
+		r.SetBasicAuth(user, user[:1])
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := revoke("bob"); code != http.StatusNotFound {
+		t.Errorf("expected other users not to revoke, got %d", code)
+	}
+	if code := revoke("alice"); code != http.StatusNoContent {
+		t.Errorf("expected revoke to succeed, got %d", code)
+	}
+	if w := testGet(cfg, sh.URL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected revoked share to be gone, got %d", w.Code)
+	}
+}
+
+func TestShareOwner(t *testing.T) {
+	cfg, _ := testShareConfig(t)
+
+	// Shares made with restricted credentials keep their restriction.
+	r := httptest.NewRequest("POST", sharesPath, strings.NewReader(`{"path": "/docs/sub"}`))
+	r.SetBasicAuth("alice", "phone")
+	w := httptest.NewRecorder()
+	cfg.ServeHTTP(w, r)
+	var res shareResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("expected the share to be created, got %d %v", w.Code, err)
+	}
+	if len(res.Restrictions) != 1 || res.Restrictions[0].Path != "/docs/sub" {
+		t.Errorf("expected the restriction of the app password, got %+v", res.Restrictions)
+	}
+	restricted, err := cfg.Shares.Create(&Share{Owner: "alice", Path: "/docs", Restrictions: res.Restrictions})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	link := cfg.Shares.Link(*restricted)
+	if w := testGet(cfg, link+"sub/b.txt", ""); w.Code != http.StatusOK {
+		t.Errorf("expected the file within the restriction, got %d", w.Code)
+	}
+	if w := testGet(cfg, link+"a.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the file outside the restriction to be hidden, got %d", w.Code)
+	}
+
+	// Shares of removed owners stop working.
+	sh := testCreateShare(t, cfg, "bob", `{"path": "/top.txt"}`, http.StatusCreated)
+	delete(cfg.Users, "bob")
+	if w := testGet(cfg, sh.URL, ""); w.Code != http.StatusGone {
+		t.Errorf("expected the share of a removed owner to be gone, got %d", w.Code)
+	}
+}
+
+func TestShareFileName(t *testing.T) {
+	cfg, dir := testShareConfig(t)
+	name := `a "quoted"; name.txt`
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("q"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := json.Marshal(shareRequest{Path: "/" + name})
+	sh := testCreateShare(t, cfg, "bob", string(body), http.StatusCreated)
+
+	w := testGet(cfg, sh.URL, "")
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if err != nil || params["filename"] != name {
+		t.Errorf("expected the file name to be escaped, got %q %v", w.Header().Get("Content-Disposition"), err)
+	}
+}
@@ -0,0 +1,92 @@
+package webdav
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned when a bearer token is malformed, badly
+// signed or expired.
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenClaims are the claims of a bearer token.
+type TokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	// Scope confines the token to a subtree of the namespace of the user.
+	Scope    string `json:"scope,omitempty"`
+	ReadOnly bool   `json:"ro,omitempty"`
+}
+
+// Restriction returns the restriction the claims put on the subject.
+func (c TokenClaims) Restriction() Restriction {
+	return Restriction{Path: c.Scope, ReadOnly: c.ReadOnly}
+}
+
+// TokenIssuer signs and verifies bearer tokens as HS256 JSON Web Tokens.
+type TokenIssuer struct {
+	Secret []byte
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Issue returns a token for the claims valid for ttl.
+func (t TokenIssuer) Issue(claims TokenClaims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(ttl).Unix()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + t.sign(signed), nil
+}
+
+// Verify checks the signature and expiry of a token and returns its claims.
+func (t TokenIssuer) Verify(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(t.sign(parts[0]+"."+parts[1]))) {
+		return nil, ErrInvalidToken
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Subject == "" || claims.ExpiresAt == 0 || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+func (t TokenIssuer) sign(data string) string {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
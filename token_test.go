@@ -0,0 +1,45 @@
+package webdav
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenIssuer(t *testing.T) {
+	issuer := TokenIssuer{Secret: []byte("secret")}
+
+	token, err := issuer.Issue(TokenClaims{Subject: "alice", Scope: "/docs", ReadOnly: true}, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	claims, err := issuer.Verify(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims.Subject != "alice" || claims.Scope != "/docs" || !claims.ReadOnly {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	expired, _ := issuer.Issue(TokenClaims{Subject: "alice"}, -time.Minute)
+	foreign, _ := TokenIssuer{Secret: []byte("other")}.Issue(TokenClaims{Subject: "alice"}, time.Minute)
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other secret", foreign},
+		{"expired", expired},
+		{"tampered", parts[0] + "." + parts[1] + "x." + parts[2]},
+		{"malformed", "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := issuer.Verify(tt.token); err != ErrInvalidToken {
+				t.Errorf("expected ErrInvalidToken, got %v", err)
+			}
+		})
+	}
+}
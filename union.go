@@ -0,0 +1,326 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// MountPoint attaches a scope at a virtual path of the namespace of a
+// user, as the on-disk and in-memory form of a Mount.
+type MountPoint struct {
+	Path     string `json:"path"`
+	Scope    string `json:"scope"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// Mount attaches a file system at a virtual path of a MountFS.
+type Mount struct {
+	Path       string
+	FileSystem webdav.FileSystem
+	ReadOnly   bool
+}
+
+// MountFS is a file system assembled from other file systems mounted at
+// virtual paths. The parents of the mount points that are not part of a
+// mount are read-only directories listing them. A rename across mounts
+// is done as a copy followed by a delete.
+type MountFS struct {
+	mounts  []Mount
+	created time.Time
+}
+
+// NewMountFS returns a file system made of the mounts. A mount at "/",
+// if any, holds everything not covered by the others.
+func NewMountFS(mounts ...Mount) *MountFS {
+	m := &MountFS{created: time.Now()}
+	for _, mt := range mounts {
+		mt.Path = path.Clean("/" + mt.Path)
+		m.mounts = append(m.mounts, mt)
+	}
+	// Longest paths first, so nested mounts win.
+	sort.SliceStable(m.mounts, func(i, j int) bool { return len(m.mounts[i].Path) > len(m.mounts[j].Path) })
+	return m
+}
+
+// resolve returns the mount holding name and the path of name in it.
+func (m *MountFS) resolve(name string) (*Mount, string) {
+	trailing := strings.HasSuffix(name, "/")
+	name = path.Clean("/" + name)
+
+	for i := range m.mounts {
+		mt := &m.mounts[i]
+		if mt.Path != "/" && name != mt.Path && !strings.HasPrefix(name, mt.Path+"/") {
+			continue
+		}
+		inner := "/" + strings.TrimPrefix(strings.TrimPrefix(name, mt.Path), "/")
+		if trailing && inner != "/" {
+			// Keep the slash, which WebDavDir uses to enter archives.
+			inner += "/"
+		}
+		return mt, inner
+	}
+	return nil, ""
+}
+
+// children returns the names of the entries directly below name that
+// lead to mount points.
+func (m *MountFS) children(name string) []string {
+	name = path.Clean("/" + name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+
+	seen := map[string]bool{}
+	var names []string
+	for _, mt := range m.mounts {
+		rest, ok := strings.CutPrefix(mt.Path, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		child, _, _ := strings.Cut(rest, "/")
+		if !seen[child] {
+			seen[child] = true
+			names = append(names, child)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MountFS) synthetic(name string) os.FileInfo {
+	base := path.Base(path.Clean("/" + name))
+	return mountDirInfo{name: base, modTime: m.created}
+}
+
+func (m *MountFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	mt, inner := m.resolve(name)
+	if mt == nil {
+		if name = path.Clean("/" + name); name == "/" || len(m.children(name)) > 0 {
+			return m.synthetic(name), nil
+		}
+		return nil, os.ErrNotExist
+	}
+
+	info, err := mt.FileSystem.Stat(ctx, inner)
+	if os.IsNotExist(err) && len(m.children(name)) > 0 {
+		return m.synthetic(name), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if inner == "/" {
+		// The root of the mount is named after the mount point.
+		info = renamedInfo{info, path.Base(mt.Path)}
+	}
+	return info, nil
+}
+
+func (m *MountFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	children := m.children(name)
+
+	mt, inner := m.resolve(name)
+	if mt == nil {
+		if path.Clean("/"+name) != "/" && len(children) == 0 {
+			if writing {
+				return nil, os.ErrPermission
+			}
+			return nil, os.ErrNotExist
+		}
+		if writing {
+			return nil, os.ErrPermission
+		}
+		return m.mountDir(ctx, name, nil, children)
+	}
+	if mt.ReadOnly && writing {
+		return nil, os.ErrPermission
+	}
+
+	f, err := mt.FileSystem.OpenFile(ctx, inner, flag, perm)
+	if os.IsNotExist(err) && len(children) > 0 && !writing {
+		return m.mountDir(ctx, name, nil, children)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(children) > 0 {
+		return m.mountDir(ctx, name, f, children)
+	}
+	return f, nil
+}
+
+// mountDir returns a directory listing the mount points below name on
+// top of the entries of f, when not nil.
+func (m *MountFS) mountDir(ctx context.Context, name string, f webdav.File, children []string) (webdav.File, error) {
+	var infos []os.FileInfo
+	for _, child := range children {
+		info, err := m.Stat(ctx, path.Join(name, child))
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	info, err := m.Stat(ctx, name)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, err
+	}
+	return &mountDir{File: f, info: info, mounts: infos}, nil
+}
+
+func (m *MountFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	mt, inner := m.resolve(name)
+	if mt == nil || mt.ReadOnly {
+		return os.ErrPermission
+	}
+	if inner == "/" || len(m.children(name)) > 0 {
+		return os.ErrExist
+	}
+	return mt.FileSystem.Mkdir(ctx, inner, perm)
+}
+
+func (m *MountFS) RemoveAll(ctx context.Context, name string) error {
+	mt, inner := m.resolve(name)
+	// Mount points and the directories leading to them stay.
+	if mt == nil || mt.ReadOnly || inner == "/" || len(m.children(name)) > 0 {
+		return os.ErrPermission
+	}
+	return mt.FileSystem.RemoveAll(ctx, inner)
+}
+
+func (m *MountFS) Rename(ctx context.Context, oldName, newName string) error {
+	src, oldInner := m.resolve(oldName)
+	dst, newInner := m.resolve(newName)
+	if src == nil || dst == nil || src.ReadOnly || dst.ReadOnly ||
+		oldInner == "/" || newInner == "/" || len(m.children(oldName)) > 0 {
+		return os.ErrPermission
+	}
+	if src == dst {
+		return src.FileSystem.Rename(ctx, oldInner, newInner)
+	}
+
+	if err := copyFS(ctx, src.FileSystem, oldInner, dst.FileSystem, newInner); err != nil {
+		dst.FileSystem.RemoveAll(ctx, newInner)
+		return err
+	}
+	return src.FileSystem.RemoveAll(ctx, oldInner)
+}
+
+// copyFS copies the tree at srcName in src to dstName in dst.
+func copyFS(ctx context.Context, src webdav.FileSystem, srcName string, dst webdav.FileSystem, dstName string) error {
+	info, err := src.Stat(ctx, srcName)
+	if err != nil {
+		return err
+	}
+	return walkFS(ctx, src, srcName, info, func(name string, info os.FileInfo) error {
+		target := path.Join(dstName, strings.TrimPrefix(name, srcName))
+		if info.IsDir() {
+			return dst.Mkdir(ctx, target, info.Mode().Perm()|0700)
+		}
+
+		r, err := src.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w, err := dst.OpenFile(ctx, target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm()|0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// mountDirInfo describes a directory leading to mount points.
+type mountDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (fi mountDirInfo) Name() string       { return fi.name }
+func (fi mountDirInfo) Size() int64        { return 0 }
+func (fi mountDirInfo) Mode() os.FileMode  { return fs.ModeDir | 0555 }
+func (fi mountDirInfo) ModTime() time.Time { return fi.modTime }
+func (fi mountDirInfo) IsDir() bool        { return true }
+func (fi mountDirInfo) Sys() interface{}   { return nil }
+
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedInfo) Name() string { return fi.name }
+
+// mountDir is a directory whose listing includes mount points. File is
+// the directory of the underlying mount, nil for synthetic directories.
+type mountDir struct {
+	webdav.File
+	info   os.FileInfo
+	mounts []os.FileInfo
+
+	entries []os.FileInfo
+	read    bool
+	off     int
+}
+
+func (d *mountDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		d.read = true
+		byName := map[string]os.FileInfo{}
+		if d.File != nil {
+			infos, err := d.File.Readdir(-1)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range infos {
+				byName[info.Name()] = info
+			}
+		}
+		// Mount points hide the entries they are mounted over.
+		for _, info := range d.mounts {
+			byName[info.Name()] = info
+		}
+		for _, info := range byName {
+			d.entries = append(d.entries, info)
+		}
+		sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+	}
+
+	rest := d.entries[d.off:]
+	if count <= 0 {
+		d.off = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(rest))
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *mountDir) Stat() (os.FileInfo, error) { return d.info, nil }
+
+func (d *mountDir) Read(p []byte) (int, error) { return 0, os.ErrInvalid }
+
+func (d *mountDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (d *mountDir) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (d *mountDir) Close() error {
+	if d.File != nil {
+		return d.File.Close()
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestMountFS(t *testing.T) {
+	home, team := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(home, "notes.txt"), []byte("notes"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(team, "plan.txt"), []byte("plan"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	projects := t.TempDir()
+
+	ctx := context.Background()
+	m := NewMountFS(
+		Mount{Path: "/home", FileSystem: webdav.Dir(home)},
+		Mount{Path: "/shared/team", FileSystem: webdav.Dir(team), ReadOnly: true},
+		Mount{Path: "/shared/projects", FileSystem: webdav.Dir(projects)},
+	)
+
+	list := func(name string) string {
+		t.Helper()
+		f, err := m.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return strings.Join(names, ",")
+	}
+
+	if got := list("/"); got != "home,shared" {
+		t.Errorf("unexpected root %q", got)
+	}
+	if got := list("/shared"); got != "projects,team" {
+		t.Errorf("unexpected synthetic directory %q", got)
+	}
+	if info, err := m.Stat(ctx, "/shared/team"); err != nil || info.Name() != "team" || !info.IsDir() {
+		t.Errorf("unexpected mount point %v %v", info, err)
+	}
+	if _, err := m.Stat(ctx, "/other"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected unmounted path not to exist, got %v", err)
+	}
+
+	if _, err := m.OpenFile(ctx, "/shared/team/new.txt", os.O_WRONLY|os.O_CREATE, 0644); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected read-only mount, got %v", err)
+	}
+	if err := m.Mkdir(ctx, "/new", 0755); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected synthetic root to be read-only, got %v", err)
+	}
+	if err := m.RemoveAll(ctx, "/home"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected mount point to stay, got %v", err)
+	}
+
+	// Renames within a mount and across mounts.
+	if err := m.Rename(ctx, "/home/notes.txt", "/home/renamed.txt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.Mkdir(ctx, "/home/dir", 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.Rename(ctx, "/home/renamed.txt", "/home/dir/notes.txt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.Rename(ctx, "/home/dir", "/shared/projects/dir"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, "dir")); !os.IsNotExist(err) {
+		t.Errorf("expected the source to be deleted, got %v", err)
+	}
+	f, err := m.OpenFile(ctx, "/shared/projects/dir/notes.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "notes" {
+		t.Errorf("unexpected moved content %q", data)
+	}
+	if err := m.Rename(ctx, "/shared/team/plan.txt", "/home/plan.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected no move out of a read-only mount, got %v", err)
+	}
+}
+
+func TestConfigServeHTTPMounts(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"homes/bob", "team"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "team", "plan.txt"), []byte("plan"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := testConfig(t, `{"modify": true, "users": [{"username": "bob", "password": "bob", "mounts": [
+		{"path": "/home", "scope": "`+dir+`/homes/{username}"},
+		{"path": "/team", "scope": "`+dir+`/team", "readOnly": true}
+	]}]}`)
+	do := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("bob", "bob")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		cfg.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("PROPFIND", "/", "", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:href>/home/</D:href>") ||
+		!strings.Contains(w.Body.String(), "<D:href>/team/</D:href>") {
+		t.Errorf("expected the mount points to be listed, got %d %s", w.Code, w.Body)
+	}
+	if w := do("PUT", "/home/a.txt", "a", nil); w.Code != http.StatusCreated {
+		t.Errorf("expected upload to the home, got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "homes", "bob", "a.txt")); err != nil {
+		t.Errorf("expected the file in the expanded scope: %v", err)
+	}
+	if w := do("PUT", "/team/a.txt", "a", nil); w.Code < 400 {
+		t.Errorf("expected the read-only mount to refuse uploads, got %d", w.Code)
+	}
+	if w := do("MOVE", "/home/a.txt", "", map[string]string{"Destination": "/team/a.txt"}); w.Code < 400 {
+		t.Errorf("expected no move into the read-only mount, got %d", w.Code)
+	}
+	if w := do("COPY", "/team/plan.txt", "", map[string]string{"Destination": "/home/plan.txt"}); w.Code != http.StatusCreated {
+		t.Errorf("expected a copy across mounts, got %d", w.Code)
+	}
+}
@@ -1,8 +1,11 @@
 package webdav
 
 import (
+	"fmt"
+	"net"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/net/webdav"
 )
@@ -14,6 +17,32 @@ type Rule struct {
 	Modify bool
 	Path   string
 	Regexp *regexp.Regexp
+	// Networks, when not empty, limits the rule to clients whose
+	// address is in one of the networks.
+	Networks []*net.IPNet
+	// Windows, when not empty, limits the rule to requests made during
+	// one of the time windows.
+	Windows []TimeWindow
+}
+
+// Pattern returns the path prefix or regular expression the rule matches.
+func (r *Rule) Pattern() string {
+	if r.Regex && r.Regexp != nil {
+		return r.Regexp.String()
+	}
+	return r.Path
+}
+
+// Group contains settings shared by several users. Scope and Modify
+// are inherited by members that don't set their own, from the last of
+// their groups that sets them; likewise the Rules of later groups take
+// precedence over those of earlier ones, and the rules of the member
+// over all of them.
+type Group struct {
+	Name   string
+	Scope  string
+	Modify bool
+	Rules  []*Rule
 }
 
 // User contains the settings of each user.
@@ -21,30 +50,163 @@ type User struct {
 	Username string
 	Password string
 	Scope    string
-	Modify   bool
+	// Mounts, when not empty, replace Scope with a namespace assembled
+	// from several scopes.
+	Mounts []MountPoint
+	Modify bool
+	Admin  bool
+	// Disabled users are refused as if their credentials were wrong.
+	Disabled bool
+	Groups   []*Group
 	Rules    []*Rule
-	Handler  *webdav.Handler
+	// Defaults are the rules shared by every user, overridden by the
+	// rules of its groups and its own.
+	Defaults []*Rule
+	// AppPasswords are additional passwords, usually given to a single
+	// application, that may carry their own restriction.
+	AppPasswords []*AppPassword
+	// Restrictions are checked before any rule and can only deny.
+	Restrictions []Restriction
+	// RateLimit overrides Config.RateLimit when not nil.
+	RateLimit *RateLimit
+	// UploadPolicies restrict the files the user may upload.
+	UploadPolicies []UploadPolicy
+	Handler        *webdav.Handler
+}
+
+// Restriction narrows what a user may do regardless of its rules.
+type Restriction struct {
+	// Path, when not empty, confines the user to that subtree.
+	Path     string `json:"path,omitempty"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+func (r Restriction) permits(a Access) bool {
+	if r.ReadOnly && !a.NoModification {
+		return false
+	}
+	if r.Path == "" {
+		return true
+	}
+	prefix := strings.TrimSuffix(r.Path, "/")
+	return a.Path == prefix || strings.HasPrefix(a.Path, prefix+"/")
+}
+
+// Restrict returns a copy of the user that is also bound by r.
+func (u *User) Restrict(r Restriction) *User {
+	if r == (Restriction{}) {
+		return u
+	}
+	restricted := *u
+	restricted.Restrictions = append(append([]Restriction{}, u.Restrictions...), r)
+	return &restricted
+}
+
+// Decision explains the outcome of an authorization check.
+type Decision struct {
+	Allowed bool
+	// Group is the name of the group owning the matched rule, empty
+	// when the rule belongs to the user or is a default.
+	Group string
+	// Global reports whether the matched rule is one of the Defaults.
+	Global bool
+	// Rule is the index of the matched rule in the Rules of its owner,
+	// or -1 when no rule matched.
+	Rule    int
+	Pattern string
+	// Default reports whether the verdict fell back to User.Modify.
+	Default bool
+	// Restricted reports whether a restriction of the user denied the
+	// access before any rule was evaluated.
+	Restricted bool
+}
+
+// String formats the decision for logs and the X-Webdav-Decision header.
+func (d Decision) String() string {
+	verdict := "deny"
+	if d.Allowed {
+		verdict = "allow"
+	}
+	if d.Restricted {
+		return verdict + "; restricted"
+	}
+	if d.Default {
+		return verdict + "; default"
+	}
+	if d.Group != "" {
+		return fmt.Sprintf("%s; group=%q; rule=%d; pattern=%q", verdict, d.Group, d.Rule, d.Pattern)
+	}
+	if d.Global {
+		return fmt.Sprintf("%s; global; rule=%d; pattern=%q", verdict, d.Rule, d.Pattern)
+	}
+	return fmt.Sprintf("%s; rule=%d; pattern=%q", verdict, d.Rule, d.Pattern)
 }
 
 // Allowed checks if the user has permission to access a directory/file
 func (u User) Allowed(url string, noModification bool) bool {
+	return u.Decide(url, noModification).Allowed
+}
+
+// Decide is like Allowed but also reports which rule produced the verdict.
+// The client is unknown, so rules restricted to networks only match when
+// they deny.
+func (u User) Decide(url string, noModification bool) Decision {
+	return u.DecideAccess(Access{Path: url, NoModification: noModification, Time: time.Now()})
+}
+
+// DecideAccess evaluates the rules of the user against an access. The
+// rules of the user take precedence over those of its groups, later
+// groups over earlier ones, and groups over the Defaults.
+func (u User) DecideAccess(a Access) Decision {
+	for _, r := range u.Restrictions {
+		if !r.permits(a) {
+			return Decision{Rule: -1, Restricted: true}
+		}
+	}
+
+	if d, ok := decideRules(u.Rules, a); ok {
+		return d
+	}
+
+	for i := len(u.Groups) - 1; i >= 0; i-- {
+		if d, ok := decideRules(u.Groups[i].Rules, a); ok {
+			d.Group = u.Groups[i].Name
+			return d
+		}
+	}
+
+	if d, ok := decideRules(u.Defaults, a); ok {
+		d.Global = true
+		return d
+	}
+
+	return Decision{Allowed: a.NoModification || u.Modify, Rule: -1, Default: true}
+}
+
+// decideRules applies the last rule matching the access.
+func decideRules(rules []*Rule, a Access) (Decision, bool) {
 	var rule *Rule
-	i := len(u.Rules) - 1
+	i := len(rules) - 1
 
 	for i >= 0 {
-		rule = u.Rules[i]
+		rule = rules[i]
+		if !rule.applies(a) {
+			i--
+			continue
+		}
 
-		isAllowed := rule.Allow && (noModification || rule.Modify)
+		url := a.Path
+		isAllowed := rule.Allow && (a.NoModification || rule.Modify)
 		if rule.Regex {
 			if rule.Regexp.MatchString(url) {
-				return isAllowed
+				return Decision{Allowed: isAllowed, Rule: i, Pattern: rule.Pattern()}, true
 			}
 		} else if strings.HasPrefix(url, rule.Path) {
-			return isAllowed
+			return Decision{Allowed: isAllowed, Rule: i, Pattern: rule.Pattern()}, true
 		}
 
 		i--
 	}
 
-	return noModification || u.Modify
+	return Decision{}, false
 }
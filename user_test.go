@@ -120,3 +120,114 @@ func TestUserAllowed(t *testing.T) {
 		})
 	}
 }
+
+func TestUserDecide(t *testing.T) {
+	user := User{
+		Modify: false,
+		Rules: []*Rule{
+			{
+				Regex:  true,
+				Allow:  false,
+				Regexp: regexp.MustCompile(`\.secret$`),
+			},
+			{
+				Path:   "/public/",
+				Allow:  true,
+				Modify: true,
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		url            string
+		noModification bool
+		want           Decision
+	}{
+		{
+			name:           "prefix rule",
+			url:            "/public/file.txt",
+			noModification: false,
+			want:           Decision{Allowed: true, Rule: 1, Pattern: "/public/"},
+		},
+		{
+			name:           "regex rule",
+			url:            "/private/key.secret",
+			noModification: true,
+			want:           Decision{Allowed: false, Rule: 0, Pattern: `\.secret$`},
+		},
+		{
+			name:           "default fallback",
+			url:            "/private/file.txt",
+			noModification: false,
+			want:           Decision{Allowed: false, Rule: -1, Default: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := user.Decide(tt.url, tt.noModification); got != tt.want {
+				t.Errorf("User.Decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserDecideGroups(t *testing.T) {
+	staff := &Group{
+		Name: "staff",
+		Rules: []*Rule{
+			{Path: "/shared/", Allow: true, Modify: true},
+			{Path: "/shared/archive/", Allow: true},
+		},
+	}
+	interns := &Group{
+		Name:  "interns",
+		Rules: []*Rule{{Path: "/shared/", Allow: false}},
+	}
+	user := User{
+		Groups:   []*Group{staff, interns},
+		Rules:    []*Rule{{Path: "/shared/docs/", Allow: true}},
+		Defaults: []*Rule{{Path: "/shared/", Allow: true, Modify: true}, {Path: "/home/", Allow: true}},
+	}
+
+	tests := []struct {
+		name           string
+		url            string
+		noModification bool
+		want           Decision
+	}{
+		{
+			name:           "user rule wins",
+			url:            "/shared/docs/a.txt",
+			noModification: true,
+			want:           Decision{Allowed: true, Rule: 0, Pattern: "/shared/docs/"},
+		},
+		{
+			name:           "later group wins",
+			url:            "/shared/b.txt",
+			noModification: true,
+			want:           Decision{Allowed: false, Group: "interns", Rule: 0, Pattern: "/shared/"},
+		},
+		{
+			name:           "global rule",
+			url:            "/home/c.txt",
+			noModification: true,
+			want:           Decision{Allowed: true, Global: true, Rule: 1, Pattern: "/home/"},
+		},
+		{
+			name:           "no match",
+			url:            "/tmp/c.txt",
+			noModification: true,
+			want:           Decision{Allowed: true, Rule: -1, Default: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := user.Decide(tt.url, tt.noModification); got != tt.want {
+				t.Errorf("User.Decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/gokit/logger"
+	"golang.org/x/net/webdav"
+)
+
+// APIPrefix is the URL path reserved for the endpoints of the server
+// that are not part of the WebDAV namespace.
+const APIPrefix = "/.webdav/"
+
+// DecisionHeader carries the authorization decision of a request when
+// Config.Debug is enabled and the requesting user is an administrator.
+const DecisionHeader = "X-Webdav-Decision"
+
+// Config is the configuration of a WebDAV instance.
+type Config struct {
+	*User
+	Auth bool
+	// Authenticator verifies credentials when Auth is enabled. Defaults
+	// to a ConfigAuthenticator over Users.
+	Authenticator Authenticator
+	// Tokens verifies bearer tokens; they are rejected when nil.
+	Tokens    *TokenIssuer
+	NoSniff   bool
+	Debug     bool
+	Prefix    string
+	Provision *Provision
+	Users     map[string]*User
+	// Shares enables public share links when not nil.
+	Shares *ShareStore
+	// Guard throttles failed logins when not nil.
+	Guard *LoginGuard
+	// Audit records security events, logged when nil.
+	Audit Auditor
+	// RateLimit applies to users without their own.
+	RateLimit RateLimit
+	// Metrics collects request statistics and serves them at MetricsPath
+	// when not nil, to administrators when Auth is enabled.
+	Metrics *Metrics
+	// CORS lets browsers on other origins use the server when not nil.
+	CORS *CORS
+	// BrowseArchives exposes zip and tar archives as read-only folders.
+	BrowseArchives bool
+	// Backend returns the file system serving a scope when not nil.
+	// Scopes are local directories otherwise.
+	Backend func(scope string) (webdav.FileSystem, error)
+	// Events receive the changes made through the server.
+	Events []EventSink
+	// Scanning checks the uploads to local scopes when not nil.
+	Scanning *Scanning
+	// MasterKey, when not nil, encrypts the files of local scopes on disk,
+	// with a key derived for each scope: templated scopes get a key per
+	// user.
+	MasterKey []byte
+	// Git, when not nil, commits the changes made to local scopes.
+	Git *GitVersioning
+
+	mu       sync.Mutex
+	handlers map[string]*webdav.Handler
+	// locks are the lock systems of the handlers, kept by the scopes
+	// across reloads even when their handlers are rebuilt.
+	locks    map[string]webdav.LockSystem
+	limiters map[string]*rateLimiter
+	sessions *sessionTable
+	archives *ArchiveCache
+	broker   *eventBroker
+	// reloader is the source of the configuration when it is backed by
+	// a file the administration API can change.
+	reloader *Reloader
+}
+
+// ReadOnlyMethod reports whether an HTTP method never modifies the file system.
+func ReadOnlyMethod(method string) bool {
+	return method == "GET" || method == "HEAD" ||
+		method == "OPTIONS" || method == "PROPFIND"
+}
+
+// requestState collects what is learned about a request while it is
+// served, for the code wrapping it.
+type requestState struct {
+	user       string
+	authFailed bool
+	denied     bool
+	// upload is set for PUT requests. uploads are the policies their
+	// content must follow, and violation the first one it broke.
+	upload    bool
+	uploads   []UploadPolicy
+	violation error
+}
+
+type requestStateKey struct{}
+
+// stateOf returns the state attached to the context of r.
+func stateOf(r *http.Request) *requestState {
+	return contextState(r.Context())
+}
+
+// contextState returns the request state attached to ctx.
+func contextState(ctx context.Context) *requestState {
+	if st, ok := ctx.Value(requestStateKey{}).(*requestState); ok {
+		return st
+	}
+	return &requestState{}
+}
+
+// ServeHTTP determines if the request is for this plugin, and if all prerequisites are met.
+func (c *Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := &requestState{}
+	r = r.WithContext(context.WithValue(r.Context(), requestStateKey{}, st))
+
+	m := c.Metrics
+	if m == nil || r.URL.Path == MetricsPath {
+		c.serve(w, r)
+		return
+	}
+
+	m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: w}
+	var body *countingBody
+	if r.Body != nil {
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	// The handler may rewrite the method, so it is recorded first.
+	method := r.Method
+
+	c.serve(mw, r)
+
+	status := mw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var in int64
+	if body != nil {
+		in = body.n
+	}
+	m.observe(method, status, st, time.Since(start), in, mw.n)
+}
+
+func (c *Config) serve(w http.ResponseWriter, r *http.Request) {
+	// Preflight requests are answered before authentication, as browsers
+	// send them without credentials.
+	if c.CORS != nil && c.CORS.handle(w, r) {
+		return
+	}
+
+	if c.Shares != nil && strings.HasPrefix(r.URL.Path, SharePrefix) {
+		c.serveShare(w, r)
+		return
+	}
+
+	u := c.requestUser(w, r)
+	if u == nil {
+		return
+	}
+	defer c.sessionTable().track(u, r)()
+
+	if c.Metrics != nil && r.URL.Path == MetricsPath {
+		// The metrics name the users.
+		if c.Auth && !u.Admin {
+			stateOf(r).denied = true
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		c.Metrics.ServeHTTP(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, adminPrefix) {
+		c.serveAdmin(w, r, u)
+		return
+	}
+	if r.URL.Path == EventsPath {
+		c.serveEventStream(w, r, u)
+		return
+	}
+	if c.Shares != nil && (r.URL.Path == sharesPath || strings.HasPrefix(r.URL.Path, sharesPath+"/")) {
+		c.serveSharesAPI(w, r, u)
+		return
+	}
+
+	handler, err := c.mount(u)
+	if err != nil {
+		logger.DefaultLogger.Error("mount scope of " + u.Username + ": " + err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	access := RequestAccess(r)
+	if archiveRequest(r) {
+		// Archives of a selection are requested with a POST, which
+		// reads nonetheless.
+		access.NoModification = true
+	}
+	if r.Method == "COPY" {
+		// A copy only reads its source, and writes to its destination.
+		access.NoModification = true
+	}
+	decision := c.DecideAccess(u, access)
+	if decision.Allowed && (r.Method == "COPY" || r.Method == "MOVE") {
+		// The destination is written to, so it needs modify permission.
+		if dst, err := url.Parse(r.Header.Get("Destination")); err == nil && dst.Path != "" {
+			access.Path, access.NoModification = dst.Path, false
+			decision = c.DecideAccess(u, access)
+		}
+	}
+	if c.Debug && u.Admin {
+		w.Header().Set(DecisionHeader, decision.String())
+	}
+
+	if !decision.Allowed {
+		logger.DefaultLogger.Debug(u.Username + " denied " + r.Method + " " + r.URL.Path + ": " + decision.String())
+		stateOf(r).denied = true
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if l := c.limiter(u); l != nil {
+		if l.requests != nil {
+			if ok, wait := l.requests.allow(time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		if l.download != nil {
+			w = throttledWriter{ResponseWriter: w, ctx: r.Context(), bucket: l.download}
+		}
+		if l.upload != nil && r.Body != nil {
+			r.Body = throttledBody{ReadCloser: r.Body, ctx: r.Context(), bucket: l.upload}
+		}
+	}
+
+	if archiveRequest(r) {
+		c.serveArchive(w, r, u, handler.FileSystem)
+		return
+	}
+
+	// Excerpt from RFC4918, section 9.4:
+	//
+	// 		GET, when applied to a collection, may return the contents of an
+	//		"index.html" resource, a human-readable view of the contents of
+	//		the collection, or something else altogether.
+	//
+	// Get, when applied to collection, will return the same as PROPFIND method.
+	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, handler.Prefix) {
+		info, err := handler.FileSystem.Stat(context.TODO(), strings.TrimPrefix(r.URL.Path, handler.Prefix))
+		if err == nil && info.IsDir() {
+			r.Method = "PROPFIND"
+
+			if r.Header.Get("Depth") == "" {
+				r.Header.Add("Depth", "1")
+			}
+		}
+	}
+
+	if r.Method == "PUT" || r.Method == "COPY" || r.Method == "MOVE" {
+		if !checkUpload(w, r, u) {
+			return
+		}
+		if st := stateOf(r); st.upload {
+			w = &policyWriter{ResponseWriter: w, st: st}
+		}
+	}
+
+	if !ReadOnlyMethod(r.Method) && c.watched() {
+		c.serveEvents(w, r, u, handler)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// requestUser returns the user making the request. It replies with an
+// error and returns nil when the request is not authorized.
+func (c *Config) requestUser(w http.ResponseWriter, r *http.Request) *User {
+	u := c.User
+
+	if c.Auth {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+
+		username, _, _ := r.BasicAuth()
+		ip := clientIP(r)
+		if c.Guard != nil {
+			if wait := c.Guard.Check(username, ip, time.Now()); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return nil
+			}
+		}
+
+		user, err := c.authenticate(r)
+		if err == nil && user.Disabled {
+			logger.DefaultLogger.Info("disabled user " + user.Username + " from " + r.RemoteAddr)
+			err = ErrInvalidCredentials
+		}
+		if err != nil {
+			// The first request of most clients carries no credentials,
+			// which is not a failed login.
+			presented := r.Header.Get("Authorization") != ""
+			if c.Guard != nil && presented && (errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrInvalidToken)) {
+				c.Guard.Fail(username, ip, time.Now())
+			}
+			stateOf(r).authFailed = presented
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return nil
+		}
+		if c.Guard != nil {
+			c.Guard.Succeed(username)
+		}
+
+		u = user
+	} else {
+		// Even if Auth is disabled, we might want to get
+		// the user from the Basic Auth header.
+		if username, _, ok := r.BasicAuth(); ok {
+			if user, ok := c.Users[username]; ok && !user.Disabled {
+				u = user
+			}
+		}
+	}
+
+	if u == nil {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return nil
+	}
+	stateOf(r).user = u.Username
+	return u
+}
+
+// findUser resolves the user called username through the Authenticator,
+// without credentials, as for the tokens and the shares it issued. Users
+// that are unknown, or disabled, are refused.
+func (c *Config) findUser(username string) (*User, error) {
+	auth := c.Authenticator
+	if auth == nil {
+		auth = ConfigAuthenticator{Users: c.Users}
+	}
+	finder, ok := auth.(UserFinder)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	u, err := finder.FindUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// authenticate resolves the user of a request from its bearer token or
+// its basic auth credentials. Passwords are first checked against the
+// app passwords of the configured users, then by the Authenticator.
+func (c *Config) authenticate(r *http.Request) (*User, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if c.Tokens == nil {
+			return nil, ErrInvalidToken
+		}
+		claims, err := c.Tokens.Verify(token)
+		if err != nil {
+			logger.DefaultLogger.Info("invalid token from " + r.RemoteAddr)
+			return nil, err
+		}
+		u, err := c.findUser(claims.Subject)
+		if err != nil {
+			logger.DefaultLogger.Info("token of unknown user " + claims.Subject + " from " + r.RemoteAddr)
+			return nil, err
+		}
+		return u.Restrict(claims.Restriction()), nil
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	if u, ok := c.Users[username]; ok {
+		if app, ok := authenticateApp(u, password); ok {
+			return app, nil
+		}
+	}
+
+	auth := c.Authenticator
+	if auth == nil {
+		auth = ConfigAuthenticator{Users: c.Users}
+	}
+	u, err := auth.Authenticate(username, password)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			logger.DefaultLogger.Info("invalid credentials for " + username + " from " + r.RemoteAddr)
+		} else {
+			logger.DefaultLogger.Error("authenticate " + username + ": " + err.Error())
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// mount returns the handler serving the scope of u. Users sharing a scope
+// share its handler, so their locks are visible to each other. Local
+// scopes are provisioned the first time they are mounted. Users with
+// mounts share the handler of their mount table.
+func (c *Config) mount(u *User) (*webdav.Handler, error) {
+	if u.Handler != nil {
+		return u.Handler, nil
+	}
+
+	key := u.Scope
+	if len(u.Mounts) > 0 {
+		var b strings.Builder
+		for _, mp := range u.Mounts {
+			fmt.Fprintf(&b, "\x00%s\x00%s\x00%t", mp.Path, mp.Scope, mp.ReadOnly)
+		}
+		key = b.String()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h, ok := c.handlers[key]; ok {
+		return h, nil
+	}
+
+	var fs webdav.FileSystem
+	if len(u.Mounts) > 0 {
+		var mounts []Mount
+		for _, mp := range u.Mounts {
+			mfs, err := c.fileSystem(mp.Scope, !mp.ReadOnly)
+			if err != nil {
+				return nil, err
+			}
+			mounts = append(mounts, Mount{Path: mp.Path, FileSystem: mfs, ReadOnly: mp.ReadOnly})
+		}
+		fs = NewMountFS(mounts...)
+	} else {
+		var err error
+		if fs, err = c.fileSystem(u.Scope, true); err != nil {
+			return nil, err
+		}
+	}
+
+	ls, ok := c.locks[key]
+	if !ok {
+		ls = webdav.NewMemLS()
+		if c.locks == nil {
+			c.locks = map[string]webdav.LockSystem{}
+		}
+		c.locks[key] = ls
+	}
+	h := &webdav.Handler{
+		Prefix:     c.Prefix,
+		FileSystem: fs,
+		LockSystem: ls,
+	}
+	if c.handlers == nil {
+		c.handlers = map[string]*webdav.Handler{}
+	}
+	c.handlers[key] = h
+	return h, nil
+}
+
+// fileSystem returns the file system of a scope, provisioning local
+// scopes when provision is set. It must be called with mu held.
+func (c *Config) fileSystem(scope string, provision bool) (webdav.FileSystem, error) {
+	if c.Backend != nil {
+		return c.Backend(scope)
+	}
+	if c.Provision != nil && provision {
+		if err := c.Provision.Ensure(scope); err != nil {
+			return nil, err
+		}
+	}
+
+	d := WebDavDir{
+		Dir:      webdav.Dir(scope),
+		NoSniff:  c.NoSniff,
+		Scanning: c.Scanning,
+		Audit:    c.Audit,
+	}
+	if c.MasterKey != nil {
+		id, err := encryptionKeyID(scope)
+		if err != nil {
+			return nil, err
+		}
+		d.Key = DeriveKey(c.MasterKey, id)
+	}
+	if c.BrowseArchives {
+		if c.archives == nil {
+			c.archives = &ArchiveCache{}
+		}
+		d.Archives = c.archives
+	}
+	if c.Git != nil && c.Git.applies(scope) {
+		g, err := NewGitFS(d, scope)
+		if err != nil {
+			return nil, err
+		}
+		g.Window, g.HistoryLimit = c.Git.Window, c.Git.HistoryLimit
+		return g, nil
+	}
+	return d, nil
+}
@@ -0,0 +1,183 @@
+package webdav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfig(t *testing.T, data string) *Config {
+	t.Helper()
+
+	fc, err := ParseConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg, err := fc.Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return cfg
+}
+
+func TestConfigServeHTTP(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := testConfig(t, `{
+		"scope": "`+dir+`",
+		"debug": true,
+		"users": [
+			{"username": "admin", "password": "admin", "admin": true,
+			 "rules": [{"path": "/file.txt", "allow": false}]},
+			{"username": "bob", "password": "bob", "modify": true}
+		]
+	}`)
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		method   string
+		status   int
+		decision string
+	}{
+		{"unauthorized", "bob", "wrong", "GET", http.StatusUnauthorized, ""},
+		{"allowed", "bob", "bob", "GET", http.StatusOK, ""},
+		{"denied admin", "admin", "admin", "GET", http.StatusForbidden, `deny; rule=0; pattern="/file.txt"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/file.txt", nil)
+			r.SetBasicAuth(tt.user, tt.password)
+			w := httptest.NewRecorder()
+			cfg.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Get(DecisionHeader); got != tt.decision {
+				t.Errorf("expected decision header %q, got %q", tt.decision, got)
+			}
+		})
+	}
+}
+
+func TestConfigServeHTTPAppPasswordsAndTokens(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"docs/a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	cfg := testConfig(t, `{
+		"scope": "`+dir+`",
+		"modify": true,
+		"tokenSecret": "secret",
+		"users": [{"username": "alice", "password": "main", "appPasswords": [
+			{"name": "phone", "password": "phone", "path": "/docs", "readOnly": true},
+			{"name": "old", "password": "old", "revoked": true}
+		]}, {"username": "dave", "password": "dave", "disabled": true}]
+	}`)
+	token, err := cfg.Tokens.Issue(TokenClaims{Subject: "alice", Scope: "/docs"}, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Tokens outlive the users they were issued to.
+	removed, _ := cfg.Tokens.Issue(TokenClaims{Subject: "carol"}, time.Minute)
+	disabled, _ := cfg.Tokens.Issue(TokenClaims{Subject: "dave"}, time.Minute)
+
+	tests := []struct {
+		name     string
+		password string
+		bearer   string
+		method   string
+		path     string
+		status   int
+	}{
+		{"main password", "main", "", "PUT", "/b.txt", http.StatusCreated},
+		{"app password read", "phone", "", "GET", "/docs/a.txt", http.StatusOK},
+		{"app password outside path", "phone", "", "GET", "/b.txt", http.StatusForbidden},
+		{"app password write", "phone", "", "PUT", "/docs/a.txt", http.StatusForbidden},
+		{"revoked app password", "old", "", "GET", "/docs/a.txt", http.StatusUnauthorized},
+		{"token write", "", token, "PUT", "/docs/a.txt", http.StatusCreated},
+		{"token outside scope", "", token, "GET", "/b.txt", http.StatusForbidden},
+		{"invalid token", "", token + "x", "GET", "/docs/a.txt", http.StatusUnauthorized},
+		{"token of removed user", "", removed, "GET", "/docs/a.txt", http.StatusUnauthorized},
+		{"token of disabled user", "", disabled, "GET", "/docs/a.txt", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader("new"))
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			} else {
+				r.SetBasicAuth("alice", tt.password)
+			}
+			w := httptest.NewRecorder()
+			cfg.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestConfigServeHTTPCopy(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"archive", "inbox"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "archive/report.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := testConfig(t, `{
+		"scope": "`+dir+`",
+		"users": [{"username": "bob", "password": "bob", "rules": [
+			{"path": "/archive/", "allow": true},
+			{"path": "/inbox/", "allow": true, "modify": true}
+		]}]
+	}`)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		destination string
+		status      int
+	}{
+		{"copy out of read-only", "COPY", "/archive/report.txt", "/inbox/report.txt", http.StatusCreated},
+		{"copy into read-only", "COPY", "/inbox/report.txt", "/archive/copy.txt", http.StatusForbidden},
+		{"move out of read-only", "MOVE", "/archive/report.txt", "/inbox/moved.txt", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.SetBasicAuth("bob", "bob")
+			r.Header.Set("Destination", tt.destination)
+			w := httptest.NewRecorder()
+			cfg.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+}